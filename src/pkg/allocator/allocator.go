@@ -0,0 +1,215 @@
+// Package allocator hands out node ports from admin defined port ranges.
+package allocator
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrPoolExhausted is returned by Allocate if there is no free node port left
+var ErrPoolExhausted = errors.New("All node ports of the pool are in use")
+
+// IsExhaustedError returns true if a service could not be created because there is no free node port left
+func IsExhaustedError(err error) bool {
+	// The api server responds with 'failed to allocate a nodePort: range is full'
+	return errors.Is(err, ErrPoolExhausted) || (err != nil && strings.Contains(err.Error(), "range is full"))
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	First int32
+	Last  int32
+}
+
+// ParsePortRanges will split a string of '30000-30099,31000' into a list of ranges
+func ParsePortRanges(rangesString string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, val := range strings.Split(rangesString, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(val), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if first <= 0 || last >= 65536 || first > last {
+			return nil, errors.New("Port range '" + val + "' is not valid")
+		}
+		ranges = append(ranges, PortRange{First: int32(first), Last: int32(last)})
+	}
+	return ranges, nil
+}
+
+// PortInRanges returns true if the port is inside of any of the ranges
+func PortInRanges(port int32, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceKey returns the namespace/name key a node port is reserved for
+func ServiceKey(namespace string, serviceName string) string {
+	return namespace + "/" + serviceName
+}
+
+// Pool keeps track of which node ports of its ranges are in use. It is safe for concurrent use.
+type Pool struct {
+	mutex  sync.Mutex
+	ranges []PortRange
+	// node port => namespace/name of the service that uses it
+	used map[int32]string
+}
+
+// NewPool creates a pool of the ranges, e.g. '30000-30099,31000'
+func NewPool(rangesString string) (*Pool, error) {
+	ranges, err := ParsePortRanges(rangesString)
+	if err != nil {
+		return nil, err
+	}
+	return &Pool{
+		ranges: ranges,
+		used:   make(map[int32]string),
+	}, nil
+}
+
+// Ranges returns the ranges of the pool
+func (pool *Pool) Ranges() []PortRange {
+	return pool.ranges
+}
+
+// Contains returns true if the node port is part of the pool
+func (pool *Pool) Contains(nodePort int32) bool {
+	return PortInRanges(nodePort, pool.ranges)
+}
+
+// Allocate returns the first (or a random) free node port of the given ranges and reserves it for the service
+func (pool *Pool) Allocate(serviceKey string, ranges []PortRange, random bool) (int32, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var free []int32
+	for _, r := range ranges {
+		for nodePort := r.First; nodePort <= r.Last; nodePort++ {
+			if _, inUse := pool.used[nodePort]; !inUse {
+				free = append(free, nodePort)
+				if !random {
+					break
+				}
+			}
+		}
+		if len(free) > 0 && !random {
+			break
+		}
+	}
+	if len(free) == 0 {
+		return 0, ErrPoolExhausted
+	}
+
+	nodePort := free[0]
+	if random {
+		nodePort = free[rand.Intn(len(free))]
+	}
+	pool.used[nodePort] = serviceKey
+	return nodePort, nil
+}
+
+// AllocateBlock returns the first node port of a free block of consecutive node ports within one of the ranges.
+// The block has one node port per service key, which is reserved for that service. Empty keys are skipped but their
+// node ports still have to be free.
+func (pool *Pool) AllocateBlock(serviceKeys []string, ranges []PortRange) (int32, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	length := int32(len(serviceKeys))
+	for _, r := range ranges {
+		for base := r.First; base+length-1 <= r.Last; base++ {
+			free := true
+			for offset := int32(0); offset < length; offset++ {
+				if _, inUse := pool.used[base+offset]; inUse {
+					// The next block can only start after the used node port
+					base += offset
+					free = false
+					break
+				}
+			}
+			if !free {
+				continue
+			}
+			for offset, serviceKey := range serviceKeys {
+				if serviceKey != "" {
+					pool.used[base+int32(offset)] = serviceKey
+				}
+			}
+			return base, nil
+		}
+	}
+	return 0, ErrPoolExhausted
+}
+
+// MarkUsed reserves the node port for the service, node ports outside of the pool are ignored
+func (pool *Pool) MarkUsed(nodePort int32, serviceKey string) {
+	if !pool.Contains(nodePort) {
+		return
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.used[nodePort] = serviceKey
+}
+
+// Release releases all node ports of the service
+func (pool *Pool) Release(serviceKey string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for nodePort, key := range pool.used {
+		if key == serviceKey {
+			delete(pool.used, nodePort)
+		}
+	}
+}
+
+// ReleaseNodePort releases a single node port if it is reserved for the service
+func (pool *Pool) ReleaseNodePort(nodePort int32, serviceKey string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.used[nodePort] == serviceKey {
+		delete(pool.used, nodePort)
+	}
+}
+
+// Used returns the number of reserved node ports
+func (pool *Pool) Used() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.used)
+}
+
+// SyncUsage marks the node ports of all existing services as used, including services that are not managed by us
+func (pool *Pool) SyncUsage(client kubernetes.Interface, namespace string) error {
+	services, err := client.CoreV1().Services(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, service := range services.Items {
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 {
+				pool.MarkUsed(port.NodePort, ServiceKey(service.Namespace, service.Name))
+			}
+		}
+	}
+	return nil
+}
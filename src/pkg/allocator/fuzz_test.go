@@ -0,0 +1,22 @@
+package allocator
+
+import (
+	"testing"
+)
+
+func FuzzParsePortRanges(f *testing.F) {
+	for _, seed := range []string{"30000-30099,31000", "30000", "", ",", "1-65535", "0-10", "10-0", "65536", " 30000 - 30010 ", "30000-30010-30020"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		ranges, err := ParsePortRanges(value)
+		if err != nil {
+			return
+		}
+		for _, r := range ranges {
+			if r.First <= 0 || r.Last >= 65536 || r.First > r.Last {
+				t.Fatalf("'%s' produced the invalid range %d-%d", value, r.First, r.Last)
+			}
+		}
+	})
+}
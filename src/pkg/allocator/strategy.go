@@ -0,0 +1,42 @@
+package allocator
+
+import (
+	"sync"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PortRequest is the port of a pod a node port is allocated for
+type PortRequest = annotations.PortRequest
+
+// Strategy decides which node port is requested for a port of a pod. Custom strategies can be compiled in by calling
+// RegisterStrategy from an init function, they are selected with --allocation-strategy or the allocation-strategy
+// annotation of the pod.
+type Strategy interface {
+	// NodePort returns the node port that should be requested or 0 to let the api server pick one
+	NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error)
+	// Allocated is called after the service was created with its final node port
+	Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32)
+}
+
+var (
+	strategiesMutex sync.RWMutex
+	strategies      = map[string]Strategy{}
+)
+
+// RegisterStrategy makes the strategy selectable by its name, a strategy of the same name is replaced
+func RegisterStrategy(name string, strategy Strategy) {
+	strategiesMutex.Lock()
+	defer strategiesMutex.Unlock()
+	strategies[name] = strategy
+}
+
+// LookupStrategy returns the registered strategy of the name
+func LookupStrategy(name string) (Strategy, bool) {
+	strategiesMutex.RLock()
+	defer strategiesMutex.RUnlock()
+	strategy, ok := strategies[name]
+	return strategy, ok
+}
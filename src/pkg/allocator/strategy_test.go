@@ -0,0 +1,34 @@
+package allocator
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type fixedStrategy struct {
+	nodePort int32
+}
+
+func (strategy fixedStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	return strategy.nodePort, nil
+}
+
+func (fixedStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	if _, ok := LookupStrategy("fixed"); ok {
+		t.Fatal("Expected no strategy before it is registered")
+	}
+	RegisterStrategy("fixed", fixedStrategy{nodePort: 30100})
+	strategy, ok := LookupStrategy("fixed")
+	if !ok {
+		t.Fatal("Expected the registered strategy")
+	}
+	nodePort, err := strategy.NodePort(nil, &v1.Pod{}, PortRequest{Port: 7777, Protocol: v1.ProtocolUDP})
+	if err != nil || nodePort != 30100 {
+		t.Errorf("Expected node port 30100 of the strategy, got %d %v", nodePort, err)
+	}
+}
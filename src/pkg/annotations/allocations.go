@@ -0,0 +1,38 @@
+package annotations
+
+import (
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Allocation is an entry of the allocations annotation, an allocated port of the pod
+type Allocation struct {
+	Port     int32       `json:"port"`
+	Protocol v1.Protocol `json:"protocol"`
+	NodePort int32       `json:"nodePort"`
+	// The address of the endpoint annotation, empty if no address is advertised
+	Address string `json:"address,omitempty"`
+	// The service of the port, empty for host network pods
+	Service string `json:"service,omitempty"`
+}
+
+// ParseAllocations parses the JSON array of the allocations annotation
+func ParseAllocations(value string) ([]Allocation, error) {
+	var allocations []Allocation
+	err := json.Unmarshal([]byte(value), &allocations)
+	if err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+// FindAllocation returns the allocation of the port
+func FindAllocation(allocations []Allocation, port int32, protocol v1.Protocol) (Allocation, bool) {
+	for _, allocation := range allocations {
+		if allocation.Port == port && allocation.Protocol == protocol {
+			return allocation, true
+		}
+	}
+	return Allocation{}, false
+}
@@ -0,0 +1,67 @@
+package annotations
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func checkPortRequests(t *testing.T, input string, requests []PortRequest, maxRequests int) {
+	if len(requests) == 0 {
+		t.Fatalf("'%s' was accepted without any port", input)
+	}
+	if len(requests) > maxRequests {
+		t.Fatalf("'%s' expanded to %d ports", input, len(requests))
+	}
+	for _, request := range requests {
+		if request.Port <= 0 || request.Port >= 65536 {
+			t.Fatalf("'%s' produced the out of range port %d", input, request.Port)
+		}
+		switch request.Protocol {
+		case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		case "":
+			// Resolved from the declared container port later on
+			if request.Container == "" {
+				t.Fatalf("'%s' produced a request without protocol and container", input)
+			}
+		default:
+			t.Fatalf("'%s' produced the unknown protocol '%s'", input, request.Protocol)
+		}
+	}
+}
+
+func FuzzSplitLabelValue(f *testing.F) {
+	for _, seed := range []string{"8080", "8080.8082", "7000-7002.9000", "", ".", "-", "0", "65535", "65536", "1-65535", "9-1", "-5", "08080", "80 80"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, value string) {
+		requests, err := SplitLabelValue(value, v1.ProtocolTCP)
+		if err != nil {
+			return
+		}
+		checkPortRequests(t, value, requests, (strings.Count(value, ".")+1)*MaxPortRangeSize)
+	})
+}
+
+func FuzzParsePortRequestEntry(f *testing.F) {
+	for _, seed := range []string{"27015/udp", "27015/UDP", "game/7777", "game/7777/udp", "/7777", "game/", "7000-7005/sctp", "8080/http", "a/b/c/d", "group:source-engine"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, entry string) {
+		requests, err := ParsePortRequestEntry(entry, v1.ProtocolTCP)
+		if err != nil {
+			return
+		}
+		checkPortRequests(t, entry, requests, MaxPortRangeSize)
+		for _, request := range requests {
+			if strings.Contains(request.Container, "/") {
+				t.Fatalf("'%s' produced the container '%s'", entry, request.Container)
+			}
+			// The key is used within object names and annotation keys
+			if strings.ContainsAny(request.Key(), "/. ") {
+				t.Fatalf("'%s' produced the key '%s'", entry, request.Key())
+			}
+		}
+	})
+}
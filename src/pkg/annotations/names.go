@@ -0,0 +1,236 @@
+// Package annotations defines the labels and annotations of the pods, services and namespaces that are managed
+// and parses the port requests of a pod.
+package annotations
+
+import (
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// DefaultPrefix is the default prefix of all annotations and labels that are set or read
+const DefaultPrefix = "dynamic-hostports.k8s"
+
+// DefaultLabelKey is the default label key of the pods that should be managed
+const DefaultLabelKey = "dynamic-hostports"
+
+// AutoLabelValue is the label value that exposes all container ports of the pod
+const AutoLabelValue = "auto"
+
+// ManagedByLabelKey is set on everything that is created, its value is Names.ManagedByLabelValue
+const ManagedByLabelKey = "app.kubernetes.io/managed-by"
+
+// Names are the label and annotation names that are derived from a label key and annotation prefix.
+// Both are configurable, so multiple isolated instances can run in one cluster.
+type Names struct {
+	LabelKey string
+	Prefix   string
+
+	ManagedByLabelValue string
+	ForPodLabel         string
+	// Label of the services in the service namespace with the namespace of their pod
+	ForPodNamespaceLabel string
+	// Label of the services with the uid of their pod, which tells apart the incarnations of a recreated pod
+	PodUIDLabel string
+	// Service annotation with the node of the pod the service was created for
+	Node string
+	// Pod annotation with the DNS name of its headless service
+	ClusterDNS string
+	// Service and pod annotation with the time the controller last confirmed that it maintains them
+	LastReconciled string
+
+	// Pod annotation with the ports to expose, which supports port groups and protocols in contrast to the label value
+	Ports string
+	// Pod annotation that can be set by the user to advertise a specific address instead of the node's external ip
+	ExternalIPOverride string
+	// Deployment or StatefulSet annotation with the node ports of all its pods
+	Mappings string
+	// Pod annotation with the advertised ips, also set on services that are not limited to them by their external ips
+	ExternalIP string
+	// Pod annotation with a JSON array of all allocated ports of the pod
+	Allocations string
+	// Pod annotation with the DNS name or hostname of the node that is advertised in the endpoints instead of its ips
+	ExternalHostname string
+	// Pod annotations with the topology.kubernetes.io/zone and region labels of the node
+	Zone   string
+	Region string
+	// Pod or namespace annotation that suspends the management
+	Paused string
+	// Label of namespaces that are managed if the namespace opt-in is enabled
+	NamespaceEnabled string
+	// Label of namespaces that are never touched
+	NamespaceExcluded string
+	// Pod annotation that allows requested ports that no container declares
+	AllowUndeclaredPorts string
+	// Label of the namespaces and ServiceAccounts of a tenant and of everything that an instance of the tenant creates
+	Tenant string
+
+	// Pod annotations that override the corresponding flags for the generated services
+	IPFamilyPolicy           string
+	IPFamilies               string
+	ExternalTrafficPolicy    string
+	InternalTrafficPolicy    string
+	SessionAffinity          string
+	SessionAffinityTimeout   string
+	PublishNotReadyAddresses string
+	RequireReady             string
+	PreAllocate              string
+	AllocationStrategy       string
+	BaseNodePort             string
+	PreferredNodePort        string
+	DefaultProtocol          string
+	ServiceType              string
+	NodeAddressPreference    string
+	NodePortPool             string
+	LeaseTTL                 string
+	HeadlessService          string
+	AdvertiseNodeNames       string
+	// Pod annotation with the time the lease was renewed, set by the workload or its operator
+	LeaseRenewed string
+}
+
+// NewNames derives all label and annotation names from the label key and annotation prefix
+func NewNames(labelKey string, prefix string) Names {
+	return Names{
+		LabelKey:                 labelKey,
+		Prefix:                   prefix,
+		ManagedByLabelValue:      prefix,
+		ForPodLabel:              prefix + "/for-pod",
+		ForPodNamespaceLabel:     prefix + "/for-pod-namespace",
+		PodUIDLabel:              prefix + "/pod-uid",
+		Node:                     prefix + "/node",
+		ClusterDNS:               prefix + "/cluster-dns",
+		LastReconciled:           prefix + "/last-reconciled",
+		Ports:                    prefix + "/ports",
+		ExternalIPOverride:       prefix + "/external-ip-override",
+		Mappings:                 prefix + "/mappings",
+		ExternalIP:               prefix + "/external-ip",
+		ExternalHostname:         prefix + "/external-hostname",
+		Allocations:              prefix + "/allocations",
+		Zone:                     prefix + "/zone",
+		Region:                   prefix + "/region",
+		Paused:                   prefix + "/paused",
+		NamespaceEnabled:         prefix + "/enabled",
+		NamespaceExcluded:        prefix + "/excluded",
+		AllowUndeclaredPorts:     prefix + "/allow-undeclared-ports",
+		Tenant:                   prefix + "/tenant",
+		IPFamilyPolicy:           prefix + "/ip-family-policy",
+		IPFamilies:               prefix + "/ip-families",
+		ExternalTrafficPolicy:    prefix + "/external-traffic-policy",
+		InternalTrafficPolicy:    prefix + "/internal-traffic-policy",
+		SessionAffinity:          prefix + "/session-affinity",
+		SessionAffinityTimeout:   prefix + "/session-affinity-timeout",
+		PublishNotReadyAddresses: prefix + "/publish-not-ready-addresses",
+		RequireReady:             prefix + "/require-ready",
+		PreAllocate:              prefix + "/pre-allocate",
+		AllocationStrategy:       prefix + "/allocation-strategy",
+		BaseNodePort:             prefix + "/base-nodeport",
+		PreferredNodePort:        prefix + "/preferred",
+		DefaultProtocol:          prefix + "/default-protocol",
+		ServiceType:              prefix + "/service-type",
+		NodeAddressPreference:    prefix + "/node-address-preference",
+		NodePortPool:             prefix + "/nodeport-pool",
+		LeaseTTL:                 prefix + "/lease-ttl",
+		HeadlessService:          prefix + "/headless-service",
+		AdvertiseNodeNames:       prefix + "/advertise-node-names",
+		LeaseRenewed:             prefix + "/lease-renewed",
+	}
+}
+
+// NodePort returns the pod annotation with the node port of the request, e.g. 'PREFIX/8080'
+func (names Names) NodePort(request PortRequest) string {
+	return names.Prefix + "/" + request.Key()
+}
+
+// Endpoint returns the pod annotation with the first advertised ip:port of the request
+func (names Names) Endpoint(request PortRequest) string {
+	return names.Prefix + "/endpoint-" + request.Key()
+}
+
+// Endpoints returns the pod annotation with all advertised ip:port of the request, which is only set for multiple ips
+func (names Names) Endpoints(request PortRequest) string {
+	return names.Prefix + "/endpoints-" + request.Key()
+}
+
+// Block returns the pod annotation with the length of a block of consecutive ports that starts at the request and
+// needs consecutive node ports, e.g. 'PREFIX/block-5004'
+func (names Names) Block(request PortRequest) string {
+	return names.Prefix + "/" + blockPrefix + request.Key()
+}
+
+// BlockNodePort returns the pod annotation with the first node port of the block that starts at the request
+func (names Names) BlockNodePort(request PortRequest) string {
+	return names.Prefix + "/" + blockNodePortPrefix + request.Key()
+}
+
+// BlockLength returns the pod annotation with the number of node ports of the block that starts at the request
+func (names Names) BlockLength(request PortRequest) string {
+	return names.Prefix + "/" + blockLengthPrefix + request.Key()
+}
+
+const blockPrefix = "block-"
+const blockNodePortPrefix = "block-nodeport-"
+const blockLengthPrefix = "block-length-"
+
+// BlockRequests returns the ports of the block if the key is a block annotation, e.g. 5004-5007 for
+// 'PREFIX/block-5004: "4"'. False is returned for all other annotations.
+func (names Names) BlockRequests(key string, value string, defaultProtocol v1.Protocol) ([]PortRequest, bool, error) {
+	name, ok := strings.CutPrefix(key, names.Prefix+"/"+blockPrefix)
+	if !ok || !isNodePort(name) {
+		return nil, false, nil
+	}
+	requests, err := ParseBlock(name, value, defaultProtocol)
+	return requests, true, err
+}
+
+// IsOutput returns true for the annotations that are set on pods, in contrast to the ones that are set by the user
+func (names Names) IsOutput(key string) bool {
+	name, ok := strings.CutPrefix(key, names.Prefix+"/")
+	if !ok {
+		return false
+	}
+	if key == names.ExternalIP || key == names.ExternalHostname || key == names.Allocations || key == names.Zone || key == names.Region || key == names.ClusterDNS || key == names.LastReconciled || strings.HasPrefix(name, "endpoint-") || strings.HasPrefix(name, "endpoints-") || strings.HasPrefix(name, blockNodePortPrefix) || strings.HasPrefix(name, blockLengthPrefix) {
+		return true
+	}
+	return isNodePort(name)
+}
+
+// PortLabel returns the pod label that mirrors a node port annotation, e.g. 'PREFIX/np-8080' for 'PREFIX/8080'.
+// False is returned for all other annotations.
+func (names Names) PortLabel(key string) (string, bool) {
+	name, ok := strings.CutPrefix(key, names.Prefix+"/")
+	if !ok || !isNodePort(name) {
+		return "", false
+	}
+	return names.Prefix + "/np-" + name, true
+}
+
+// NodePortRequest returns the port of a node port annotation, e.g. 27015/udp for 'PREFIX/27015-udp'. False is
+// returned for all other annotations.
+func (names Names) NodePortRequest(key string) (PortRequest, bool) {
+	name, ok := strings.CutPrefix(key, names.Prefix+"/")
+	if !ok || !isNodePort(name) {
+		return PortRequest{}, false
+	}
+	portString, protocolString, hasProtocol := strings.Cut(name, "-")
+	port, err := ParseHostport(portString)
+	if err != nil {
+		return PortRequest{}, false
+	}
+	request := PortRequest{Port: port, Protocol: v1.ProtocolTCP}
+	if hasProtocol {
+		request.Protocol, err = ParseProtocol(protocolString)
+		if err != nil {
+			return PortRequest{}, false
+		}
+	}
+	return request, true
+}
+
+// The node port annotations are named after the port, e.g. '8080' or '27015-udp'
+func isNodePort(name string) bool {
+	port, _, _ := strings.Cut(name, "-")
+	_, err := strconv.Atoi(port)
+	return err == nil
+}
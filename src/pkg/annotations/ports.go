@@ -0,0 +1,273 @@
+package annotations
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// MaxPortRangeSize is the upper limit of ports a single range may expand to
+const MaxPortRangeSize = 1000
+
+// LabelValueSyntax describes the expected value of the label
+const LabelValueSyntax = "'auto' or ports separated by '.', e.g. '8080.27015-27020.9000/udp'"
+
+// PortsAnnotationSyntax describes the expected value of the ports annotation
+const PortsAnnotationSyntax = "entries separated by ',', e.g. '8080, 27015-27020/udp, game/7777, group:NAME'"
+
+// InvalidValueError is returned if the label or the ports annotation of a pod can't be parsed
+type InvalidValueError struct {
+	Key    string
+	Value  string
+	Syntax string
+	Err    error
+}
+
+func (err InvalidValueError) Error() string {
+	return "Invalid value '" + err.Value + "' of '" + err.Key + "' (" + err.Err.Error() + "), expected " + err.Syntax
+}
+
+func (err InvalidValueError) Unwrap() error {
+	return err.Err
+}
+
+// PortRequest is a single port of a pod that should be exposed
+type PortRequest struct {
+	Port     int32
+	Protocol v1.Protocol
+	// Optional name of the container that has to declare the port
+	Container string
+}
+
+// Key identifies the request within object names and annotation keys. TCP ports are just the port for compatibility.
+func (request PortRequest) Key() string {
+	if request.Protocol == v1.ProtocolTCP {
+		return strconv.Itoa(int(request.Port))
+	}
+	return strconv.Itoa(int(request.Port)) + "-" + strings.ToLower(string(request.Protocol))
+}
+
+func (request PortRequest) String() string {
+	return strconv.Itoa(int(request.Port)) + "/" + strings.ToLower(string(request.Protocol))
+}
+
+// ParseHostport parses a port between 1 and 65535
+func ParseHostport(val string) (int32, error) {
+	port, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if port <= 0 || port >= 65536 {
+		return 0, errors.New("Port is not in valid range")
+	}
+	return int32(port), nil
+}
+
+// ParseProtocol parses a case insensitive 'tcp', 'udp' or 'sctp'
+func ParseProtocol(val string) (v1.Protocol, error) {
+	switch protocol := v1.Protocol(strings.ToUpper(val)); protocol {
+	case v1.ProtocolTCP, v1.ProtocolUDP, v1.ProtocolSCTP:
+		return protocol, nil
+	default:
+		return "", errors.New("Unknown protocol '" + val + "'")
+	}
+}
+
+// ParsePortRequestEntry will parse a single entry like '8080', '7000-7005', '27015/udp' or 'game/7777'.
+// Ranges are expanded to all of their ports. Entries without a protocol get the default protocol, container scoped ones
+// the protocol of the declared container port once they are resolved by ResolveContainerPorts.
+func ParsePortRequestEntry(entry string, defaultProtocol v1.Protocol) ([]PortRequest, error) {
+	parts := strings.Split(entry, "/")
+	container := ""
+	if len(parts) > 1 && (parts[0] == "" || parts[0][0] < '0' || parts[0][0] > '9') {
+		container = parts[0]
+		parts = parts[1:]
+	}
+	if len(parts) > 2 {
+		return nil, errors.New("Port entry '" + entry + "' has too many parts")
+	}
+
+	protocol := defaultProtocol
+	if container != "" {
+		protocol = ""
+	}
+	portsString := parts[0]
+	if len(parts) == 2 {
+		var err error
+		protocol, err = ParseProtocol(parts[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bounds := strings.SplitN(portsString, "-", 2)
+	first, err := ParseHostport(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	last := first
+	if len(bounds) == 2 {
+		last, err = ParseHostport(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if first > last {
+			return nil, errors.New("Port range '" + portsString + "' is reversed")
+		}
+		if last-first >= MaxPortRangeSize {
+			return nil, errors.New("Port range '" + portsString + "' is too large")
+		}
+	}
+
+	var requests []PortRequest
+	for port := first; port <= last; port++ {
+		requests = append(requests, PortRequest{Port: port, Protocol: protocol, Container: container})
+	}
+	return requests, nil
+}
+
+// BlockSyntax describes the expected value of a block annotation
+const BlockSyntax = "the number of consecutive ports, e.g. '4'"
+
+// ParseBlock parses the port key of a block annotation (e.g. '5004' or '5004-udp') and its length to the ports of the
+// block. Keys without a protocol get the default protocol.
+func ParseBlock(key string, length string, defaultProtocol v1.Protocol) ([]PortRequest, error) {
+	portString, protocolString, hasProtocol := strings.Cut(key, "-")
+	first, err := ParseHostport(portString)
+	if err != nil {
+		return nil, err
+	}
+	protocol := defaultProtocol
+	if hasProtocol {
+		protocol, err = ParseProtocol(protocolString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	size, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 || size > MaxPortRangeSize || int(first)+size-1 >= 65536 {
+		return nil, errors.New("Block length '" + length + "' is not valid")
+	}
+
+	requests := make([]PortRequest, size)
+	for i := range requests {
+		requests[i] = PortRequest{Port: first + int32(i), Protocol: protocol}
+	}
+	return requests, nil
+}
+
+// SplitLabelValue will split a label value of '8080.8082' to the ports [8080, 8082] of the default protocol.
+// Ranges are expanded, so '7000-7002.9000' becomes [7000, 7001, 7002, 9000]
+func SplitLabelValue(portsString string, defaultProtocol v1.Protocol) ([]PortRequest, error) {
+	var mapped []PortRequest
+
+	for _, val := range strings.Split(portsString, ".") {
+		requests, err := ParsePortRequestEntry(val, defaultProtocol)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, requests...)
+	}
+
+	return mapped, nil
+}
+
+// ResolveContainerPorts checks that the container of container scoped requests declares the port and fills in the
+// declared protocol
+func ResolveContainerPorts(pod *v1.Pod, requests []PortRequest) ([]PortRequest, error) {
+	resolved := make([]PortRequest, len(requests))
+	for i, request := range requests {
+		resolved[i] = request
+		if request.Container == "" {
+			continue
+		}
+
+		var container *v1.Container
+		for c := range pod.Spec.Containers {
+			if pod.Spec.Containers[c].Name == request.Container {
+				container = &pod.Spec.Containers[c]
+				break
+			}
+		}
+		if container == nil {
+			return nil, errors.New("Pod has no container '" + request.Container + "'")
+		}
+
+		declared := false
+		for _, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			if port.ContainerPort == request.Port && (request.Protocol == "" || request.Protocol == protocol) {
+				resolved[i].Protocol = protocol
+				declared = true
+				break
+			}
+		}
+		if !declared {
+			return nil, errors.New("Container '" + request.Container + "' does not declare port " + strconv.Itoa(int(request.Port)))
+		}
+	}
+	return resolved, nil
+}
+
+// DeclaredContainerPorts returns all container ports that are declared in the pod spec
+func DeclaredContainerPorts(pod *v1.Pod) []PortRequest {
+	var requests []PortRequest
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			requests = append(requests, PortRequest{Port: port.ContainerPort, Protocol: protocol, Container: container.Name})
+		}
+	}
+	return requests
+}
+
+// UndeclaredPorts returns the requests whose port is not declared by any container, or not by their container.
+// Traffic to them is most likely lost.
+func UndeclaredPorts(pod *v1.Pod, requests []PortRequest) []PortRequest {
+	var undeclared []PortRequest
+	for _, request := range requests {
+		declared := false
+		for _, container := range pod.Spec.Containers {
+			if request.Container != "" && container.Name != request.Container {
+				continue
+			}
+			for _, port := range container.Ports {
+				protocol := port.Protocol
+				if protocol == "" {
+					protocol = v1.ProtocolTCP
+				}
+				if port.ContainerPort == request.Port && protocol == request.Protocol {
+					declared = true
+				}
+			}
+		}
+		if !declared {
+			undeclared = append(undeclared, request)
+		}
+	}
+	return undeclared
+}
+
+// UniquePortRequests removes duplicates, the containers of a pod share their network so a port can only be exposed once
+func UniquePortRequests(requests []PortRequest) []PortRequest {
+	var unique []PortRequest
+	seen := make(map[string]bool)
+	for _, request := range requests {
+		if !seen[request.Key()] {
+			seen[request.Key()] = true
+			unique = append(unique, request)
+		}
+	}
+	return unique
+}
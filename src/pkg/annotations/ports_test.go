@@ -0,0 +1,186 @@
+package annotations
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSplitLabelValue(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  []PortRequest
+		expectErr bool
+	}{
+		{value: "8080", expected: []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}}},
+		{value: "8080.8082", expected: []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}, {Port: 8082, Protocol: v1.ProtocolTCP}}},
+		{value: "7000-7002", expected: []PortRequest{{Port: 7000, Protocol: v1.ProtocolTCP}, {Port: 7001, Protocol: v1.ProtocolTCP}, {Port: 7002, Protocol: v1.ProtocolTCP}}},
+		{value: "", expectErr: true},
+		{value: "http", expectErr: true},
+		{value: "0", expectErr: true},
+		{value: "65536", expectErr: true},
+		{value: "7002-7000", expectErr: true},
+		{value: "1-2000", expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			requests, err := SplitLabelValue(test.value, v1.ProtocolTCP)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if !test.expectErr && !reflect.DeepEqual(requests, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, requests)
+			}
+		})
+	}
+}
+
+func TestParsePortRequestEntry(t *testing.T) {
+	tests := []struct {
+		entry     string
+		expected  []PortRequest
+		expectErr bool
+	}{
+		{entry: "27015/udp", expected: []PortRequest{{Port: 27015, Protocol: v1.ProtocolUDP}}},
+		{entry: "27015/UDP", expected: []PortRequest{{Port: 27015, Protocol: v1.ProtocolUDP}}},
+		{entry: "9000/sctp", expected: []PortRequest{{Port: 9000, Protocol: v1.ProtocolSCTP}}},
+		{entry: "game/7777", expected: []PortRequest{{Port: 7777, Container: "game"}}},
+		{entry: "game/7777/udp", expected: []PortRequest{{Port: 7777, Protocol: v1.ProtocolUDP, Container: "game"}}},
+		{entry: "8080/http", expectErr: true},
+		{entry: "game/7777/udp/tcp", expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.entry, func(t *testing.T) {
+			requests, err := ParsePortRequestEntry(test.entry, v1.ProtocolTCP)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if !test.expectErr && !reflect.DeepEqual(requests, test.expected) {
+				t.Errorf("Expected %v, got %v", test.expected, requests)
+			}
+		})
+	}
+}
+
+func TestBlockRequests(t *testing.T) {
+	names := NewNames(DefaultLabelKey, DefaultPrefix)
+	requests, ok, err := names.BlockRequests(DefaultPrefix+"/block-5004-udp", "2", v1.ProtocolTCP)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	expected := []PortRequest{{Port: 5004, Protocol: v1.ProtocolUDP}, {Port: 5005, Protocol: v1.ProtocolUDP}}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected %v, got %v", expected, requests)
+	}
+
+	for _, key := range []string{DefaultPrefix + "/block-nodeport-5004", DefaultPrefix + "/block-length-5004", DefaultPrefix + "/5004"} {
+		if _, ok, _ := names.BlockRequests(key, "2", v1.ProtocolTCP); ok {
+			t.Errorf("Expected %s to be no block annotation", key)
+		}
+	}
+	for _, length := range []string{"0", "-1", "two", "1001"} {
+		if _, _, err := names.BlockRequests(DefaultPrefix+"/block-5004", length, v1.ProtocolTCP); err == nil {
+			t.Errorf("Expected an error for the length %q", length)
+		}
+	}
+}
+
+func TestResolveContainerPorts(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{
+		{Name: "game", Ports: []v1.ContainerPort{{ContainerPort: 7777, Protocol: v1.ProtocolUDP}, {ContainerPort: 8080}}},
+	}}}
+
+	resolved, err := ResolveContainerPorts(pod, []PortRequest{{Port: 7777, Container: "game"}, {Port: 8080, Container: "game"}, {Port: 9000, Protocol: v1.ProtocolTCP}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PortRequest{{Port: 7777, Protocol: v1.ProtocolUDP, Container: "game"}, {Port: 8080, Protocol: v1.ProtocolTCP, Container: "game"}, {Port: 9000, Protocol: v1.ProtocolTCP}}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Expected %v, got %v", expected, resolved)
+	}
+
+	for _, request := range []PortRequest{{Port: 7777, Container: "other"}, {Port: 9999, Container: "game"}, {Port: 7777, Protocol: v1.ProtocolTCP, Container: "game"}} {
+		_, err := ResolveContainerPorts(pod, []PortRequest{request})
+		if err == nil {
+			t.Errorf("Expected an error for %+v", request)
+		}
+	}
+}
+
+func TestUniquePortRequests(t *testing.T) {
+	requests := []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}, {Port: 8080, Protocol: v1.ProtocolUDP}, {Port: 8080, Protocol: v1.ProtocolTCP, Container: "app"}}
+	unique := UniquePortRequests(requests)
+	if len(unique) != 2 {
+		t.Errorf("Expected 2 requests, got %v", unique)
+	}
+}
+
+func TestIsOutput(t *testing.T) {
+	names := NewNames(DefaultLabelKey, DefaultPrefix)
+	tests := map[string]bool{
+		DefaultPrefix + "/8080":                 true,
+		DefaultPrefix + "/27015-udp":            true,
+		DefaultPrefix + "/endpoint-8080":        true,
+		DefaultPrefix + "/endpoints-8080":       true,
+		DefaultPrefix + "/external-ip":          true,
+		DefaultPrefix + "/external-hostname":    true,
+		DefaultPrefix + "/allocations":          true,
+		DefaultPrefix + "/zone":                 true,
+		DefaultPrefix + "/region":               true,
+		DefaultPrefix + "/cluster-dns":          true,
+		DefaultPrefix + "/last-reconciled":      true,
+		DefaultPrefix + "/headless-service":     false,
+		DefaultPrefix + "/block-nodeport-5004":  true,
+		DefaultPrefix + "/block-length-5004":    true,
+		DefaultPrefix + "/block-5004":           false,
+		DefaultPrefix + "/lease-renewed":        false,
+		DefaultPrefix + "/ports":                false,
+		DefaultPrefix + "/paused":               false,
+		DefaultPrefix + "/external-ip-override": false,
+		"other.example.com/8080":                false,
+	}
+	for key, expected := range tests {
+		if names.IsOutput(key) != expected {
+			t.Errorf("Expected IsOutput(%s) to be %v", key, expected)
+		}
+	}
+}
+
+func TestPortLabel(t *testing.T) {
+	names := NewNames(DefaultLabelKey, DefaultPrefix)
+	tests := map[string]string{
+		DefaultPrefix + "/8080":          DefaultPrefix + "/np-8080",
+		DefaultPrefix + "/27015-udp":     DefaultPrefix + "/np-27015-udp",
+		DefaultPrefix + "/endpoint-8080": "",
+		DefaultPrefix + "/external-ip":   "",
+		"other.example.com/8080":         "",
+	}
+	for key, expected := range tests {
+		label, ok := names.PortLabel(key)
+		if label != expected || ok != (expected != "") {
+			t.Errorf("Expected PortLabel(%s) to be %q, got %q %v", key, expected, label, ok)
+		}
+	}
+}
+
+func TestNodePortRequest(t *testing.T) {
+	names := NewNames(DefaultLabelKey, DefaultPrefix)
+	tests := map[string]*PortRequest{
+		DefaultPrefix + "/8080":          {Port: 8080, Protocol: v1.ProtocolTCP},
+		DefaultPrefix + "/27015-udp":     {Port: 27015, Protocol: v1.ProtocolUDP},
+		DefaultPrefix + "/endpoint-8080": nil,
+		DefaultPrefix + "/block-5004":    nil,
+		DefaultPrefix + "/70000":         nil,
+		DefaultPrefix + "/8080-quic":     nil,
+		"other.example.com/8080":         nil,
+	}
+	for key, expected := range tests {
+		request, ok := names.NodePortRequest(key)
+		if ok != (expected != nil) || (ok && request != *expected) {
+			t.Errorf("Expected NodePortRequest(%s) to be %v, got %v %v", key, expected, request, ok)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package client looks up the allocations of a pod from within the pod, e.g. for a game server that has to announce
+// its public address and port.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// ErrNotAllocated is returned by Get if the pod has no allocations yet
+var ErrNotAllocated = errors.New("The pod has no allocations yet")
+
+// The environment variables NewInCluster reads the pod from, set them with the downward API
+const (
+	PodNameEnv      = "POD_NAME"
+	PodNamespaceEnv = "POD_NAMESPACE"
+)
+
+// The namespace of the service account, used if POD_NAMESPACE is not set
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// The bound service account token of the pod, the whoami service authenticates the pod with it
+const serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// How long Watch waits before it watches again after the watch failed
+const rewatchDelay = time.Second
+
+// DefaultWhoamiURL is the whoami service of the controller as it is deployed by deploy.yaml
+const DefaultWhoamiURL = "http://dynamic-hostports-whoami.dynamic-hostports.svc:8081"
+
+// How often Watch asks the whoami service for changes
+var whoamiPollInterval = 2 * time.Second
+
+// Client reads the allocations annotation of one pod. It needs the permission to get and watch the pod, or it asks
+// the whoami service of the controller, which needs no permissions.
+type Client struct {
+	kube      kubernetes.Interface
+	names     annotations.Names
+	namespace string
+	name      string
+	// The base url of the whoami service, the pod is read from the api server if it is empty
+	whoamiURL  string
+	httpClient *http.Client
+	// Read on every request, the kubelet rotates the token
+	whoamiTokenFile string
+}
+
+// The answer of the whoami service
+type whoamiResponse struct {
+	Allocations []annotations.Allocation `json:"allocations"`
+}
+
+// New returns the client of the pod. The names have to match the --label-key and --annotation-prefix of the
+// controller, usually annotations.NewNames(annotations.DefaultLabelKey, annotations.DefaultPrefix).
+func New(kube kubernetes.Interface, namespace string, name string, names annotations.Names) *Client {
+	return &Client{kube: kube, names: names, namespace: namespace, name: name}
+}
+
+// NewInCluster returns the client of the own pod with the default names. The pod is read from the POD_NAME and
+// POD_NAMESPACE environment variables, the namespace falls back to the one of the service account.
+func NewInCluster() (*Client, error) {
+	namespace, name, err := podFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return New(kube, namespace, name, annotations.NewNames(annotations.DefaultLabelKey, annotations.DefaultPrefix)), nil
+}
+
+// NewWhoami returns the client of the pod that asks the whoami service of the controller at the base url (e.g.
+// DefaultWhoamiURL). The service only answers the pod itself, which is authenticated with its mounted service
+// account token. Without a token it only works if the controller runs with --whoami-source-ip-auth.
+func NewWhoami(baseURL string, namespace string, name string) *Client {
+	return &Client{namespace: namespace, name: name, whoamiURL: strings.TrimSuffix(baseURL, "/"), httpClient: &http.Client{Timeout: 10 * time.Second}, whoamiTokenFile: serviceAccountTokenFile}
+}
+
+// NewWhoamiInCluster returns the whoami client of the own pod, which is read like with NewInCluster
+func NewWhoamiInCluster(baseURL string) (*Client, error) {
+	namespace, name, err := podFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewWhoami(baseURL, namespace, name), nil
+}
+
+func podFromEnv() (string, string, error) {
+	name := os.Getenv(PodNameEnv)
+	if name == "" {
+		return "", "", errors.New("The environment variable " + PodNameEnv + " is not set")
+	}
+	namespace := os.Getenv(PodNamespaceEnv)
+	if namespace == "" {
+		content, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return "", "", errors.New("The environment variable " + PodNamespaceEnv + " is not set " + err.Error())
+		}
+		namespace = strings.TrimSpace(string(content))
+	}
+	return namespace, name, nil
+}
+
+// Get returns the current allocations of the pod, or ErrNotAllocated if it has none yet
+func (c *Client) Get(ctx context.Context) ([]annotations.Allocation, error) {
+	if c.whoamiURL != "" {
+		return c.getWhoami(ctx)
+	}
+	pod, err := c.kube.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return c.podAllocations(pod)
+}
+
+// Wait blocks until the pod has allocations and returns them
+func (c *Client) Wait(ctx context.Context) ([]annotations.Allocation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes, err := c.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allocations, ok := <-changes
+	if !ok {
+		return nil, ctx.Err()
+	}
+	return allocations, nil
+}
+
+// Watch sends the allocations of the pod once it has them and again whenever they change, e.g. because the address
+// of the node changed. The channel is closed when the context is done. The whoami service is polled.
+func (c *Client) Watch(ctx context.Context) (<-chan []annotations.Allocation, error) {
+	if c.whoamiURL != "" {
+		return c.pollWhoami(ctx)
+	}
+	pod, err := c.kube.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan []annotations.Allocation)
+	go func() {
+		defer close(changes)
+		sent := ""
+		for {
+			if value := pod.Annotations[c.names.Allocations]; value != sent {
+				allocations, err := c.podAllocations(pod)
+				if err == nil {
+					select {
+					case changes <- allocations:
+					case <-ctx.Done():
+						return
+					}
+				}
+				sent = value
+			}
+
+			next, err := c.nextPod(ctx, pod.ResourceVersion)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// The watch might have expired, the pod is read again
+				select {
+				case <-time.After(rewatchDelay):
+				case <-ctx.Done():
+					return
+				}
+				next, err = c.kube.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+				if err != nil {
+					continue
+				}
+			}
+			pod = next
+		}
+	}()
+	return changes, nil
+}
+
+// Watches the pod from the resource version until it changes
+func (c *Client) nextPod(ctx context.Context, resourceVersion string) (*v1.Pod, error) {
+	watcher, err := c.kube.CoreV1().Pods(c.namespace).Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", c.name).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		pod, ok := event.Object.(*v1.Pod)
+		if !ok || pod.Name != c.name {
+			continue
+		}
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			return pod, nil
+		case watch.Deleted:
+			return nil, errors.New("The pod was deleted")
+		}
+	}
+	return nil, errors.New("The watch of the pod was closed")
+}
+
+// Asks the whoami service for the allocations of the pod
+func (c *Client) getWhoami(ctx context.Context) ([]annotations.Allocation, error) {
+	query := url.Values{"namespace": {c.namespace}, "name": {c.name}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.whoamiURL+"/whoami?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := os.ReadFile(c.whoamiTokenFile)
+	if err == nil {
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("The whoami service answered with '" + response.Status + "'")
+	}
+	var answer whoamiResponse
+	err = json.NewDecoder(response.Body).Decode(&answer)
+	if err != nil {
+		return nil, err
+	}
+	if len(answer.Allocations) == 0 {
+		return nil, ErrNotAllocated
+	}
+	return answer.Allocations, nil
+}
+
+// Polls the whoami service and sends the allocations whenever they change
+func (c *Client) pollWhoami(ctx context.Context) (<-chan []annotations.Allocation, error) {
+	allocations, err := c.getWhoami(ctx)
+	if err != nil && !errors.Is(err, ErrNotAllocated) {
+		return nil, err
+	}
+	changes := make(chan []annotations.Allocation)
+	go func() {
+		defer close(changes)
+		var sent []annotations.Allocation
+		for {
+			if len(allocations) > 0 && !slices.Equal(allocations, sent) {
+				select {
+				case changes <- allocations:
+				case <-ctx.Done():
+					return
+				}
+				sent = allocations
+			}
+			select {
+			case <-time.After(whoamiPollInterval):
+			case <-ctx.Done():
+				return
+			}
+			// Failed requests are retried with the next poll
+			if next, err := c.getWhoami(ctx); err == nil {
+				allocations = next
+			}
+		}
+	}()
+	return changes, nil
+}
+
+func (c *Client) podAllocations(pod *v1.Pod) ([]annotations.Allocation, error) {
+	value, ok := pod.Annotations[c.names.Allocations]
+	if !ok {
+		return nil, ErrNotAllocated
+	}
+	return annotations.ParseAllocations(value)
+}
+
+// ReadFile reads the allocations from the annotations file of a downward API volume, which needs no permissions.
+// The kubelet updates the file when the annotations change.
+func ReadFile(path string, names annotations.Names) ([]annotations.Allocation, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Every line is KEY="VALUE" with a quoted value
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		key, quoted, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != names.Allocations {
+			continue
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, errors.New("Invalid value of annotation '" + key + "' " + err.Error())
+		}
+		return annotations.ParseAllocations(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotAllocated
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testNames = annotations.NewNames(annotations.DefaultLabelKey, annotations.DefaultPrefix)
+
+const testAllocations = `[{"port":8080,"protocol":"TCP","nodePort":31544,"address":"203.0.113.10","service":"game-0-8080"}]`
+
+func newTestPod(podAnnotations map[string]string) *v1.Pod {
+	return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: "default", Annotations: podAnnotations}}
+}
+
+func TestGet(t *testing.T) {
+	kube := fake.NewSimpleClientset(newTestPod(nil))
+	client := New(kube, "default", "game-0", testNames)
+	_, err := client.Get(context.Background())
+	if !errors.Is(err, ErrNotAllocated) {
+		t.Errorf("Expected ErrNotAllocated, got %v", err)
+	}
+
+	_, err = kube.CoreV1().Pods("default").Update(context.Background(), newTestPod(map[string]string{testNames.Allocations: testAllocations}), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocations, err := client.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocation, ok := annotations.FindAllocation(allocations, 8080, v1.ProtocolTCP)
+	if !ok || allocation.NodePort != 31544 || allocation.Address != "203.0.113.10" {
+		t.Errorf("Expected the allocation of port 8080, got %v", allocations)
+	}
+}
+
+func TestWait(t *testing.T) {
+	kube := fake.NewSimpleClientset(newTestPod(nil))
+	client := New(kube, "default", "game-0", testNames)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result := make(chan []annotations.Allocation, 1)
+	go func() {
+		allocations, err := client.Wait(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		result <- allocations
+	}()
+	// The watch has to be started before the pod is updated, the fake clientset has no resource versions
+	time.Sleep(100 * time.Millisecond)
+	_, err := kube.CoreV1().Pods("default").Update(ctx, newTestPod(map[string]string{testNames.Allocations: testAllocations}), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case allocations := <-result:
+		if len(allocations) != 1 || allocations[0].NodePort != 31544 {
+			t.Errorf("Expected the allocation, got %v", allocations)
+		}
+	case <-ctx.Done():
+		t.Fatal("Wait did not return")
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "annotations")
+	content := "other.example.com/key=\"value\"\n" + testNames.Allocations + "=" + strconv.Quote(testAllocations) + "\n"
+	err := os.WriteFile(path, []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocations, err := ReadFile(path, testNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].Service != "game-0-8080" {
+		t.Errorf("Expected the allocation of the file, got %v", allocations)
+	}
+
+	err = os.WriteFile(path, []byte("other.example.com/key=\"value\"\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadFile(path, testNames)
+	if !errors.Is(err, ErrNotAllocated) {
+		t.Errorf("Expected ErrNotAllocated, got %v", err)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	allocated := atomic.Bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer pod-token" {
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if request.URL.Path != "/whoami" || request.URL.Query().Get("namespace") != "default" || request.URL.Query().Get("name") != "game-0" {
+			http.Error(writer, "Unknown pod", http.StatusNotFound)
+			return
+		}
+		allocations := "[]"
+		if allocated.Load() {
+			allocations = testAllocations
+		}
+		writer.Write([]byte(`{"namespace":"default","name":"game-0","node":"node-1","allocations":` + allocations + `}`))
+	}))
+	defer server.Close()
+	whoamiPollInterval = 10 * time.Millisecond
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("pod-token\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewWhoami(server.URL+"/", "default", "game-0")
+	client.whoamiTokenFile = tokenFile
+	_, err = client.Get(context.Background())
+	if !errors.Is(err, ErrNotAllocated) {
+		t.Errorf("Expected ErrNotAllocated, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		allocated.Store(true)
+	}()
+	allocations, err := client.Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].NodePort != 31544 {
+		t.Errorf("Expected the allocation of the whoami service, got %v", allocations)
+	}
+
+	other := NewWhoami(server.URL, "default", "other")
+	other.whoamiTokenFile = tokenFile
+	_, err = other.Get(context.Background())
+	if err == nil || errors.Is(err, ErrNotAllocated) {
+		t.Errorf("Expected the error of the whoami service, got %v", err)
+	}
+
+	// Pods without a mounted token ask without one
+	unauthenticated := NewWhoami(server.URL, "default", "game-0")
+	unauthenticated.whoamiTokenFile = filepath.Join(t.TempDir(), "missing")
+	_, err = unauthenticated.Get(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the request without token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ConfigMap (in the namespace of the pod) that stores the node ports of sticky pods
+const stickyConfigMapName = "dynamic-hostports-sticky"
+
+// The api server rejects explicit node ports that are already in use with a 422
+func isNodePortAllocatedError(err error) bool {
+	return k8sErrors.IsInvalid(err) && strings.Contains(err.Error(), "port is already allocated")
+}
+
+// Upper limit of node ports the allocation strategy may try before the api server has to pick one
+const maxNodePortAttempts = 10
+
+// Creates the service with the first node port candidate that is not allocated yet.
+// The candidates are the deterministic node port based on the StatefulSet ordinal, the preferred node port and
+// the node ports of the allocation strategy. Once the strategy repeats a node port that is in use the next free node
+// port of the pools is taken. If all of them are already in use the api server picks a node port.
+// A node port of a port block is the only candidate, since the block would not be consecutive with any other.
+func createServiceWithNodePort(client kubernetes.Interface, pod *v1.Pod, serviceDef *v1.Service, requestedPort PortRequest, strategy allocator.Strategy, blockNodePort int32) (*v1.Service, error) {
+	if blockNodePort != 0 {
+		return createServiceWithBlockNodePort(client, pod, serviceDef, blockNodePort)
+	}
+
+	var explicitCandidates []int32
+	for _, getNodePort := range []func(*v1.Pod, PortRequest) (int32, error){getOrdinalNodePort, getPreferredNodePort} {
+		nodePort, err := getNodePort(pod, requestedPort)
+		if err != nil {
+			return nil, err
+		}
+		if nodePort != 0 {
+			explicitCandidates = append(explicitCandidates, nodePort)
+		}
+	}
+
+	triedNodePorts := make(map[int32]bool)
+	for attempt := 0; ; attempt++ {
+		nodePort := int32(0)
+		if len(explicitCandidates) > 0 {
+			nodePort, explicitCandidates = explicitCandidates[0], explicitCandidates[1:]
+		} else if attempt < maxNodePortAttempts {
+			var err error
+			nodePort, err = strategy.NodePort(client, pod, requestedPort)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if nodePort != 0 && triedNodePorts[nodePort] && nodePortAllocator != nil {
+			// The strategy has no other candidate (e.g. the sticky node port is taken), the pools still might
+			ranges, err := nodePortRangesForPod(pod)
+			if err != nil {
+				return nil, err
+			}
+			nodePort, err = nodePortAllocator.Allocate(podPortServiceKey(pod, requestedPort), ranges, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if triedNodePorts[nodePort] {
+			// The strategy has no other candidate
+			nodePort = 0
+		}
+		triedNodePorts[nodePort] = true
+		serviceKey := allocator.ServiceKey(serviceDef.Namespace, serviceDef.Name)
+
+		if nodePort != 0 {
+			err := reserveGlobalNodePort(nodePort, serviceKey)
+			if isNodePortReservedError(err) {
+				releaseNodePort(serviceDef, nodePort)
+				log.Printf("[%s] %s, trying the next candidate", pod.Name, err)
+				recorder.Eventf(pod, v1.EventTypeWarning, "NodePortConflict", "%s, trying the next candidate for service %s", err, serviceDef.Name)
+				if nodePortAllocator != nil {
+					nodePortAllocator.MarkUsed(nodePort, "")
+				}
+				continue
+			}
+			if err != nil {
+				releaseNodePort(serviceDef, nodePort)
+				return nil, err
+			}
+		}
+
+		serviceDef.Spec.Ports[0].NodePort = nodePort
+		if config.K3sServiceLB && nodePort != 0 {
+			// Otherwise the port is aligned after the api server picked the node port
+			serviceDef.Spec.Ports[0].Port = nodePort
+		}
+		newService, err := submitService(client, serviceDef)
+		if err == nil {
+			createdNodePort := nodePortOf(newService, requestedPort)
+			if nodePortAllocator != nil {
+				nodePortAllocator.MarkUsed(createdNodePort, serviceKey)
+			}
+			if nodePort == 0 {
+				// The node port of the api server is not coordinated, but it is reserved so no other cluster takes it
+				err := reserveGlobalNodePort(createdNodePort, serviceKey)
+				if err != nil {
+					logErr.Printf("[%s] Failed to reserve node port %d of service %s across clusters %s", pod.Name, createdNodePort, newService.Name, err)
+				}
+			}
+			return newService, nil
+		}
+
+		releaseNodePort(serviceDef, nodePort)
+		if nodePort == 0 || !isNodePortAllocatedError(err) {
+			return nil, err
+		}
+
+		log.Printf("[%s] Node port %d is already allocated, trying the next candidate", pod.Name, nodePort)
+		recorder.Eventf(pod, v1.EventTypeWarning, "NodePortConflict", "Node port %d for service %s is already allocated, trying the next candidate", nodePort, serviceDef.Name)
+		if nodePortAllocator != nil {
+			// Used by a service we don't know about
+			nodePortAllocator.MarkUsed(nodePort, "")
+		}
+	}
+}
+
+func createServiceWithBlockNodePort(client kubernetes.Interface, pod *v1.Pod, serviceDef *v1.Service, nodePort int32) (*v1.Service, error) {
+	serviceKey := allocator.ServiceKey(serviceDef.Namespace, serviceDef.Name)
+	err := reserveGlobalNodePort(nodePort, serviceKey)
+	if err != nil {
+		releaseNodePort(serviceDef, nodePort)
+		return nil, err
+	}
+
+	serviceDef.Spec.Ports[0].NodePort = nodePort
+	if config.K3sServiceLB {
+		serviceDef.Spec.Ports[0].Port = nodePort
+	}
+	newService, err := submitService(client, serviceDef)
+	if err != nil {
+		releaseNodePort(serviceDef, nodePort)
+		if isNodePortAllocatedError(err) && nodePortAllocator != nil {
+			// Used by a service we don't know about, the next block is chosen around it
+			nodePortAllocator.MarkUsed(nodePort, "")
+		}
+		return nil, err
+	}
+	if nodePortAllocator != nil {
+		nodePortAllocator.MarkUsed(nodePort, serviceKey)
+	}
+	return newService, nil
+}
+
+// Creates the service. With one service per pod the port is added to the service of the pod if it already exists.
+func submitService(client kubernetes.Interface, serviceDef *v1.Service) (*v1.Service, error) {
+	services := client.CoreV1().Services(serviceDef.Namespace)
+	if !config.ServicePerPod {
+		return services.Create(context.Background(), serviceDef, metav1.CreateOptions{})
+	}
+	existing, err := services.Get(context.Background(), serviceDef.Name, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return services.Create(context.Background(), serviceDef, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	port := serviceDef.Spec.Ports[0]
+	existing.Spec.Ports = slices.DeleteFunc(existing.Spec.Ports, func(existingPort v1.ServicePort) bool {
+		return existingPort.Name == port.Name
+	})
+	existing.Spec.Ports = append(existing.Spec.Ports, port)
+	return services.Update(context.Background(), existing, metav1.UpdateOptions{})
+}
+
+// Returns the requested port a port of a managed service was created for. The target port is the container port,
+// the port itself is the node port with ServiceLB.
+func servicePortRequest(port v1.ServicePort) PortRequest {
+	return PortRequest{Port: port.TargetPort.IntVal, Protocol: port.Protocol}
+}
+
+// Returns the node port of the requested port within the service, 0 if the service has no such port
+func nodePortOf(service *v1.Service, requestedPort PortRequest) int32 {
+	for _, port := range service.Spec.Ports {
+		if servicePortRequest(port).Key() == requestedPort.Key() {
+			return port.NodePort
+		}
+	}
+	return 0
+}
+
+// Returns the node port of the 'preferred-PORT' annotation or 0 if there is none
+func getPreferredNodePort(pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	preferredString, ok := pod.Annotations[preferredNodePortAnnotation+"-"+requestedPort.Key()]
+	if !ok {
+		return 0, nil
+	}
+	preferred, err := strconv.Atoi(preferredString)
+	if err != nil {
+		return 0, err
+	}
+	if preferred <= 0 || preferred >= 65536 {
+		return 0, errors.New("Preferred node port is not in valid range")
+	}
+	return int32(preferred), nil
+}
+
+// Returns the ordinal of a StatefulSet pod
+func statefulSetOrdinal(pod *v1.Pod) (int, bool) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		return 0, false
+	}
+	if index, ok := pod.Labels["apps.kubernetes.io/pod-index"]; ok {
+		ordinal, err := strconv.Atoi(index)
+		return ordinal, err == nil
+	}
+	i := strings.LastIndex(pod.Name, "-")
+	if i < 0 {
+		return 0, false
+	}
+	ordinal, err := strconv.Atoi(pod.Name[i+1:])
+	return ordinal, err == nil
+}
+
+// Returns base node port + StatefulSet ordinal if the pod has a base node port annotation, otherwise 0.
+// The port specific annotation 'base-nodeport-PORT' takes precedence over 'base-nodeport'.
+func getOrdinalNodePort(pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	baseString, ok := pod.Annotations[baseNodePortAnnotation+"-"+requestedPort.Key()]
+	if !ok {
+		baseString, ok = pod.Annotations[baseNodePortAnnotation]
+	}
+	if !ok {
+		return 0, nil
+	}
+
+	base, err := strconv.Atoi(baseString)
+	if err != nil {
+		return 0, err
+	}
+	ordinal, ok := statefulSetOrdinal(pod)
+	if !ok {
+		recorder.Eventf(pod, v1.EventTypeWarning, "NotAStatefulSetPod", "Ignoring base node port of port %s because the pod has no StatefulSet ordinal", requestedPort)
+		return 0, nil
+	}
+	nodePort := base + ordinal
+	if nodePort <= 0 || nodePort >= 65536 {
+		return 0, errors.New("Base node port + ordinal is not in valid range")
+	}
+	return int32(nodePort), nil
+}
+
+// Returns an identity of the pod that survives the recreation of the pod.
+// StatefulSet pods are identified by their StatefulSet and ordinal, every other pod by its name.
+func stickyIdentity(pod *v1.Pod) string {
+	if ordinal, ok := statefulSetOrdinal(pod); ok {
+		return string(metav1.GetControllerOf(pod).UID) + "-" + strconv.Itoa(ordinal)
+	}
+	return pod.Name
+}
+
+func stickyKey(pod *v1.Pod, requestedPort PortRequest) string {
+	return stickyIdentity(pod) + "." + requestedPort.Key()
+}
+
+// Returns the previously recorded node port of the pod or 0 if there is none
+func getStickyNodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	configMap, err := client.CoreV1().ConfigMaps(pod.Namespace).Get(context.Background(), stickyConfigMapName, metav1.GetOptions{})
+	if k8sErrors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := configMap.Data[stickyKey(pod, requestedPort)]
+	if !ok {
+		return 0, nil
+	}
+	nodePort, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	return int32(nodePort), nil
+}
+
+func recordStickyNodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) error {
+	// The ports of a pod are recorded concurrently, so the ConfigMap might be created in the meantime
+	retriable := func(err error) bool {
+		return k8sErrors.IsConflict(err) || k8sErrors.IsAlreadyExists(err)
+	}
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		configMaps := client.CoreV1().ConfigMaps(pod.Namespace)
+		configMap, err := configMaps.Get(context.Background(), stickyConfigMapName, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			_, err = configMaps.Create(context.Background(), &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      stickyConfigMapName,
+					Namespace: pod.Namespace,
+					Labels:    managedLabels(),
+				},
+				Data: map[string]string{
+					stickyKey(pod, requestedPort): strconv.Itoa(int(nodePort)),
+				},
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[stickyKey(pod, requestedPort)] = strconv.Itoa(int(nodePort))
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
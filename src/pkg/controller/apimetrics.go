@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// Counts the failed requests to the api server by verb, resource and status code
+type apiErrorsRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (roundTripper apiErrorsRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := roundTripper.next.RoundTrip(request)
+	if err != nil {
+		verb, resource := apiRequestVerbAndResource(request)
+		apiRequestErrorsTotal.WithLabelValues(verb, resource, "error").Inc()
+	} else if response.StatusCode >= 400 {
+		verb, resource := apiRequestVerbAndResource(request)
+		apiRequestErrorsTotal.WithLabelValues(verb, resource, strconv.Itoa(response.StatusCode)).Inc()
+	}
+	return response, err
+}
+
+// Counts the failed requests of all clients that are created with the config
+func instrumentConfig(config *rest.Config) {
+	config.Wrap(func(next http.RoundTripper) http.RoundTripper {
+		return apiErrorsRoundTripper{next: next}
+	})
+}
+
+// Returns the verb (like kubectl, e.g. get, list or watch) and the resource of a request to the api server. The path
+// is /api/VERSION/... for the core group and /apis/GROUP/VERSION/... otherwise, optionally with a namespace.
+func apiRequestVerbAndResource(request *http.Request) (string, string) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return strings.ToLower(request.Method), "other"
+	}
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		if len(parts) == 2 {
+			// The namespace itself
+			parts = parts[:2]
+		} else {
+			parts = parts[2:]
+		}
+	}
+	if len(parts) == 0 {
+		return strings.ToLower(request.Method), "other"
+	}
+	resource := parts[0]
+	hasName := len(parts) >= 2
+	if len(parts) >= 3 {
+		// Subresources like pods/status
+		resource += "/" + parts[2]
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		if request.URL.Query().Get("watch") == "true" {
+			return "watch", resource
+		}
+		if hasName {
+			return "get", resource
+		}
+		return "list", resource
+	case http.MethodPost:
+		return "create", resource
+	case http.MethodPut:
+		return "update", resource
+	case http.MethodPatch:
+		return "patch", resource
+	case http.MethodDelete:
+		return "delete", resource
+	}
+	return strings.ToLower(request.Method), resource
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The logs of every pod would dominate the measurements
+func silenceLogs(b *testing.B) {
+	log.SetOutput(io.Discard)
+	logErr.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		log.SetOutput(os.Stdout)
+		logErr.SetOutput(os.Stderr)
+	})
+}
+
+// Creates the pod with a unique name and uid in the clientset, like the scheduler and kubelet leave it
+func createBenchmarkPod(b *testing.B, client kubernetes.Interface, index int) *v1.Pod {
+	pod := newTestPod("game-"+strconv.Itoa(index), "8080", nil)
+	pod.UID = types.UID("uid-" + strconv.Itoa(index))
+	pod, err := client.CoreV1().Pods(testNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return pod
+}
+
+// Reconciles of pods whose services already exist, which is what most events of a running cluster are
+func BenchmarkReconcile(b *testing.B) {
+	silenceLogs(b)
+	client := newTestClient(b)
+	handledPods := make(map[string]podState)
+	cachedExternalIPs := make(map[string][]string)
+	pods := make([]*v1.Pod, 1000)
+	for i := range pods {
+		pods[i] = createBenchmarkPod(b, client, i)
+		err := handlePodEvent(client, watch.Added, pods[i], handledPods, cachedExternalIPs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := handlePodEvent(client, watch.Modified, pods[i%len(pods)], handledPods, cachedExternalIPs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "reconciles/s")
+}
+
+// Reconciles of new pods, each of them gets a service, endpoints and its annotations
+func BenchmarkAllocation(b *testing.B) {
+	silenceLogs(b)
+	client := newTestClient(b)
+	handledPods := make(map[string]podState)
+	cachedExternalIPs := make(map[string][]string)
+	pods := make([]*v1.Pod, b.N)
+	for i := range pods {
+		pods[i] = createBenchmarkPod(b, client, i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := handlePodEvent(client, watch.Added, pods[i], handledPods, cachedExternalIPs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "allocations/s")
+}
+
+// The heap that 1k managed pods take after their allocation. It includes the objects of the fake clientset, so it is
+// an upper bound that catches regressions rather than the memory of the controller alone.
+func BenchmarkMemoryPer1kPods(b *testing.B) {
+	silenceLogs(b)
+	var total uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client := newTestClient(b)
+		pods := make([]*v1.Pod, 1000)
+		for j := range pods {
+			pods[j] = createBenchmarkPod(b, client, j)
+		}
+		handledPods := make(map[string]podState)
+		cachedExternalIPs := make(map[string][]string)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		b.StartTimer()
+
+		for _, pod := range pods {
+			err := handlePodEvent(client, watch.Added, pod, handledPods, cachedExternalIPs)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if after.HeapAlloc > before.HeapAlloc {
+			total += after.HeapAlloc - before.HeapAlloc
+		}
+		runtime.KeepAlive(client)
+		runtime.KeepAlive(handledPods)
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "heap-bytes/1k-pods")
+}
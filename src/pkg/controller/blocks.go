@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+var errBlockWithoutPools = errors.New("Port blocks require node port pools (--nodeport-pools)")
+
+// Returns the blocks of consecutive ports of the block annotations, sorted by their first port
+func getPortBlocks(pod *v1.Pod, defaultProtocol v1.Protocol) ([][]PortRequest, error) {
+	var blocks [][]PortRequest
+	for key, value := range pod.Annotations {
+		requests, ok, err := names.BlockRequests(key, value, defaultProtocol)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return nil, annotations.InvalidValueError{Key: key, Value: value, Syntax: annotations.BlockSyntax, Err: err}
+		}
+		blocks = append(blocks, requests)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i][0].Key() < blocks[j][0].Key()
+	})
+	return blocks, nil
+}
+
+// A block of the pod whose services are created
+type portBlock struct {
+	first  PortRequest
+	length int
+	base   int32
+	// Indexes of the requested ports that belong to the block
+	indexes []int
+	// The node ports were reserved just now, so the block is allocated again if one of its services fails
+	reserved bool
+}
+
+// Assigns the node ports of the requested ports that belong to a block. A block keeps the first node port of its
+// annotation, so services that are created again get the node port they had before. Otherwise a free block of node
+// ports is reserved in the pools.
+func allocatePortBlocks(pod *v1.Pod, requestedPorts []PortRequest) ([]portBlock, map[string]int32, error) {
+	defaultProtocol, err := annotations.ParseProtocol(podSetting(pod, defaultProtocolAnnotation, config.DefaultProtocol))
+	if err != nil {
+		return nil, nil, err
+	}
+	blockRequests, err := getPortBlocks(pod, defaultProtocol)
+	if err != nil || len(blockRequests) == 0 {
+		return nil, nil, err
+	}
+
+	indexes := make(map[string]int)
+	for i, requestedPort := range requestedPorts {
+		indexes[requestedPort.Key()] = i
+	}
+	var blocks []portBlock
+	nodePorts := make(map[string]int32)
+	for _, requests := range blockRequests {
+		block := portBlock{first: requests[0], length: len(requests)}
+		serviceKeys := make([]string, len(requests))
+		for offset, request := range requests {
+			if i, ok := indexes[request.Key()]; ok {
+				block.indexes = append(block.indexes, i)
+				serviceKeys[offset] = podPortServiceKey(pod, request)
+			}
+		}
+		if len(block.indexes) == 0 {
+			continue
+		}
+
+		base, err := strconv.Atoi(pod.Annotations[names.BlockNodePort(block.first)])
+		if err == nil && pod.Annotations[names.BlockLength(block.first)] == strconv.Itoa(block.length) {
+			block.base = int32(base)
+		} else {
+			block.base, err = reservePortBlock(pod, serviceKeys)
+			if err != nil {
+				releasePortBlocks(pod, requestedPorts, blocks, nodePorts)
+				return nil, nil, err
+			}
+			block.reserved = true
+		}
+		for offset, serviceKey := range serviceKeys {
+			if serviceKey != "" {
+				nodePorts[requests[offset].Key()] = block.base + int32(offset)
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nodePorts, nil
+}
+
+func reservePortBlock(pod *v1.Pod, serviceKeys []string) (int32, error) {
+	if nodePortAllocator == nil {
+		return 0, errBlockWithoutPools
+	}
+	ranges, err := nodePortRangesForPod(pod)
+	if err != nil {
+		return 0, err
+	}
+	return nodePortAllocator.AllocateBlock(serviceKeys, ranges)
+}
+
+// Releases the node ports of the blocks that were reserved just now
+func releasePortBlocks(pod *v1.Pod, requestedPorts []PortRequest, blocks []portBlock, nodePorts map[string]int32) {
+	for _, block := range blocks {
+		if !block.reserved {
+			continue
+		}
+		for _, i := range block.indexes {
+			serviceKey := podPortServiceKey(pod, requestedPorts[i])
+			nodePortAllocator.ReleaseNodePort(nodePorts[requestedPorts[i].Key()], serviceKey)
+		}
+	}
+}
+
+// Deletes the created services of the reserved blocks that could not be created completely, otherwise they would not
+// be consecutive after the missing ones are created again. Returns the pod annotations of the blocks that are complete
+// or were allocated before, and removes the annotations of the deleted services.
+func finishPortBlocks(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest, blocks []portBlock, created []map[string]string, errs []error) map[string]string {
+	blockAnnotations := make(map[string]string)
+	for _, block := range blocks {
+		failed := false
+		for _, i := range block.indexes {
+			failed = failed || errs[i] != nil
+		}
+
+		if failed && block.reserved {
+			for _, i := range block.indexes {
+				if created[i] == nil {
+					continue
+				}
+				log.Printf("[%s] Deleting the service of port %s because the rest of its port block failed.", pod.Name, requestedPorts[i])
+				err := deletePortService(client, pod, requestedPorts[i])
+				if err != nil && !k8sErrors.IsNotFound(err) {
+					logErr.Printf("[%s] Failed to delete the service of port %s of the port block %s %s", pod.Name, requestedPorts[i], block.first, err)
+				}
+				created[i] = nil
+			}
+			continue
+		}
+		blockAnnotations[names.BlockNodePort(block.first)] = strconv.Itoa(int(block.base))
+		blockAnnotations[names.BlockLength(block.first)] = strconv.Itoa(block.length)
+	}
+	return blockAnnotations
+}
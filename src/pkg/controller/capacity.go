@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How often the capacity gauges are updated, they need to list all services
+const capacityMetricsInterval = 30 * time.Second
+
+// Returns the ranges that the node ports are allocated from
+func capacityRanges() []allocator.PortRange {
+	if nodePortAllocator != nil {
+		return nodePortAllocator.Ranges()
+	}
+	return clusterNodePortRange
+}
+
+// Updates the capacity gauges from the services of the namespaces and the service namespace. The usage of other
+// namespaces is unknown.
+func updateCapacityMetrics(client kubernetes.Interface, namespaces []string) error {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	managed, err := labels.Parse(managedSelector())
+	if err != nil {
+		return err
+	}
+	usedNodePorts := make(map[int32]bool)
+	allocations := make(map[string]int)
+	if config.ServiceNamespace != "" && !slices.Contains(namespaces, "") && !slices.Contains(namespaces, config.ServiceNamespace) {
+		namespaces = append(slices.Clone(namespaces), config.ServiceNamespace)
+	}
+	for _, namespace := range namespaces {
+		services, err := client.CoreV1().Services(namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, service := range services.Items {
+			for _, port := range service.Spec.Ports {
+				if port.NodePort != 0 {
+					usedNodePorts[port.NodePort] = true
+				}
+			}
+			if managed.Matches(labels.Set(service.Labels)) && service.Labels[forPodLabelKey] != "" && !isHeadlessService(&service) {
+				// Services of older versions have no node annotation
+				allocations[service.Annotations[nodeAnnotation]]++
+			}
+		}
+	}
+
+	ranges := capacityRanges()
+	total := 0
+	for _, portRange := range ranges {
+		total += int(portRange.Last-portRange.First) + 1
+	}
+	used := 0
+	for nodePort := range usedNodePorts {
+		if allocator.PortInRanges(nodePort, ranges) {
+			used++
+		}
+	}
+	nodePortsTotal.Set(float64(total))
+	nodePortsFree.Set(float64(total - used))
+
+	// Deleted nodes must disappear
+	nodeAllocations.Reset()
+	for node, count := range allocations {
+		nodeAllocations.WithLabelValues(node).Set(float64(count))
+	}
+	return nil
+}
+
+func reportCapacity(ctx context.Context, client kubernetes.Interface, namespaces []string) {
+	for {
+		err := updateCapacityMetrics(client, namespaces)
+		if err != nil {
+			logErr.Printf("Failed to update the capacity metrics %s", err)
+		}
+		select {
+		case <-time.After(capacityMetricsInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
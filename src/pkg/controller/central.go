@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+func validateServiceNamespace() error {
+	if config.ServiceNamespace == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Label(config.ServiceNamespace); len(errs) > 0 {
+		return errors.New("Invalid service namespace '" + config.ServiceNamespace + "' " + strings.Join(errs, ", "))
+	}
+	if config.NamespacedRbac {
+		return errors.New("The services can't be created in another namespace in the namespaced rbac mode")
+	}
+	return nil
+}
+
+// Returns the namespace the services of the pods in the namespace are created in
+func serviceNamespace(podNamespace string) string {
+	if config.ServiceNamespace != "" {
+		return config.ServiceNamespace
+	}
+	return podNamespace
+}
+
+// Returns the namespace of the pod the service was created for
+func servicePodNamespace(service *v1.Service) string {
+	if namespace, ok := service.Labels[forPodNamespaceLabelKey]; ok {
+		return namespace
+	}
+	return service.Namespace
+}
+
+// Returns the prefix of the service names of the pod. The names in the service namespace start with the namespace of
+// the pod, so pods with the same name in different namespaces don't collide.
+func podServiceBaseName(pod *v1.Pod) string {
+	if config.ServiceNamespace != "" {
+		return pod.Namespace + "-" + pod.Name
+	}
+	return pod.Name
+}
+
+// Returns the key the node port of the port is reserved for in the pools, the one of the service in the service
+// namespace it is released with
+func podPortServiceKey(pod *v1.Pod, requestedPort PortRequest) string {
+	return allocator.ServiceKey(serviceNamespace(pod.Namespace), podPortToServiceName(pod, requestedPort))
+}
+
+// Returns the label selector of the managed services of the pods in the namespace, "" selects the ones of all
+// namespaces
+func managedServicesSelector(podNamespace string) string {
+	if config.ServiceNamespace != "" && podNamespace != "" {
+		return managedSelector() + "," + forPodNamespaceLabelKey + "=" + podNamespace
+	}
+	return managedSelector()
+}
+
+// Lists the managed services of the pods in the namespace that also match the selector
+func listManagedServices(client kubernetes.Interface, podNamespace string, selector string) (*v1.ServiceList, error) {
+	labelSelector := managedServicesSelector(podNamespace)
+	if selector != "" {
+		labelSelector += "," + selector
+	}
+	return client.CoreV1().Services(serviceNamespace(podNamespace)).List(context.Background(), metav1.ListOptions{LabelSelector: labelSelector})
+}
+
+// Lists the managed services of the pod, the ones of previous incarnations of the pod are included
+func listPodServices(client kubernetes.Interface, pod *v1.Pod) (*v1.ServiceList, error) {
+	return listManagedServices(client, pod.Namespace, forPodLabelKey+"="+pod.Name)
+}
+
+// Returns the namespaces the managed services of the pods in the namespaces are in
+func serviceNamespaces(namespaces []string) []string {
+	if config.ServiceNamespace != "" {
+		return []string{config.ServiceNamespace}
+	}
+	return namespaces
+}
@@ -0,0 +1,435 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Environment variables override the defaults of the flags, e.g. DYNAMIC_HOSTPORTS_NODE_ADDRESS_PREFERENCE=InternalIP
+const envPrefix = "DYNAMIC_HOSTPORTS_"
+
+// Flags that were set on the command line or via environment variable, or that differ from the defaults in the
+// Config of an embedded controller. They take precedence over the config file.
+var explicitFlags = map[string]bool{}
+
+func envVarName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Remembers the flags of the command line and applies the environment variables to the remaining ones
+func bindFlags(commandLine *pflag.FlagSet) error {
+	commandLine.Visit(func(f *pflag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	var err error
+	configFlags.VisitAll(func(f *flag.Flag) {
+		if explicitFlags[f.Name] || err != nil {
+			return
+		}
+		if value, ok := os.LookupEnv(envVarName(f.Name)); ok {
+			err = f.Value.Set(value)
+			if err != nil {
+				err = errors.New("Invalid value of environment variable " + envVarName(f.Name) + " " + err.Error())
+			}
+			explicitFlags[f.Name] = true
+		}
+	})
+	return err
+}
+
+func rootCommand() *cobra.Command {
+	resetConfig()
+	root := &cobra.Command{
+		Use:          "k8s-dynamic-hostport",
+		Short:        "Exposes pods with dynamically allocated node ports",
+		SilenceUsage: true,
+		Args:         cobra.NoArgs,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			err := bindFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			return setup()
+		},
+		// Without a subcommand the controller is started, like it always was
+		Run: func(cmd *cobra.Command, args []string) {
+			run()
+		},
+	}
+	root.PersistentFlags().AddGoFlagSet(configFlags)
+
+	root.AddCommand(&cobra.Command{
+		Use:   "run",
+		Short: "Run the controller",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			run()
+		},
+	})
+	root.AddCommand(addOutputFlag(&cobra.Command{
+		Use:   "cleanup",
+		Short: "Delete all services, endpoints, ConfigMaps and pod annotations created by the controller",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			removed, err := cleanup(client, watchedNamespaces())
+			if isStructuredOutput() {
+				// The objects that were removed before a failure are printed as well
+				printErr := printStructured(os.Stdout, removed)
+				if err == nil {
+					err = printErr
+				}
+			}
+			return err
+		},
+	}, false))
+	root.AddCommand(addOutputFlag(&cobra.Command{
+		Use:   "verify",
+		Short: "Verify the config, the connection to the api server and the permissions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			return verify(client, watchedNamespaces())
+		},
+	}, false))
+	root.AddCommand(addOutputFlag(&cobra.Command{
+		Use:     "status",
+		Aliases: []string{"list"},
+		Short:   "Print the allocated node ports of the managed pods",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			allocations, err := listAllocations(client, watchedNamespaces())
+			if err != nil {
+				return err
+			}
+			if isStructuredOutput() {
+				return printStructured(os.Stdout, allocations)
+			}
+			return printAllocations(os.Stdout, allocations, time.Now(), outputFormat == "wide")
+		},
+	}, true))
+	root.AddCommand(topCommand())
+	root.AddCommand(&cobra.Command{
+		Use:   "relay",
+		Short: "Forward the TCP node ports of the managed services to their pods, runs on the gateway nodes",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			runRelay(client, serviceNamespaces(watchedNamespaces()))
+			return nil
+		},
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   "webhook",
+		Short: "Assign host ports to the pods with a mutating webhook instead of creating services",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			return runWebhook(client, watchedNamespaces())
+		},
+	})
+	root.AddCommand(&cobra.Command{
+		Use:   "renew POD...",
+		Short: "Renew the leases of the pods in --namespace, so their dynamic hostports are kept for another --lease-ttl",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			namespace := watchedNamespaces()[0]
+			if namespace == "" {
+				namespace = metav1.NamespaceDefault
+			}
+			for _, podName := range args {
+				err := renewLease(client, namespace, podName)
+				if err != nil {
+					return err
+				}
+				log.Printf("Renewed the lease of pod '%s/%s'", namespace, podName)
+			}
+			return nil
+		},
+	})
+	return root
+}
+
+// Returns the keys of the annotations that the controller set on the pod
+func outputAnnotationKeys(pod *v1.Pod) []string {
+	var keys []string
+	for key := range pod.Annotations {
+		if names.IsOutput(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func removePodAnnotations(client kubernetes.Interface, pod *v1.Pod, keys []string) error {
+	return updatePodAnnotations(client, pod, nil, keys)
+}
+
+// An object that the cleanup deleted, or a pod whose annotations it removed
+type removedObject struct {
+	Kind        string   `json:"kind"`
+	Namespace   string   `json:"namespace"`
+	Name        string   `json:"name"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+func cleanupNamespace(client kubernetes.Interface, namespace string) ([]removedObject, error) {
+	managedOptions := metav1.ListOptions{LabelSelector: managedSelector()}
+	var removed []removedObject
+
+	services, err := listManagedServices(client, namespace, "")
+	if err != nil {
+		return removed, err
+	}
+	for _, service := range services.Items {
+		log.Printf("Delete service '%s/%s'", service.Namespace, service.Name)
+		err := deleteService(client, service.Namespace, service.Name)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, removedObject{Kind: "Service", Namespace: service.Namespace, Name: service.Name})
+	}
+
+	// The endpoints are usually deleted together with their service
+	endpoints, err := client.CoreV1().Endpoints(serviceNamespace(namespace)).List(context.Background(), metav1.ListOptions{LabelSelector: managedServicesSelector(namespace)})
+	if err != nil {
+		return removed, err
+	}
+	for _, endpoint := range endpoints.Items {
+		log.Printf("Delete endpoints '%s/%s'", endpoint.Namespace, endpoint.Name)
+		err := client.CoreV1().Endpoints(endpoint.Namespace).Delete(context.Background(), endpoint.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, removedObject{Kind: "Endpoints", Namespace: endpoint.Namespace, Name: endpoint.Name})
+	}
+
+	configMaps, err := client.CoreV1().ConfigMaps(namespace).List(context.Background(), managedOptions)
+	if err != nil {
+		return removed, err
+	}
+	for _, configMap := range configMaps.Items {
+		log.Printf("Delete ConfigMap '%s/%s'", configMap.Namespace, configMap.Name)
+		err := client.CoreV1().ConfigMaps(configMap.Namespace).Delete(context.Background(), configMap.Name, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, removedObject{Kind: "ConfigMap", Namespace: configMap.Namespace, Name: configMap.Name})
+	}
+
+	pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: labelKey})
+	if err != nil {
+		return removed, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		keys := outputAnnotationKeys(pod)
+		if len(keys) == 0 {
+			continue
+		}
+		log.Printf("[%s] Remove annotations %s", pod.Name, strings.Join(keys, ","))
+		err := removePodAnnotations(client, pod, keys)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return removed, err
+		}
+		sort.Strings(keys)
+		removed = append(removed, removedObject{Kind: "Pod", Namespace: pod.Namespace, Name: pod.Name, Annotations: keys})
+	}
+	return removed, nil
+}
+
+// Deletes everything the controller created, so it can be uninstalled or started from scratch
+func cleanup(client kubernetes.Interface, namespaces []string) ([]removedObject, error) {
+	removed := []removedObject{}
+	for _, namespace := range namespaces {
+		removedInNamespace, err := cleanupNamespace(client, namespace)
+		removed = append(removed, removedInNamespace...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	log.Print("Cleanup done")
+	return removed, nil
+}
+
+// The permissions the controller needs at least
+var requiredPermissions = []authorizationV1.ResourceAttributes{
+	{Verb: "get", Resource: "nodes"},
+	{Verb: "list", Resource: "nodes"},
+	{Verb: "watch", Resource: "nodes"},
+	{Verb: "list", Resource: "namespaces"},
+	{Verb: "watch", Resource: "namespaces"},
+	{Verb: "get", Resource: "pods"},
+	{Verb: "list", Resource: "pods"},
+	{Verb: "watch", Resource: "pods"},
+	{Verb: "patch", Resource: "pods"},
+	{Verb: "list", Resource: "services"},
+	{Verb: "create", Resource: "services"},
+	{Verb: "delete", Resource: "services"},
+	{Verb: "create", Resource: "endpoints"},
+	{Verb: "delete", Resource: "endpoints"},
+	{Verb: "create", Resource: "events"},
+}
+
+// The resources of requiredPermissions and controllerPermissions that are not checked per namespace
+var clusterScopedResources = map[string]bool{"nodes": true, "namespaces": true, "tokenreviews": true}
+
+// Returns the permissions the controller needs with the current flags
+func controllerPermissions() []authorizationV1.ResourceAttributes {
+	permissions := slices.Clone(requiredPermissions)
+	if config.NamespacedRbac {
+		// The nodes and namespaces are never fetched in the namespaced rbac mode
+		permissions = slices.DeleteFunc(permissions, func(permission authorizationV1.ResourceAttributes) bool {
+			return permission.Resource == "nodes" || permission.Resource == "namespaces"
+		})
+	}
+	if config.NodeIpsConfigMap != "" {
+		namespace, name := splitNamespacedName(config.NodeIpsConfigMap)
+		permissions = append(permissions, authorizationV1.ResourceAttributes{Verb: "get", Resource: "configmaps", Namespace: namespace, Name: name})
+	}
+	if config.PodCondition {
+		permissions = append(permissions, authorizationV1.ResourceAttributes{Verb: "patch", Resource: "pods", Subresource: "status"})
+	}
+	if config.WhoamiAddress != "" && !config.NamespacedRbac {
+		// The tokens of the pods that ask the whoami service
+		permissions = append(permissions, authorizationV1.ResourceAttributes{Verb: "create", Group: "authentication.k8s.io", Resource: "tokenreviews"})
+	}
+	if config.ServicePerPod {
+		// The ports are added to and removed from the service and endpoints of the pod
+		for _, resource := range []string{"services", "endpoints"} {
+			permissions = append(permissions,
+				authorizationV1.ResourceAttributes{Verb: "get", Resource: resource},
+				authorizationV1.ResourceAttributes{Verb: "update", Resource: resource},
+			)
+		}
+	}
+	return permissions
+}
+
+// The result of a permission check of verify
+type permissionCheck struct {
+	Verb      string `json:"verb"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Allowed   bool   `json:"allowed"`
+}
+
+type verifyResult struct {
+	ServerVersion string            `json:"serverVersion"`
+	Permissions   []permissionCheck `json:"permissions"`
+	Succeeded     bool              `json:"succeeded"`
+}
+
+// Checks the connection to the api server and the permissions of the controller
+func verify(client kubernetes.Interface, namespaces []string) error {
+	result, err := checkPermissions(client, namespaces)
+	if err != nil {
+		return err
+	}
+	if isStructuredOutput() {
+		err := printStructured(os.Stdout, result)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Printf("OK      Connected to the api server %s", result.ServerVersion)
+		for _, check := range result.Permissions {
+			scope := check.Namespace
+			if scope == "" {
+				scope = "cluster"
+			}
+			if check.Allowed {
+				log.Printf("OK      %s %s (%s)", check.Verb, check.Resource, scope)
+			} else {
+				logErr.Printf("FAILED  %s %s (%s) is not allowed", check.Verb, check.Resource, scope)
+			}
+		}
+	}
+
+	if !result.Succeeded {
+		return errors.New("Some permissions are missing")
+	}
+	if !isStructuredOutput() {
+		log.Print("Verification succeeded")
+	}
+	return nil
+}
+
+func checkPermissions(client kubernetes.Interface, namespaces []string) (verifyResult, error) {
+	result := verifyResult{Succeeded: true}
+	version, err := client.Discovery().ServerVersion()
+	if err != nil {
+		return result, errors.New("Failed to connect to the api server " + err.Error())
+	}
+	result.ServerVersion = version.GitVersion
+
+	permissions := controllerPermissions()
+	checked := make(map[authorizationV1.ResourceAttributes]bool)
+	for _, namespace := range namespaces {
+		for _, permission := range permissions {
+			attributes := permission
+			if attributes.Namespace == "" && !clusterScopedResources[attributes.Resource] {
+				attributes.Namespace = namespace
+				if attributes.Resource == "services" || attributes.Resource == "endpoints" {
+					// The services of the pods can be in the --service-namespace
+					attributes.Namespace = serviceNamespace(namespace)
+				}
+			}
+			if checked[attributes] {
+				continue
+			}
+			checked[attributes] = true
+			review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), &authorizationV1.SelfSubjectAccessReview{
+				Spec: authorizationV1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return result, err
+			}
+
+			resource := attributes.Resource
+			if attributes.Subresource != "" {
+				resource += "/" + attributes.Subresource
+			}
+			result.Permissions = append(result.Permissions, permissionCheck{Verb: attributes.Verb, Resource: resource, Namespace: attributes.Namespace, Allowed: review.Status.Allowed})
+			if !review.Status.Allowed {
+				result.Succeeded = false
+			}
+		}
+	}
+	return result, nil
+}
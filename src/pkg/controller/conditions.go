@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The pod condition with the allocation state, its reason is the reason of the corresponding event on failures
+const podConditionType v1.PodConditionType = "DynamicHostPortsReady"
+
+// Sets the condition of the pod unless it already has this state. Errors are only logged, the condition is just for
+// the tooling that inspects the pods.
+func setPodCondition(client kubernetes.Interface, pod *v1.Pod, status v1.ConditionStatus, reason string, message string) {
+	if !config.PodCondition {
+		return
+	}
+	condition := v1.PodCondition{
+		Type:               podConditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+	for _, existing := range pod.Status.Conditions {
+		if existing.Type != podConditionType {
+			continue
+		}
+		if existing.Status == status && existing.Reason == reason && existing.Message == message {
+			return
+		}
+		if existing.Status == status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	// The conditions are merged by their type, so the ones of the kubelet are kept
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"uid": pod.UID,
+		},
+		"status": map[string]interface{}{
+			"conditions": []v1.PodCondition{condition},
+		},
+	})
+	if err == nil {
+		_, err = client.CoreV1().Pods(pod.Namespace).Patch(context.Background(), pod.Name, types.StrategicMergePatchType, serializedJson, metav1.PatchOptions{}, "status")
+	}
+	if err != nil {
+		logErr.Printf("[%s] Failed to set the %s condition %s", pod.Name, podConditionType, err)
+	}
+}
@@ -0,0 +1,359 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	"sigs.k8s.io/yaml"
+)
+
+// How often the config file is checked for changes
+const configPollInterval = 10 * time.Second
+
+// Flags that define what is watched, changing them requires a restart
+var restartOnlyFlags = []string{"config", "kubeconfig", "context", "as", "as-group", "as-uid", "namespace", "namespaces", "label-key", "annotation-prefix", "pod-selector", "metrics-address", "cluster-secret-selector", "cluster-secrets-namespace", "cluster-secret-key", "coordination-configmap", "coordination-kubeconfig", "cluster-id", "http-auth", "http-tls-cert-file", "http-tls-key-file", "http-client-ca-file", "namespaced-rbac", "tenant", "event-debounce", "watchdog-timeout", "cleanup-on-shutdown", "service-per-pod", "last-reconciled-interval", "service-namespace", "whoami-address"}
+
+// Receives a value whenever the config should be reloaded
+var configReloads = make(chan struct{})
+
+// The node port pools the allocator was created with, so a reload keeps the usage if they didn't change
+var parsedNodePortPools string
+
+// The flags that were set by the config file
+var configFileFlags = map[string]bool{}
+
+// Guards the flags and the configuration parsed from them. The pod loop reloads the config, everything that runs
+// next to it (the http handlers, the periodic reports and the pod watches) reads it with the read lock.
+var configMutex sync.RWMutex
+
+// Implemented by flags that can be set multiple times, like the metadata templates
+type repeatableValue interface {
+	reset()
+	values() []string
+}
+
+// Formats a scalar YAML value as flag value
+func configValueString(value interface{}) string {
+	switch typed := value.(type) {
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	default:
+		return fmt.Sprint(typed)
+	}
+}
+
+// Returns the flag values of a YAML value. Lists and maps ('team-a: 10' becomes 'team-a=10') are joined with ','
+// unless the flag is repeatable, in that case every entry is a separate value.
+func configFlagValues(value interface{}, repeatable bool) []string {
+	var entries []string
+	switch typed := value.(type) {
+	case []interface{}:
+		for _, entry := range typed {
+			entries = append(entries, configValueString(entry))
+		}
+	case map[string]interface{}:
+		for key, entry := range typed {
+			entries = append(entries, key+"="+configValueString(entry))
+		}
+		sort.Strings(entries)
+	default:
+		return []string{configValueString(typed)}
+	}
+
+	if repeatable {
+		return entries
+	}
+	return []string{strings.Join(entries, ",")}
+}
+
+// Applies the config file to all flags that were not set on the command line or via environment variable.
+// Flags that were removed from the file since it was loaded the last time are reset to their default.
+func loadConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return err
+	}
+
+	for name := range values {
+		if configFlags.Lookup(name) == nil || name == "config" {
+			return errors.New("Unknown config key '" + name + "'")
+		}
+	}
+
+	for name := range configFileFlags {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		f := configFlags.Lookup(name)
+		if repeatable, ok := f.Value.(repeatableValue); ok {
+			repeatable.reset()
+		} else if err := f.Value.Set(f.DefValue); err != nil {
+			return err
+		}
+	}
+
+	configFileFlags = make(map[string]bool)
+	for name, value := range values {
+		f := configFlags.Lookup(name)
+		if explicitFlags[name] {
+			continue
+		}
+		configFileFlags[name] = true
+		repeatable, isRepeatable := f.Value.(repeatableValue)
+		if isRepeatable {
+			repeatable.reset()
+		}
+		for _, flagValue := range configFlagValues(value, isRepeatable) {
+			err = f.Value.Set(flagValue)
+			if err != nil {
+				return errors.New("Invalid value of config key '" + name + "' " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Parses and validates the flags into the configuration that is derived from them. Called on start and on every reload.
+func parseConfig() error {
+	var err error
+	nodeAddressTypes, err = nodeaddr.ParseAddressTypes(config.NodeAddressPreference)
+	if err != nil {
+		return errors.New("Invalid node address preference " + err.Error())
+	}
+
+	err = parseNodeNameTypes()
+	if err != nil {
+		return err
+	}
+
+	err = validateDnsPublisher()
+	if err != nil {
+		return err
+	}
+
+	err = validateHttpAuth()
+	if err != nil {
+		return err
+	}
+
+	err = validateNamespacedRbac()
+	if err != nil {
+		return err
+	}
+
+	err = validateVirtualIps()
+	if err != nil {
+		return err
+	}
+
+	err = validateServiceNamespace()
+	if err != nil {
+		return err
+	}
+
+	err = validateHostNetworkPods()
+	if err != nil {
+		return err
+	}
+
+	err = validateWhoami()
+	if err != nil {
+		return err
+	}
+
+	_, err = annotations.ParseProtocol(config.DefaultProtocol)
+	if err != nil {
+		return errors.New("Invalid default protocol " + err.Error())
+	}
+
+	preferredAddressCidrs, err = nodeaddr.ParseCidrs(config.PreferredAddressCidrs)
+	if err != nil {
+		return errors.New("Invalid preferred address cidrs " + err.Error())
+	}
+
+	propagateLabels = nil
+	if config.PropagateLabels != "" {
+		propagateLabels, err = regexp.Compile(config.PropagateLabels)
+		if err != nil {
+			return errors.New("Invalid propagate labels regex " + err.Error())
+		}
+	}
+	propagateAnnotations = nil
+	if config.PropagateAnnotations != "" {
+		propagateAnnotations, err = regexp.Compile(config.PropagateAnnotations)
+		if err != nil {
+			return errors.New("Invalid propagate annotations regex " + err.Error())
+		}
+	}
+
+	allowedPorts = nil
+	if config.AllowedPorts != "" {
+		allowedPorts, err = allocator.ParsePortRanges(config.AllowedPorts)
+		if err != nil {
+			return errors.New("Invalid allowed ports " + err.Error())
+		}
+	}
+	deniedPorts = nil
+	if config.DeniedPorts != "" {
+		deniedPorts, err = allocator.ParsePortRanges(config.DeniedPorts)
+		if err != nil {
+			return errors.New("Invalid denied ports " + err.Error())
+		}
+	}
+
+	if config.ServicePerPod && config.K3sServiceLB {
+		return errors.New("One service per pod can't be combined with ServiceLB, which binds a single port per service")
+	}
+
+	err = parseServicePortName()
+	if err != nil {
+		return errors.New("Invalid service port name " + err.Error())
+	}
+	serviceLabelTemplates, err = parseMetadataTemplates(config.ServiceLabelTemplates)
+	if err != nil {
+		return errors.New("Invalid service label template " + err.Error())
+	}
+	serviceAnnotationTemplates, err = parseMetadataTemplates(config.ServiceAnnotationTemplates)
+	if err != nil {
+		return errors.New("Invalid service annotation template " + err.Error())
+	}
+
+	excludedNamespaces = parseNamespaceList(config.ExcludeNamespaces)
+
+	namespaceQuotas, err = parseNamespaceQuotas(config.NamespaceQuotas)
+	if err != nil {
+		return errors.New("Invalid namespace quotas " + err.Error())
+	}
+	if config.DefaultNamespaceQuota < -1 {
+		return errors.New("The default namespace quota must be -1 (unlimited) or more")
+	}
+
+	clusterNodePortRange, err = allocator.ParsePortRanges(config.ClusterNodePortRange)
+	if err != nil {
+		return errors.New("Invalid cluster node port range " + err.Error())
+	}
+
+	if config.NodePortPools != parsedNodePortPools {
+		nodePortAllocator = nil
+		if config.NodePortPools != "" {
+			nodePortAllocator, err = allocator.NewPool(config.NodePortPools)
+			if err != nil {
+				return errors.New("Invalid node port pools " + err.Error())
+			}
+		}
+		parsedNodePortPools = config.NodePortPools
+	}
+
+	return nil
+}
+
+// Returns the values of all flags
+func snapshotFlags() map[string][]string {
+	snapshot := make(map[string][]string)
+	configFlags.VisitAll(func(f *flag.Flag) {
+		if repeatable, ok := f.Value.(repeatableValue); ok {
+			snapshot[f.Name] = repeatable.values()
+		} else {
+			snapshot[f.Name] = []string{f.Value.String()}
+		}
+	})
+	return snapshot
+}
+
+func restoreFlag(f *flag.Flag, values []string) {
+	if repeatable, ok := f.Value.(repeatableValue); ok {
+		repeatable.reset()
+	}
+	for _, value := range values {
+		err := f.Value.Set(value)
+		if err != nil {
+			logErr.Printf("Failed to restore flag '%s' %s", f.Name, err)
+		}
+	}
+}
+
+// Reads the config file again and applies it. The previous config is kept if the new one is invalid.
+func reloadConfig() error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	snapshot := snapshotFlags()
+	previousConfigFileFlags := configFileFlags
+	err := loadConfigFile(config.ConfigFile)
+	if err == nil {
+		// Restored before parsing, so the config is validated and derived with the values that stay in effect
+		for _, name := range restartOnlyFlags {
+			f := configFlags.Lookup(name)
+			if f.Value.String() != snapshot[name][0] {
+				log.Printf("Changing '%s' requires a restart, keeping '%s'", name, snapshot[name][0])
+				restoreFlag(f, snapshot[name])
+			}
+		}
+		err = parseConfig()
+	}
+	if err != nil {
+		current := snapshotFlags()
+		configFlags.VisitAll(func(f *flag.Flag) {
+			if strings.Join(current[f.Name], "\n") != strings.Join(snapshot[f.Name], "\n") {
+				restoreFlag(f, snapshot[f.Name])
+			}
+		})
+		configFileFlags = previousConfigFileFlags
+		if parseErr := parseConfig(); parseErr != nil {
+			logErr.Printf("Failed to restore the previous config %s", parseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Requests a reload on SIGHUP and whenever the content of the config file changes (e.g. an updated ConfigMap volume),
+// until the context is done
+func watchConfig(ctx context.Context, path string, reloads chan<- struct{}) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	content, _ := os.ReadFile(path)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hangups:
+			log.Print("Got SIGHUP, reloading config")
+		case <-ticker.C:
+			newContent, err := os.ReadFile(path)
+			if err != nil || bytes.Equal(content, newContent) {
+				continue
+			}
+			log.Print("Config file changed, reloading config")
+		case <-ctx.Done():
+			return
+		}
+		content, _ = os.ReadFile(path)
+		select {
+		case reloads <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,1782 @@
+// Package controller is the controller of the dynamic hostports. It watches the labeled pods, allocates their node
+// ports with services and endpoints and advertises them in the annotations of the pods. Other programs embed it with
+// Main, Command or New with a Config.
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	logLib "log"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCoreV1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+const servicePrefix = "dynamic-hostports-service"
+
+// The label key and annotation prefix are configurable, so multiple isolated instances can run in one cluster
+var names annotations.Names
+var annotationPrefix string
+var labelKey string
+
+const managedByLabelKey = annotations.ManagedByLabelKey
+
+var managedByLabelValue string
+var forPodLabelKey string
+var forPodNamespaceLabelKey string
+var podUidLabelKey string
+var nodeAnnotation string
+var clusterDnsAnnotation string
+var lastReconciledAnnotation string
+var portsAnnotation string
+var externalIpOverrideAnnotation string
+var mappingsAnnotation string
+var externalIpAnnotation string
+var externalHostnameAnnotation string
+var allocationsAnnotation string
+var zoneAnnotation string
+var regionAnnotation string
+var pausedAnnotation string
+var namespaceEnabledLabel string
+var namespaceExcludedLabel string
+var allowUndeclaredPortsAnnotation string
+var tenantLabel string
+
+// Pod annotations that override the corresponding flags for the generated services
+var ipFamilyPolicyAnnotation string
+var ipFamiliesAnnotation string
+var externalTrafficPolicyAnnotation string
+var internalTrafficPolicyAnnotation string
+var sessionAffinityAnnotation string
+var sessionAffinityTimeoutAnnotation string
+var publishNotReadyAddressesAnnotation string
+var requireReadyAnnotation string
+var preAllocateAnnotation string
+var allocationStrategyAnnotation string
+var baseNodePortAnnotation string
+var preferredNodePortAnnotation string
+var defaultProtocolAnnotation string
+var serviceTypeAnnotation string
+var nodeAddressPreferenceAnnotation string
+var nodePortPoolAnnotation string
+var leaseTtlAnnotation string
+var headlessServiceAnnotation string
+var advertiseNodeNamesAnnotation string
+var leaseRenewedAnnotation string
+
+// Derives all label and annotation names from the label key and annotation prefix
+func setNames(newLabelKey string, newAnnotationPrefix string) {
+	names = annotations.NewNames(newLabelKey, newAnnotationPrefix)
+	labelKey = names.LabelKey
+	annotationPrefix = names.Prefix
+	managedByLabelValue = names.ManagedByLabelValue
+	forPodLabelKey = names.ForPodLabel
+	forPodNamespaceLabelKey = names.ForPodNamespaceLabel
+	podUidLabelKey = names.PodUIDLabel
+	nodeAnnotation = names.Node
+	clusterDnsAnnotation = names.ClusterDNS
+	lastReconciledAnnotation = names.LastReconciled
+	portsAnnotation = names.Ports
+	externalIpOverrideAnnotation = names.ExternalIPOverride
+	mappingsAnnotation = names.Mappings
+	externalIpAnnotation = names.ExternalIP
+	externalHostnameAnnotation = names.ExternalHostname
+	allocationsAnnotation = names.Allocations
+	zoneAnnotation = names.Zone
+	regionAnnotation = names.Region
+	pausedAnnotation = names.Paused
+	namespaceEnabledLabel = names.NamespaceEnabled
+	namespaceExcludedLabel = names.NamespaceExcluded
+	allowUndeclaredPortsAnnotation = names.AllowUndeclaredPorts
+	tenantLabel = names.Tenant
+	ipFamilyPolicyAnnotation = names.IPFamilyPolicy
+	ipFamiliesAnnotation = names.IPFamilies
+	externalTrafficPolicyAnnotation = names.ExternalTrafficPolicy
+	internalTrafficPolicyAnnotation = names.InternalTrafficPolicy
+	sessionAffinityAnnotation = names.SessionAffinity
+	sessionAffinityTimeoutAnnotation = names.SessionAffinityTimeout
+	publishNotReadyAddressesAnnotation = names.PublishNotReadyAddresses
+	requireReadyAnnotation = names.RequireReady
+	preAllocateAnnotation = names.PreAllocate
+	allocationStrategyAnnotation = names.AllocationStrategy
+	baseNodePortAnnotation = names.BaseNodePort
+	preferredNodePortAnnotation = names.PreferredNodePort
+	defaultProtocolAnnotation = names.DefaultProtocol
+	serviceTypeAnnotation = names.ServiceType
+	nodeAddressPreferenceAnnotation = names.NodeAddressPreference
+	nodePortPoolAnnotation = names.NodePortPool
+	leaseTtlAnnotation = names.LeaseTTL
+	headlessServiceAnnotation = names.HeadlessService
+	advertiseNodeNamesAnnotation = names.AdvertiseNodeNames
+	leaseRenewedAnnotation = names.LeaseRenewed
+}
+
+func init() {
+	setNames(annotations.DefaultLabelKey, annotations.DefaultPrefix)
+}
+
+var log = logLib.New(os.Stdout, "", 0)
+var logErr = logLib.New(os.Stderr, "", 0)
+
+// Used to report problems of a pod as events on the pod itself
+var recorder record.EventRecorder = &record.FakeRecorder{}
+
+var propagateLabels *regexp.Regexp
+var propagateAnnotations *regexp.Regexp
+var nodeAddressTypes []v1.NodeAddressType
+var preferredAddressCidrs []*net.IPNet
+var nodePortAllocator *allocator.Pool
+var clusterNodePortRange []allocator.PortRange
+var namespaceQuotas map[string]int
+var allowedPorts []allocator.PortRange
+var deniedPorts []allocator.PortRange
+var excludedNamespaces map[string]bool
+
+type podState int
+
+const (
+	podStateNew podState = iota
+	// The services were already created, but the endpoints are still missing
+	podStatePreAllocated
+	podStateHandled
+	// The lease expired, the services stay deleted until it is renewed
+	podStateLeaseExpired
+)
+
+func podPortToAnnotation(requestedPort PortRequest) string {
+	return names.NodePort(requestedPort)
+}
+
+func podPortToEndpointAnnotation(requestedPort PortRequest) string {
+	return names.Endpoint(requestedPort)
+}
+
+func podPortToEndpointsAnnotation(requestedPort PortRequest) string {
+	return names.Endpoints(requestedPort)
+}
+
+func podPortToServiceName(pod *v1.Pod, requestedPort PortRequest) string {
+	if config.ServicePerPod {
+		return podServiceBaseName(pod)
+	}
+	return podServiceBaseName(pod) + "-" + requestedPort.Key()
+}
+
+// The node name is required by kube-proxy to detect local endpoints (externalTrafficPolicy: Local)
+func podEndpointAddress(pod *v1.Pod, ip string) v1.EndpointAddress {
+	nodeName := pod.Spec.NodeName
+	return v1.EndpointAddress{
+		IP:       ip,
+		NodeName: &nodeName,
+		TargetRef: &v1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			UID:       pod.UID,
+		},
+	}
+}
+
+// Returns the endpoint addresses of all ips (IPv4 and IPv6) of the pod
+func podEndpointAddresses(pod *v1.Pod) []v1.EndpointAddress {
+	if len(pod.Status.PodIPs) == 0 {
+		return []v1.EndpointAddress{
+			podEndpointAddress(pod, pod.Status.PodIP),
+		}
+	}
+
+	addresses := make([]v1.EndpointAddress, len(pod.Status.PodIPs))
+	for i, podIp := range pod.Status.PodIPs {
+		addresses[i] = podEndpointAddress(pod, podIp.IP)
+	}
+	return addresses
+}
+
+// Returns the entries whose key matches the pattern. Our own labels and annotations are never copied.
+func propagatedMetadata(values map[string]string, pattern *regexp.Regexp) map[string]string {
+	propagated := make(map[string]string)
+	if pattern == nil {
+		return propagated
+	}
+	for key, value := range values {
+		if pattern.MatchString(key) && key != labelKey && !strings.HasPrefix(key, annotationPrefix+"/") {
+			propagated[key] = value
+		}
+	}
+	return propagated
+}
+
+func serviceMeta(pod *v1.Pod, requestedPort PortRequest) metav1.ObjectMeta {
+	labels := propagatedMetadata(pod.Labels, propagateLabels)
+	for key, value := range managedLabels() {
+		labels[key] = value
+	}
+	labels[forPodLabelKey] = pod.Name
+	labels[podUidLabelKey] = string(pod.UID)
+	if config.ServiceNamespace != "" {
+		labels[forPodNamespaceLabelKey] = pod.Namespace
+	}
+
+	meta := metav1.ObjectMeta{
+		Name:      podPortToServiceName(pod, requestedPort),
+		Namespace: serviceNamespace(pod.Namespace),
+		Labels:    labels,
+	}
+	annotations := propagatedMetadata(pod.Annotations, propagateAnnotations)
+	if pod.Spec.NodeName != "" {
+		// Node names can be longer than label values
+		annotations[nodeAnnotation] = pod.Spec.NodeName
+	}
+	if len(annotations) > 0 {
+		meta.Annotations = annotations
+	}
+	return meta
+}
+
+func createEndpoints(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) error {
+	portName, err := servicePortName(pod, requestedPort)
+	if err != nil {
+		return err
+	}
+	endpoints := client.CoreV1().Endpoints(serviceNamespace(pod.Namespace))
+	_, err = endpoints.Create(
+		context.Background(),
+		&v1.Endpoints{
+			ObjectMeta: serviceMeta(pod, requestedPort),
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: podEndpointAddresses(pod),
+					Ports: []v1.EndpointPort{
+						{
+							Name:     portName,
+							Port:     requestedPort.Port,
+							Protocol: requestedPort.Protocol,
+						},
+					},
+				},
+			},
+		},
+		metav1.CreateOptions{},
+	)
+	if !k8sErrors.IsAlreadyExists(err) || !config.ServicePerPod {
+		return err
+	}
+
+	// The endpoints of the pod already exist with its other ports
+	existing, err := endpoints.Get(context.Background(), podPortToServiceName(pod, requestedPort), metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if len(existing.Subsets) == 0 {
+		existing.Subsets = []v1.EndpointSubset{{Addresses: podEndpointAddresses(pod)}}
+	}
+	for _, port := range existing.Subsets[0].Ports {
+		if port.Name == portName {
+			return nil
+		}
+	}
+	existing.Subsets[0].Ports = append(existing.Subsets[0].Ports, v1.EndpointPort{Name: portName, Port: requestedPort.Port, Protocol: requestedPort.Protocol})
+	_, err = endpoints.Update(context.Background(), existing, metav1.UpdateOptions{})
+	return err
+}
+
+func createService(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, cachedExternalIPs map[string][]string) error {
+	return createServices(client, pod, []PortRequest{requestedPort}, false, cachedExternalIPs)
+}
+
+// The services of a pod are created concurrently, but not too many at once for pods with large port ranges
+const maxParallelServiceCreations = 8
+
+// Creates the services (and endpoints) of the ports concurrently and adds all their annotations with a single patch.
+// The services that fit into the namespace quota are created even if the others don't.
+func createServices(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest, withEndpoints bool, cachedExternalIPs map[string][]string) error {
+	if len(requestedPorts) == 0 {
+		return nil
+	}
+	var quotaErr error
+	left, err := namespaceQuotaLeft(client, pod)
+	if err != nil {
+		return err
+	}
+	if left >= 0 && left < len(requestedPorts) {
+		requestedPorts = requestedPorts[:left]
+		quotaErr = errNamespaceQuotaExceeded
+	}
+
+	blocks, blockNodePorts, err := allocatePortBlocks(pod, requestedPorts)
+	if err != nil {
+		return err
+	}
+
+	// All ports of the pod are advertised on the same ips, the cache must not be used concurrently
+	externalIps := getPodExternalIps(client, pod, cachedExternalIPs)
+	nodeNames := getPodNodeNames(client, pod, cachedExternalIPs)
+
+	var wait sync.WaitGroup
+	created := make([]map[string]string, len(requestedPorts))
+	errs := make([]error, len(requestedPorts))
+	parallel := maxParallelServiceCreations
+	if config.ServicePerPod {
+		// The ports are added to the same service one after another
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+	for i, requestedPort := range requestedPorts {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if withEndpoints {
+				// The endpoints might already exist if the service creation failed before
+				err := createEndpoints(client, pod, requestedPort)
+				if err != nil && !k8sErrors.IsAlreadyExists(err) {
+					errs[i] = err
+					return
+				}
+			}
+			created[i], errs[i] = createPortService(client, pod, requestedPort, externalIps, nodeNames, blockNodePorts[requestedPort.Key()])
+		}()
+	}
+	wait.Wait()
+
+	annotations := finishPortBlocks(client, pod, requestedPorts, blocks, created, errs)
+	createdAny := false
+	for _, portAnnotations := range created {
+		for key, value := range portAnnotations {
+			annotations[key] = value
+			createdAny = true
+		}
+	}
+
+	// The annotations of the created services are added even if others failed, they are not created again
+	if createdAny {
+		for key, value := range nodeTopologyAnnotations(client, pod, cachedExternalIPs) {
+			annotations[key] = value
+		}
+		err := patchPodAnnotations(client, pod, annotations)
+		if err != nil {
+			logErr.Printf("[%s] Adding the port annotations failed %s", pod.Name, err)
+			return err
+		}
+		// Pre-allocated services are created before the pod is eligible
+		if since := podEligibleSince(pod); withEndpoints && !since.IsZero() {
+			allocationLatencySeconds.WithLabelValues(pod.Namespace).Observe(max(time.Since(since).Seconds(), 0))
+		}
+	}
+	err = errors.Join(errs...)
+	if err != nil {
+		return err
+	}
+	return quotaErr
+}
+
+// Creates the service of the port and returns the pod annotations of it. The node port of a port block is the only
+// node port that is requested, otherwise the allocation strategy of the pod picks them.
+func createPortService(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, externalIps []string, nodeNames []string, blockNodePort int32) (map[string]string, error) {
+	log.Printf("[%s] Create service for port %s", pod.Name, requestedPort)
+
+	portName, err := servicePortName(pod, requestedPort)
+	if err != nil {
+		return nil, err
+	}
+	serviceDef := v1.Service{
+		ObjectMeta: serviceMeta(pod, requestedPort),
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{
+				{
+					Name:       portName,
+					Port:       requestedPort.Port,
+					TargetPort: intstr.FromInt(int(requestedPort.Port)),
+					Protocol:   requestedPort.Protocol,
+				},
+			},
+		},
+	}
+
+	if ips := nodeaddr.IPs(externalIps); len(ips) > 0 && !config.K3sServiceLB && config.SetExternalIps {
+		serviceDef.Spec.ExternalIPs = ips
+	} else if len(ips) > 0 && !config.K3sServiceLB {
+		// The discovery outputs read the advertised ips from the service
+		if serviceDef.Annotations == nil {
+			serviceDef.Annotations = make(map[string]string)
+		}
+		serviceDef.Annotations[externalIpAnnotation] = strings.Join(ips, ",")
+	} else if !config.K3sServiceLB {
+		log.Printf("[%s] Got no address of node '%s'. The service will exposed over all nodes.", pod.Name, pod.Spec.NodeName)
+	}
+
+	err = applyServiceSettings(pod, &serviceDef, externalIps)
+	if err != nil {
+		return nil, err
+	}
+	if config.K3sServiceLB {
+		// ServiceLB exposes the service on the nodes itself
+		serviceDef.Spec.Type = v1.ServiceTypeLoadBalancer
+	}
+
+	strategy, err := allocationStrategyForPod(pod)
+	if err != nil {
+		return nil, err
+	}
+	newService, err := createServiceWithNodePort(client, pod, &serviceDef, requestedPort, strategy, blockNodePort)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.K3sServiceLB {
+		newService, err = alignServiceLBPort(client, newService)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nodePort := nodePortOf(newService, requestedPort)
+	strategy.Allocated(client, pod, requestedPort, nodePort)
+
+	// The service is already usable, so a broken template must not prevent the pod annotation
+	err = applyMetadataTemplates(client, pod, newService, requestedPort, externalIps)
+	if err != nil {
+		logErr.Printf("[%s] Failed to apply metadata templates to service '%s' %s", pod.Name, newService.Name, err)
+	}
+
+	if config.K3sServiceLB {
+		// The addresses are known once ServiceLB bound the port
+		externalIps = nil
+		nodeNames = nil
+		go waitForServiceLB(client, pod, requestedPort, newService)
+	}
+	return portAnnotations(requestedPort, nodePort, externalIps, nodeNames), nil
+}
+
+// Returns the value of the pod annotation, the namespace annotation or the default value if neither is set
+func podSetting(pod *v1.Pod, annotation string, defaultValue string) string {
+	if value, ok := pod.Annotations[annotation]; ok {
+		return value
+	}
+	if value, ok := namespaceAnnotation(pod.Namespace, annotation); ok {
+		return value
+	}
+	return defaultValue
+}
+
+func podBoolSetting(pod *v1.Pod, annotation string, defaultValue bool) (bool, error) {
+	return strconv.ParseBool(podSetting(pod, annotation, strconv.FormatBool(defaultValue)))
+}
+
+// Applies all user configurable settings of the pod annotations and flags to the service
+func applyServiceSettings(pod *v1.Pod, serviceDef *v1.Service, externalIps []string) error {
+	err := applyIpFamilies(pod, serviceDef, externalIps)
+	if err != nil {
+		return err
+	}
+
+	serviceType := v1.ServiceType(podSetting(pod, serviceTypeAnnotation, config.ServiceType))
+	switch serviceType {
+	case v1.ServiceTypeNodePort, v1.ServiceTypeLoadBalancer:
+		serviceDef.Spec.Type = serviceType
+	default:
+		return errors.New("Invalid service type '" + string(serviceType) + "'")
+	}
+
+	externalTrafficPolicy := v1.ServiceExternalTrafficPolicy(podSetting(pod, externalTrafficPolicyAnnotation, config.ExternalTrafficPolicy))
+	switch externalTrafficPolicy {
+	case "":
+	case v1.ServiceExternalTrafficPolicyCluster, v1.ServiceExternalTrafficPolicyLocal:
+		serviceDef.Spec.ExternalTrafficPolicy = externalTrafficPolicy
+	default:
+		return errors.New("Invalid external traffic policy '" + string(externalTrafficPolicy) + "'")
+	}
+
+	internalTrafficPolicy := v1.ServiceInternalTrafficPolicy(podSetting(pod, internalTrafficPolicyAnnotation, config.InternalTrafficPolicy))
+	switch internalTrafficPolicy {
+	case "":
+	case v1.ServiceInternalTrafficPolicyCluster, v1.ServiceInternalTrafficPolicyLocal:
+		serviceDef.Spec.InternalTrafficPolicy = &internalTrafficPolicy
+	default:
+		return errors.New("Invalid internal traffic policy '" + string(internalTrafficPolicy) + "'")
+	}
+
+	publishNotReadyAddresses, err := podBoolSetting(pod, publishNotReadyAddressesAnnotation, config.PublishNotReadyAddresses)
+	if err != nil {
+		return err
+	}
+	serviceDef.Spec.PublishNotReadyAddresses = publishNotReadyAddresses
+
+	return applySessionAffinity(pod, serviceDef)
+}
+
+// Sets the sessionAffinity and the optional ClientIP timeout of the service
+func applySessionAffinity(pod *v1.Pod, serviceDef *v1.Service) error {
+	sessionAffinity := v1.ServiceAffinity(podSetting(pod, sessionAffinityAnnotation, config.SessionAffinity))
+	switch sessionAffinity {
+	case "", v1.ServiceAffinityNone:
+		serviceDef.Spec.SessionAffinity = sessionAffinity
+		return nil
+	case v1.ServiceAffinityClientIP:
+		serviceDef.Spec.SessionAffinity = sessionAffinity
+	default:
+		return errors.New("Invalid session affinity '" + string(sessionAffinity) + "'")
+	}
+
+	timeoutString := podSetting(pod, sessionAffinityTimeoutAnnotation, strconv.Itoa(config.SessionAffinityTimeout))
+	timeout, err := strconv.Atoi(timeoutString)
+	if err != nil {
+		return err
+	}
+	if timeout < 0 || timeout > 86400 {
+		return errors.New("Session affinity timeout is not in valid range")
+	}
+	if timeout > 0 {
+		timeoutSeconds := int32(timeout)
+		serviceDef.Spec.SessionAffinityConfig = &v1.SessionAffinityConfig{
+			ClientIP: &v1.ClientIPConfig{
+				TimeoutSeconds: &timeoutSeconds,
+			},
+		}
+	}
+
+	return nil
+}
+
+// Sets the ipFamilyPolicy and ipFamilies of the service based on the pod annotation, flags or the advertised ips
+func applyIpFamilies(pod *v1.Pod, serviceDef *v1.Service, externalIps []string) error {
+	policyString := podSetting(pod, ipFamilyPolicyAnnotation, config.IpFamilyPolicy)
+	switch v1.IPFamilyPolicy(policyString) {
+	case "":
+		if nodeaddr.IsDualStack(externalIps) {
+			// Falls back to single-stack if the cluster does not support dual-stack
+			policy := v1.IPFamilyPolicyPreferDualStack
+			serviceDef.Spec.IPFamilyPolicy = &policy
+		}
+	case v1.IPFamilyPolicySingleStack, v1.IPFamilyPolicyPreferDualStack, v1.IPFamilyPolicyRequireDualStack:
+		policy := v1.IPFamilyPolicy(policyString)
+		serviceDef.Spec.IPFamilyPolicy = &policy
+	default:
+		return errors.New("Invalid ip family policy '" + policyString + "'")
+	}
+
+	familiesString := podSetting(pod, ipFamiliesAnnotation, config.IpFamilies)
+	if familiesString != "" {
+		for _, val := range strings.Split(familiesString, ",") {
+			family := v1.IPFamily(strings.TrimSpace(val))
+			if family != v1.IPv4Protocol && family != v1.IPv6Protocol {
+				return errors.New("Invalid ip family '" + string(family) + "'")
+			}
+			serviceDef.Spec.IPFamilies = append(serviceDef.Spec.IPFamilies, family)
+		}
+	}
+
+	return nil
+}
+
+// Returns the ips that should be advertised for the pod. The override annotation and the virtual ips take precedence
+// over the node's ips.
+func getPodExternalIps(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) []string {
+	return podAdvertisedIps(client, pod, cachedExternalIPs, false)
+}
+
+// Like getPodExternalIps, but the virtual ips and relay gateways are skipped if the ports are bound on the node itself
+func podAdvertisedIps(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string, boundOnNode bool) []string {
+	if override := pod.Annotations[externalIpOverrideAnnotation]; override != "" {
+		if net.ParseIP(override) != nil {
+			return []string{override}
+		}
+		logErr.Printf("[%s] Ignoring invalid ip '%s' in annotation '%s'", pod.Name, override, externalIpOverrideAnnotation)
+	}
+
+	if !boundOnNode {
+		if ips := getPodVirtualIps(client, pod, cachedExternalIPs); len(ips) > 0 {
+			return ips
+		}
+	}
+
+	addressTypes := nodeAddressTypes
+	if preference := podSetting(pod, nodeAddressPreferenceAnnotation, ""); preference != "" {
+		var err error
+		addressTypes, err = nodeaddr.ParseAddressTypes(preference)
+		if err != nil {
+			logErr.Printf("[%s] Ignoring node address preference %s", pod.Name, err)
+			addressTypes = nodeAddressTypes
+		}
+	}
+
+	if config.NamespacedRbac {
+		return getNamespacedNodeIps(client, pod, cachedExternalIPs)
+	}
+
+	if config.RelayGatewaySelector != "" && !boundOnNode {
+		// The node ports are reachable through the relay on the gateway nodes
+		ips, err := getGatewayIps(client, addressTypes, cachedExternalIPs)
+		if err == nil {
+			return ips
+		}
+		logErr.Printf("[%s] Failed to fetch the gateway nodes, falling back to the ips of node '%s' %s", pod.Name, pod.Spec.NodeName, err)
+	}
+
+	ips, err := getOrFetchNodeIps(client, pod.Spec.NodeName, addressTypes, cachedExternalIPs)
+	if err != nil {
+		// The node lookup can fail (e.g. missing RBAC permissions), the host ip is still better than nothing
+		log.Printf("[%s] Got an error while fetching ip of node '%s', falling back to host ip '%s'. %s", pod.Name, pod.Spec.NodeName, pod.Status.HostIP, err)
+		if pod.Status.HostIP == "" {
+			return nil
+		}
+		return []string{pod.Status.HostIP}
+	}
+
+	return ips
+}
+
+// Returns the (cached) addresses of the first of the address types that the node has.
+// Unless all ips should be advertised only the first matching address is returned.
+func getOrFetchNodeIps(client kubernetes.Interface, nodeName string, addressTypes []v1.NodeAddressType, cachedExternalIPs map[string][]string) ([]string, error) {
+	cacheKey := nodeName + "/" + addressTypesKey(addressTypes)
+	ips, knowsIPs := cachedExternalIPs[cacheKey]
+	if !knowsIPs {
+		node, err := getNode(client, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		var addressType v1.NodeAddressType
+		ips, addressType = nodeaddr.AddressesByPriority(node, addressTypes, preferredAddressCidrs, config.AdvertiseAllNodeIps)
+		if kind := nodeaddr.LocalClusterKind(node); kind != "" && len(ips) > 0 && addressType != addressTypes[0] {
+			// Local clusters have no external ips, but their internal ip is reachable from the host
+			log.Printf("Node '%s' of the local %s cluster has no %s, advertising its %s instead", nodeName, kind, addressTypes[0], addressType)
+		}
+		if len(ips) > 0 {
+			log.Printf("Caching %s ips of node '%s' => %s", addressType, nodeName, strings.Join(ips, ","))
+			cachedExternalIPs[cacheKey] = ips
+		}
+	}
+
+	return ips, nil
+}
+
+// Returns the pod annotations with the zone and region of the node, so clients can pick a close server without
+// reading the nodes. They are not known in the namespaced rbac mode.
+func nodeTopologyAnnotations(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) map[string]string {
+	annotations := make(map[string]string)
+	if config.NamespacedRbac || pod.Spec.NodeName == "" {
+		return annotations
+	}
+	cacheKey := "topology/" + pod.Spec.NodeName
+	topology, ok := cachedExternalIPs[cacheKey]
+	if !ok {
+		node, err := getNode(client, pod.Spec.NodeName)
+		if err != nil {
+			logErr.Printf("[%s] Failed to get the topology of node '%s' %s", pod.Name, pod.Spec.NodeName, err)
+			return annotations
+		}
+		topology = []string{node.Labels[v1.LabelTopologyZone], node.Labels[v1.LabelTopologyRegion]}
+		cachedExternalIPs[cacheKey] = topology
+	}
+	if topology[0] != "" {
+		annotations[zoneAnnotation] = topology[0]
+	}
+	if topology[1] != "" {
+		annotations[regionAnnotation] = topology[1]
+	}
+	return annotations
+}
+
+func addressTypesKey(addressTypes []v1.NodeAddressType) string {
+	keys := make([]string, len(addressTypes))
+	for i, addressType := range addressTypes {
+		keys[i] = string(addressType)
+	}
+	return strings.Join(keys, ",")
+}
+
+// Returns the pod annotations with the node port and the endpoints of the port. The endpoints use the node names
+// instead of the ips if there are any.
+func portAnnotations(requestedPort PortRequest, dynamicPort int32, externalIps []string, nodeNames []string) map[string]string {
+	annotations := map[string]string{
+		podPortToAnnotation(requestedPort): strconv.Itoa(int(dynamicPort)),
+	}
+	if len(externalIps) > 0 {
+		// All ports of the pod are advertised on the same ips
+		annotations[externalIpAnnotation] = strings.Join(externalIps, ",")
+	}
+	hosts := externalIps
+	if len(nodeNames) > 0 {
+		annotations[externalHostnameAnnotation] = strings.Join(nodeNames, ",")
+		hosts = nodeNames
+	}
+	if len(hosts) > 0 {
+		annotations[podPortToEndpointAnnotation(requestedPort)] = net.JoinHostPort(hosts[0], strconv.Itoa(int(dynamicPort)))
+	}
+	if len(hosts) > 1 {
+		endpoints := make([]string, len(hosts))
+		for i, host := range hosts {
+			endpoints[i] = net.JoinHostPort(host, strconv.Itoa(int(dynamicPort)))
+		}
+		annotations[podPortToEndpointsAnnotation(requestedPort)] = strings.Join(endpoints, ",")
+	}
+	return annotations
+}
+
+// Returns the allocations annotation of all node port annotations of the pod, so scripts can read the allocations
+// from one JSON array. False is returned if the pod has no node port annotations.
+func allocationsAnnotationValue(pod *v1.Pod, podAnnotations map[string]string) (string, bool) {
+	allocations := []annotations.Allocation{}
+	for key, value := range podAnnotations {
+		requestedPort, ok := names.NodePortRequest(key)
+		if !ok {
+			continue
+		}
+		nodePort, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		allocation := annotations.Allocation{Port: requestedPort.Port, Protocol: requestedPort.Protocol, NodePort: int32(nodePort)}
+		if host, _, err := net.SplitHostPort(podAnnotations[podPortToEndpointAnnotation(requestedPort)]); err == nil {
+			allocation.Address = host
+		}
+		if !isAnnotatedHostNetworkPod(pod) {
+			allocation.Service = podPortToServiceName(pod, requestedPort)
+		}
+		allocations = append(allocations, allocation)
+	}
+	if len(allocations) == 0 {
+		return "", false
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Port != allocations[j].Port {
+			return allocations[i].Port < allocations[j].Port
+		}
+		return allocations[i].Protocol < allocations[j].Protocol
+	})
+	value, err := json.Marshal(allocations)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+// The node port and endpoint annotations are summarized in the allocations annotation
+func changesAllocations(key string) bool {
+	_, ok := names.NodePortRequest(key)
+	return ok || strings.HasPrefix(key, annotationPrefix+"/endpoint-")
+}
+
+func addPodPortAnnotation(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, dynamicPort int32, externalIps []string) error {
+	annotations := portAnnotations(requestedPort, dynamicPort, externalIps, nil)
+	err := patchPodAnnotations(client, pod, annotations)
+	if err != nil {
+		logErr.Printf("[%s] Adding annotation %s=>%d failed %s", pod.Name, requestedPort, dynamicPort, err)
+	}
+
+	return err
+}
+
+func patchPodAnnotations(client kubernetes.Interface, pod *v1.Pod, annotations map[string]string) error {
+	return updatePodAnnotations(client, pod, annotations, nil)
+}
+
+// Sets and removes annotations of the pod in a single patch. The allocations annotation is recalculated from the
+// annotations of the pod with both applied, unless it is removed as well.
+func updatePodAnnotations(client kubernetes.Interface, pod *v1.Pod, annotations map[string]string, removedKeys []string) error {
+	patch := make(map[string]interface{})
+	for key, value := range annotations {
+		patch[key] = value
+	}
+	for _, key := range removedKeys {
+		patch[key] = nil
+	}
+	recalculate := slices.ContainsFunc(removedKeys, changesAllocations)
+	for key := range annotations {
+		recalculate = recalculate || changesAllocations(key)
+	}
+	if recalculate && !slices.Contains(removedKeys, allocationsAnnotation) {
+		podAnnotations := maps.Clone(pod.Annotations)
+		if podAnnotations == nil {
+			podAnnotations = make(map[string]string)
+		}
+		maps.Copy(podAnnotations, annotations)
+		for _, key := range removedKeys {
+			delete(podAnnotations, key)
+		}
+		if value, ok := allocationsAnnotationValue(pod, podAnnotations); ok {
+			patch[allocationsAnnotation] = value
+		} else {
+			patch[allocationsAnnotation] = nil
+		}
+	}
+	metadata := map[string]interface{}{
+		"annotations": patch,
+	}
+	labels := make(map[string]interface{})
+	if config.PortLabels {
+		// Labels can be used in selectors and downward API projections, unlike annotations
+		for key, value := range annotations {
+			if label, ok := names.PortLabel(key); ok {
+				labels[label] = value
+			}
+		}
+	}
+	// The labels of --port-labels are removed even if the flag was disabled in the meantime
+	for _, key := range removedKeys {
+		if label, ok := names.PortLabel(key); ok && pod.Labels[label] != "" {
+			labels[label] = nil
+		}
+	}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if pod.UID != "" {
+		// The uid is a precondition, a new incarnation of the pod must not get the annotations of the previous one
+		metadata["uid"] = pod.UID
+	}
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"kind":       "Pod",
+		"apiVersion": "v1",
+		"metadata":   metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Pods(pod.Namespace).Patch(
+		context.Background(),
+		pod.Name,
+		types.MergePatchType,
+		serializedJson,
+		metav1.PatchOptions{},
+	)
+	return err
+}
+
+func deleteService(client kubernetes.Interface, namespace string, serviceName string) error {
+	err := client.CoreV1().Services(namespace).Delete(context.Background(), serviceName, metav1.DeleteOptions{})
+	if err == nil {
+		if nodePortAllocator != nil {
+			nodePortAllocator.Release(allocator.ServiceKey(namespace, serviceName))
+		}
+		releaseGlobalNodePorts(allocator.ServiceKey(namespace, serviceName))
+	}
+	return err
+}
+
+// Deletes the service of the port. With one service per pod only the port is removed from the service of the pod,
+// which is deleted together with its last port.
+func deletePortService(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) error {
+	serviceName := podPortToServiceName(pod, requestedPort)
+	if !config.ServicePerPod {
+		return deleteService(client, serviceNamespace(pod.Namespace), serviceName)
+	}
+	service, err := client.CoreV1().Services(serviceNamespace(pod.Namespace)).Get(context.Background(), serviceName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	nodePort := nodePortOf(service, requestedPort)
+	service.Spec.Ports = slices.DeleteFunc(service.Spec.Ports, func(port v1.ServicePort) bool {
+		return servicePortRequest(port).Key() == requestedPort.Key()
+	})
+	if len(service.Spec.Ports) == 0 {
+		return deleteService(client, service.Namespace, serviceName)
+	}
+	_, err = client.CoreV1().Services(service.Namespace).Update(context.Background(), service, metav1.UpdateOptions{})
+	if err == nil {
+		releaseNodePort(service, nodePort)
+	}
+	return err
+}
+
+func deletePodServices(client kubernetes.Interface, pod *v1.Pod) error {
+	// The services are looked up by their label, since the requested ports might have changed in the meantime
+	services, err := listPodServices(client, pod)
+	if err != nil {
+		return err
+	}
+
+	for _, service := range services.Items {
+		if !isServiceOfPod(&service, pod) {
+			// A new incarnation of the pod might already have created its services
+			continue
+		}
+		log.Printf("[%s] Deleting service %s.", pod.Name, service.Name)
+		err := deleteService(client, service.Namespace, service.Name)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return deletePodRecords(pod)
+}
+
+// Returns true if the namespace has the paused annotation. Errors are treated as not paused.
+func isNamespacePaused(namespace string) bool {
+	if namespaceLister == nil {
+		return false
+	}
+	ns, err := getNamespace(namespace)
+	if err != nil {
+		logErr.Printf("Failed to get namespace '%s' %s", namespace, err)
+		return false
+	}
+	return ns.Annotations[pausedAnnotation] == "true"
+}
+
+// Paused pods are not reconciled at all, their services are neither created, modified nor deleted
+func isPaused(pod *v1.Pod) bool {
+	return pod.Annotations[pausedAnnotation] == "true" || isNamespacePaused(pod.Namespace)
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// Returns when the pod became eligible for its services, which is when its first container started or when it became
+// ready if that is required. The ip is assigned before the containers start. Returns the zero time if it is unknown.
+func podEligibleSince(pod *v1.Pod) time.Time {
+	requireReady, _ := podBoolSetting(pod, requireReadyAnnotation, config.RequireReady)
+	if requireReady {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return condition.LastTransitionTime.Time
+			}
+		}
+		return time.Time{}
+	}
+	var since time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running != nil && (since.IsZero() || status.State.Running.StartedAt.Time.Before(since)) {
+			since = status.State.Running.StartedAt.Time
+		}
+	}
+	return since
+}
+
+// Returns false if the pod already has its annotation for the port, which means that the service already exists
+func needsService(pod *v1.Pod, requestedPort PortRequest) bool {
+	if pod.Annotations[podPortToAnnotation(requestedPort)] != "" {
+		log.Printf("[%s] Pod already has service annotation for port %s. Skipping recreation.", pod.Name, requestedPort)
+		return false
+	}
+	return true
+}
+
+// Returns the requested ports that have no service yet
+func missingServices(pod *v1.Pod, requestedPorts []PortRequest) []PortRequest {
+	var missing []PortRequest
+	for _, requestedPort := range requestedPorts {
+		if needsService(pod, requestedPort) {
+			missing = append(missing, requestedPort)
+		}
+	}
+	return missing
+}
+
+func handlePodEvent(client kubernetes.Interface, eventType watch.EventType, pod *v1.Pod, handledPods map[string]podState, cachedExternalIPs map[string][]string) error {
+	namespacedPodName := pod.Namespace + "/" + pod.Name // Prevent multiple attempts of creating a service
+	if eventType == watch.Deleted {
+		delete(handledPods, namespacedPodName)
+	}
+	if isNamespaceExcluded(pod.Namespace) {
+		log.Printf("[%s] Ignoring pod because its namespace is excluded.", pod.Name)
+		return nil
+	}
+	if isPaused(pod) {
+		log.Printf("[%s] Ignoring pod because it or its namespace is paused.", pod.Name)
+		return nil
+	}
+
+	if eventType == watch.Deleted {
+		err := deletePodServices(client, pod)
+		if err != nil {
+			return err
+		}
+		err = removeUnmanagedPodAnnotations(client, pod)
+		if err != nil {
+			return err
+		}
+	} else {
+		expiry, err := leaseExpiry(pod)
+		if err != nil {
+			return err
+		}
+		if !expiry.IsZero() {
+			if !time.Now().Before(expiry) {
+				if handledPods[namespacedPodName] == podStateLeaseExpired {
+					return nil
+				}
+				err := expireLease(client, pod)
+				if err != nil {
+					return err
+				}
+				handledPods[namespacedPodName] = podStateLeaseExpired
+				return nil
+			}
+			if handledPods[namespacedPodName] == podStateLeaseExpired {
+				log.Printf("[%s] The lease was renewed.", pod.Name)
+				handledPods[namespacedPodName] = podStateNew
+			}
+			scheduleLeaseCheck(pod, expiry)
+		}
+
+		if handledPods[namespacedPodName] == podStateHandled {
+			log.Printf("[%s] Ignoring pod because it was already handled.", pod.Name)
+			return nil
+		}
+
+		if !isNamespaceEnabled(pod.Namespace) {
+			log.Printf("[%s] Ignoring pod because its namespace is not enrolled.", pod.Name)
+			return nil
+		}
+
+		if !isTenantPod(client, pod) {
+			log.Printf("[%s] Ignoring pod because it does not belong to tenant '%s'.", pod.Name, config.Tenant)
+			return nil
+		}
+
+		requestedPorts, err := getRequestedPorts(client, pod)
+		if err != nil {
+			return err
+		}
+		requestedPorts = filterAllowedPorts(pod, requestedPorts)
+		requestedPorts, err = filterPolicyHookPorts(pod, requestedPorts)
+		if err != nil {
+			return err
+		}
+		warnUndeclaredPorts(pod, requestedPorts)
+
+		if pod.Spec.HostNetwork && config.HostNetworkPods != hostNetworkPodsService {
+			return handleHostNetworkPod(client, pod, requestedPorts, handledPods, cachedExternalIPs)
+		}
+
+		preAllocate, err := podBoolSetting(pod, preAllocateAnnotation, config.PreAllocate)
+		if err != nil {
+			return err
+		}
+		if preAllocate && handledPods[namespacedPodName] == podStateNew {
+			if pod.Spec.NodeName == "" {
+				log.Printf("[%s] Ignoring pod because it is not scheduled yet.", pod.Name)
+				return nil
+			}
+
+			handledPods[namespacedPodName] = podStatePreAllocated
+
+			// The endpoints are created as soon as the pod has an ip
+			err := createServices(client, pod, missingServices(pod, requestedPorts), false, cachedExternalIPs)
+			if err != nil {
+				return err
+			}
+		}
+
+		if pod.Status.PodIP == "" {
+			log.Printf("[%s] Ignoring pod because it does not have an ip.", pod.Name)
+			return nil
+		}
+
+		if pod.Status.Phase != v1.PodRunning {
+			log.Printf("[%s] Ignoring pod because it is not running.", pod.Name)
+			return nil
+		}
+
+		requireReady, err := podBoolSetting(pod, requireReadyAnnotation, config.RequireReady)
+		if err != nil {
+			return err
+		}
+		if requireReady && !isPodReady(pod) {
+			log.Printf("[%s] Ignoring pod because it is not ready.", pod.Name)
+			return nil
+		}
+
+		wasPreAllocated := handledPods[namespacedPodName] == podStatePreAllocated
+		handledPods[namespacedPodName] = podStateHandled
+
+		if wasPreAllocated {
+			for _, requestedPort := range requestedPorts {
+				err := createEndpoints(client, pod, requestedPort)
+				if err != nil && !k8sErrors.IsAlreadyExists(err) {
+					return err
+				}
+			}
+		} else {
+			err := createServices(client, pod, missingServices(pod, requestedPorts), true, cachedExternalIPs)
+			if err != nil {
+				return err
+			}
+		}
+		err = createHeadlessService(client, pod, requestedPorts)
+		if err != nil {
+			logErr.Printf("[%s] Failed to create the headless service %s", pod.Name, err)
+		}
+		err = publishPodRecords(client, pod, cachedExternalIPs)
+		if err != nil {
+			logErr.Printf("[%s] Failed to publish the DNS records %s", pod.Name, err)
+		}
+		setPodCondition(client, pod, v1.ConditionTrue, "Allocated", strconv.Itoa(len(requestedPorts))+" dynamic hostports are allocated")
+	}
+
+	err := updateWorkloadOutputs(client, pod)
+	if err != nil {
+		logErr.Printf("[%s] Failed to update the annotation or ConfigMap of its workload %s", pod.Name, err)
+	}
+
+	return nil
+}
+
+// Returns the label selector of the managed pods
+func podLabelSelector() string {
+	if config.PodSelector == "" {
+		return labelKey
+	}
+	return labelKey + "," + config.PodSelector
+}
+
+// Forwards the events of the pod watch of the namespace until the context is done. The watch is restarted once it
+// times out.
+func watchPods(ctx context.Context, client kubernetes.Interface, namespace string, events *podEventQueue, dog *watchdog) {
+	timeout := int64(60 * 60 * 24) // 24 hours
+	// The watch is resumed from the last resource version, so a restart doesn't list all pods again
+	resourceVersion := ""
+	for ctx.Err() == nil {
+		// The excluded namespaces can be reloaded in the meantime
+		configMutex.RLock()
+		labelSelector, fieldSelector := podLabelSelector(), excludedNamespacesFieldSelector()
+		configMutex.RUnlock()
+		if resourceVersion == "" {
+			pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+				LabelSelector: labelSelector,
+				FieldSelector: fieldSelector,
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logErr.Panicf("Error while listing the pods %s", err)
+			}
+			for i := range pods.Items {
+				events.push(watch.Event{Type: watch.Added, Object: &pods.Items[i]})
+			}
+			resourceVersion = pods.ResourceVersion
+		}
+		watcher, err := client.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{
+			LabelSelector:   labelSelector,
+			FieldSelector:   fieldSelector,
+			TimeoutSeconds:  &timeout,
+			ResourceVersion: resourceVersion,
+			// The bookmarks show the watchdog that a quiet watch is still alive
+			AllowWatchBookmarks: true,
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logErr.Panicf("Error while create watch for pods %s", err)
+		}
+		dog.watchStarted(namespace, watcher)
+		stopWatch := context.AfterFunc(ctx, watcher.Stop)
+		for event := range watcher.ResultChan() {
+			dog.eventReceived(namespace)
+			if event.Type == watch.Error {
+				// Usually the resource version is too old, the pods are listed again with the next watch
+				logErr.Printf("The pod watch of namespace '%s' failed %v", namespace, k8sErrors.FromObject(event.Object))
+				resourceVersion = ""
+				watcher.Stop()
+				break
+			}
+			if pod, ok := event.Object.(*v1.Pod); ok {
+				resourceVersion = pod.ResourceVersion
+			}
+			if event.Type == watch.Bookmark {
+				continue
+			}
+			events.push(event)
+		}
+		if !stopWatch() {
+			// The watch was stopped because the context is done
+			return
+		}
+		log.Printf("Restart watch of namespace '%s'", namespace)
+	}
+}
+
+// Returns true if the namespace is one of the watched namespaces. An empty namespace watches all of them.
+func isWatchedNamespace(namespaces []string, namespace string) bool {
+	for _, watched := range namespaces {
+		if watched == "" || watched == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles the events of all namespaces in a single loop, so the state of the pods is not shared between goroutines
+func podManagerRoutine(ctx context.Context, client kubernetes.Interface, namespaces []string) {
+	cachedExternalIPs := make(map[string][]string)
+	handledPods := make(map[string]podState)
+	retries := newPodRetries()
+	incarnations := newPodIncarnations()
+	statuses := make(podReconcileStatuses)
+
+	handle := func(eventType watch.EventType, pod *v1.Pod) {
+		current, previous := incarnations.observe(eventType, pod)
+		if !current {
+			log.Printf("[%s] Ignoring event %s of a deleted incarnation of the pod.", pod.Name, eventType)
+			return
+		}
+		if previous != "" {
+			log.Printf("[%s] The pod was recreated, forgetting the state of incarnation %s.", pod.Name, previous)
+			delete(handledPods, pod.Namespace+"/"+pod.Name)
+			err := deletePreviousIncarnationServices(client, pod)
+			if err != nil {
+				logErr.Printf("[%s] Failed to delete the services of the previous incarnation %s", pod.Name, err)
+			}
+		}
+		err := handlePodEvent(client, eventType, pod, handledPods, cachedExternalIPs)
+		statuses.record(eventType, pod, err)
+		if err == nil {
+			retries.reset(pod)
+			return
+		}
+		var invalid annotations.InvalidValueError
+		if errors.As(err, &invalid) {
+			// The pod would never be handled, so the owner of the pod has to learn why
+			logErr.Printf("[%s] Invalid port request namespace=%q pod=%q key=%q value=%q error=%q expected=%q", pod.Name, pod.Namespace, pod.Name, invalid.Key, invalid.Value, invalid.Err, invalid.Syntax)
+			invalidPortRequestsTotal.WithLabelValues(pod.Namespace).Inc()
+			recorder.Eventf(pod, v1.EventTypeWarning, "InvalidPortRequest", "%s", err)
+			setPodCondition(client, pod, v1.ConditionFalse, "InvalidPortRequest", err.Error())
+			return
+		}
+		logErr.Printf("[%s] Failed to handle event %s", pod.Name, err)
+
+		// Retry later, node ports might be released in the meantime
+		if allocator.IsExhaustedError(err) {
+			handledPods[pod.Namespace+"/"+pod.Name] = podStateNew
+			nodePortExhaustedTotal.WithLabelValues(pod.Namespace).Inc()
+			delay := retries.schedule(pod, "nodeport_exhausted")
+			recorder.Eventf(pod, v1.EventTypeWarning, "NodePortExhausted", "No free node port left, retrying in %s", delay)
+			setPodCondition(client, pod, v1.ConditionFalse, "NodePortExhausted", err.Error())
+		} else if isPolicyHookError(err) {
+			handledPods[pod.Namespace+"/"+pod.Name] = podStateNew
+			delay := retries.schedule(pod, "policy_hook")
+			recorder.Eventf(pod, v1.EventTypeWarning, "PolicyHookFailed", "%s, retrying in %s", err, delay)
+			setPodCondition(client, pod, v1.ConditionFalse, "PolicyHookFailed", err.Error())
+		} else if errors.Is(err, errNamespaceQuotaExceeded) {
+			handledPods[pod.Namespace+"/"+pod.Name] = podStateNew
+			delay := retries.schedule(pod, "quota_exceeded")
+			recorder.Eventf(pod, v1.EventTypeWarning, "QuotaExceeded", "The namespace has reached its quota of %d dynamic hostports, retrying in %s", namespaceQuota(pod.Namespace), delay)
+			setPodCondition(client, pod, v1.ConditionFalse, "QuotaExceeded", err.Error())
+		}
+	}
+
+	debouncer := newPodDebouncer(config.EventDebounce)
+	dog := newWatchdog(ctx, config.WatchdogTimeout)
+	events := newPodEventQueue()
+	for _, namespace := range namespaces {
+		log.Printf("Watching pods of namespace '%s'", namespace)
+		go watchPods(ctx, client, namespace, events, dog)
+	}
+	handleEvent := func(event watch.Event) {
+		pod, ok := event.Object.(*v1.Pod)
+		if !ok {
+			logErr.Panic("Unexpected watch object")
+		}
+		if event.Type == watch.Deleted || debouncer.delay == 0 {
+			debouncer.drop(pod)
+			handle(event.Type, pod)
+			return
+		}
+		debouncer.add(event.Type, pod)
+	}
+	// The idle loop beats as well, only a loop that is stuck in an event stops beating
+	var heartbeats <-chan time.Time
+	if dog.timeout > 0 {
+		ticker := time.NewTicker(dog.timeout / 5)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+
+	for {
+		dog.beat()
+		// Deletions release node ports, so they go before everything that queued up in the meantime
+		if event, ok := events.popDeletion(); ok {
+			handleEvent(event)
+			continue
+		}
+		select {
+		case <-heartbeats:
+		case <-events.ready:
+			if event, ok := events.pop(); ok {
+				handleEvent(event)
+			}
+		case event := <-debouncer.channel:
+			handle(event.eventType, event.pod)
+		case key := <-leaseExpiries:
+			pod, err := client.CoreV1().Pods(key.Namespace).Get(context.Background(), key.Name, metav1.GetOptions{})
+			if err != nil {
+				if !k8sErrors.IsNotFound(err) {
+					logErr.Printf("[%s] Failed to get pod for the lease check %s", key.Name, err)
+				}
+				continue
+			}
+			handle(watch.Modified, pod)
+		case key := <-retries.channel:
+			pod, err := client.CoreV1().Pods(key.Namespace).Get(context.Background(), key.Name, metav1.GetOptions{})
+			if err != nil {
+				logErr.Printf("[%s] Failed to get pod for retry %s", key.Name, err)
+				continue
+			}
+			handle(watch.Modified, pod)
+		case reply := <-debugStateRequests:
+			reply <- newDebugState(handledPods, cachedExternalIPs, events, debouncer, retries, statuses)
+		case <-ctx.Done():
+			log.Print("Stopped the pod loop")
+			return
+		case <-configReloads:
+			err := reloadConfig()
+			if err != nil {
+				logErr.Printf("Failed to reload config, keeping the previous one %s", err)
+				continue
+			}
+			log.Print("Reloaded config")
+			// The address preferences might have changed
+			for cacheKey := range cachedExternalIPs {
+				delete(cachedExternalIPs, cacheKey)
+			}
+			if nodePortAllocator != nil {
+				for _, namespace := range namespaces {
+					err := nodePortAllocator.SyncUsage(client, serviceNamespace(namespace))
+					if err != nil {
+						logErr.Printf("Failed to sync node port usage %s", err)
+					}
+				}
+			}
+		case nodeName := <-nodeAddressChanges:
+			refreshNodePods(client, namespaces, nodeName, cachedExternalIPs)
+		case enrolledNamespace := <-enrolledNamespaces:
+			if !isWatchedNamespace(namespaces, enrolledNamespace) || isNamespaceExcluded(enrolledNamespace) {
+				continue
+			}
+			pods, err := client.CoreV1().Pods(enrolledNamespace).List(context.Background(), metav1.ListOptions{
+				LabelSelector: podLabelSelector(),
+			})
+			if err != nil {
+				logErr.Printf("Failed to list pods of enrolled namespace '%s' %s", enrolledNamespace, err)
+				continue
+			}
+			for i := range pods.Items {
+				handle(watch.Modified, &pods.Items[i])
+			}
+		}
+	}
+}
+
+// Returns true if the pod matches the label selector of the managed pods
+func isManagedPod(pod *v1.Pod) bool {
+	selector, err := labels.Parse(podLabelSelector())
+	return err == nil && selector.Matches(labels.Set(pod.Labels))
+}
+
+// The watch reports a pod as deleted once its label is removed, but the pod still exists with the annotations of its
+// deleted services. They are removed, so the pod doesn't advertise node ports that are gone.
+func removeUnmanagedPodAnnotations(client kubernetes.Interface, pod *v1.Pod) error {
+	if pod.DeletionTimestamp != nil || isManagedPod(pod) {
+		return nil
+	}
+	keys := outputAnnotationKeys(pod)
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	log.Printf("[%s] The pod is no longer managed, removing annotations %s", pod.Name, strings.Join(keys, ","))
+	err := removePodAnnotations(client, pod, keys)
+	if k8sErrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// The reasons why a service is stale, which are the reason label of the metric and the message of the event
+var staleReasons = map[string]string{
+	"pod_not_found": "the pod does not exist",
+	"pod_recreated": "the pod was recreated with another uid",
+	"pod_unlabeled": "the pod no longer has the label",
+}
+
+// Pods that don't match the pod selector are listed as well, their services might be managed by another instance
+func deleteStaleServices(client kubernetes.Interface, namespace string) error {
+	pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: labelKey,
+		FieldSelector: excludedNamespacesFieldSelector(),
+	})
+	if err != nil {
+		return err
+	}
+
+	services, err := client.CoreV1().Services(serviceNamespace(namespace)).List(context.Background(), metav1.ListOptions{
+		LabelSelector: managedServicesSelector(namespace),
+		FieldSelector: excludedNamespacesFieldSelector(),
+	})
+	if err != nil {
+		return err
+	}
+
+	unlabeledPods := make(map[types.NamespacedName]*v1.Pod)
+	for _, service := range services.Items {
+		podName := service.Labels[forPodLabelKey]
+		podNamespace := servicePodNamespace(&service)
+		reason := "pod_not_found"
+		foundPod := false
+		for i := range pods.Items {
+			if isServiceOfPod(&service, &pods.Items[i]) {
+				foundPod = true
+				break
+			}
+			if pods.Items[i].Name == podName && pods.Items[i].Namespace == podNamespace {
+				reason = "pod_recreated"
+			}
+		}
+		if !foundPod {
+			if isNamespaceExcluded(podNamespace) {
+				continue
+			}
+			if isNamespacePaused(podNamespace) {
+				log.Printf("Keeping stale service '%s' because its namespace is paused", service.Name)
+				continue
+			}
+			var unlabeled *v1.Pod
+			if reason == "pod_not_found" && podName != "" {
+				// The label might have been removed while the controller was not running
+				pod, err := client.CoreV1().Pods(podNamespace).Get(context.Background(), podName, metav1.GetOptions{})
+				if err == nil && isServiceOfPod(&service, pod) {
+					reason = "pod_unlabeled"
+					unlabeled = pod
+				} else if err == nil {
+					reason = "pod_recreated"
+				}
+			}
+
+			log.Printf("Delete stale service '%s' (%s)", service.Name, reason)
+			localErr := deleteService(client, service.Namespace, service.Name)
+			if localErr != nil {
+				logErr.Printf("Failed to delete service %s", localErr)
+				continue
+			}
+			staleServicesDeletedTotal.WithLabelValues(podNamespace, reason).Inc()
+			recorder.Eventf(&service, v1.EventTypeNormal, "StaleServiceDeleted", "Deleted the service of pod %s, %s", podName, staleReasons[reason])
+			if unlabeled != nil {
+				unlabeledPods[types.NamespacedName{Namespace: unlabeled.Namespace, Name: unlabeled.Name}] = unlabeled
+			}
+		}
+	}
+
+	for _, pod := range unlabeledPods {
+		err := removeUnmanagedPodAnnotations(client, pod)
+		if err != nil {
+			logErr.Printf("[%s] Failed to remove the annotations of the unmanaged pod %s", pod.Name, err)
+		}
+	}
+	return nil
+}
+
+// Returns true if the service belongs to this incarnation of the pod. A recreated pod has the same name but a new
+// uid, services without the uid label were created by older versions and only match by name.
+func isServiceOfPod(service *v1.Service, pod *v1.Pod) bool {
+	if service.Labels[forPodLabelKey] != pod.Name || servicePodNamespace(service) != pod.Namespace {
+		return false
+	}
+	uid, ok := service.Labels[podUidLabelKey]
+	return !ok || uid == string(pod.UID)
+}
+
+func serviceManagerRoutine(client kubernetes.Interface, namespace string) {
+	err := deleteStaleServices(client, namespace)
+	if err != nil {
+		logErr.Panicf("Error while deleting stale services %s", err)
+	}
+
+	if nodePortAllocator != nil {
+		err = nodePortAllocator.SyncUsage(client, serviceNamespace(namespace))
+		if err != nil {
+			logErr.Panicf("Error while syncing node port usage %s", err)
+		}
+	}
+
+	err = syncGlobalNodePorts(client, serviceNamespace(namespace))
+	if err != nil {
+		logErr.Panicf("Error while syncing the node ports with the coordination ConfigMap %s", err)
+	}
+}
+
+// ----------------- Start stuff -----------------
+
+func homeDir() string {
+	if h := os.Getenv("HOME"); h != "" {
+		return h
+	}
+	return os.Getenv("USERPROFILE") // Windows
+}
+
+func defaultKubeconfig() string {
+	if home := homeDir(); home != "" {
+		return filepath.Join(home, ".kube", "config")
+	}
+	return ""
+}
+
+// Uses the in cluster config unless a kubeconfig or context is explicitly requested
+func getBestConfig() (*rest.Config, error) {
+	var restConfig *rest.Config
+	var err error
+
+	if !explicitFlags["kubeconfig"] && config.Context == "" {
+		restConfig, err = rest.InClusterConfig()
+		if err != nil && err != rest.ErrNotInCluster {
+			return nil, err
+		}
+	}
+
+	if restConfig == nil {
+		// We have to fall back to the local kube config if we are not in a cluster
+		restConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: config.Kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: config.Context},
+		).ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instrumentConfig(restConfig)
+	restConfig.Impersonate = rest.ImpersonationConfig{
+		UserName: config.As,
+		UID:      config.AsUid,
+	}
+	if config.AsGroups != "" {
+		restConfig.Impersonate.Groups = strings.Split(config.AsGroups, ",")
+	}
+	return restConfig, nil
+}
+
+// Returns the recorder of the events, which are sent until the context is done
+func createEventRecorder(ctx context.Context, client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	context.AfterFunc(ctx, broadcaster.Shutdown)
+	broadcaster.StartRecordingToSink(&typedCoreV1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: managedByLabelValue})
+}
+
+func createClientset() (*kubernetes.Clientset, error) {
+	restConfig, err := getBestConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// Returns the namespaces of the flags, an empty namespace stands for all namespaces
+func watchedNamespaces() []string {
+	if config.Namespaces == "" {
+		namespace := config.Namespace
+		if namespace == "" {
+			namespace = os.Getenv("KUBERNETES_NAMESPACE")
+		}
+		return []string{namespace}
+	}
+
+	var namespaces []string
+	for namespace := range parseNamespaceList(config.Namespaces) {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// Applies the config file and validates the config
+func setup() error {
+	if config.ConfigFile != "" {
+		err := loadConfigFile(config.ConfigFile)
+		if err != nil {
+			return errors.New("Invalid config file " + err.Error())
+		}
+	}
+
+	if errs := validation.IsQualifiedName(config.LabelKey); len(errs) > 0 {
+		return errors.New("Invalid label key '" + config.LabelKey + "' " + strings.Join(errs, ", "))
+	}
+	if errs := validation.IsDNS1123Subdomain(config.AnnotationPrefix); len(errs) > 0 {
+		return errors.New("Invalid annotation prefix '" + config.AnnotationPrefix + "' " + strings.Join(errs, ", "))
+	}
+	setNames(config.LabelKey, config.AnnotationPrefix)
+
+	if _, err := labels.Parse(podLabelSelector()); err != nil {
+		return errors.New("Invalid pod selector " + err.Error())
+	}
+
+	err := parseConfig()
+	if err != nil {
+		return errors.New("Invalid config " + err.Error())
+	}
+	return nil
+}
+
+// Runs the controller until it is killed
+func run() {
+	if config.ClusterSecretSelector != "" {
+		runMultiCluster()
+		return
+	}
+	client, err := createClientset()
+	if err != nil {
+		panic(err.Error())
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	if config.CleanupOnShutdown {
+		go watchShutdown(stop)
+	}
+	err = runWithClient(ctx, client)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Controller runs the controller within another program, with its own client and config instead of the command
+// line. The state of the controller is kept in the package, so only one of them can run at a time.
+type Controller struct {
+	client kubernetes.Interface
+	config Config
+}
+
+// Set while a controller runs
+var controllerRunning atomic.Bool
+
+// New returns a controller that manages the pods with the client. The config is validated once it runs. The
+// multi-cluster mode starts the command of the binary for every cluster, so it is only available with Main.
+func New(client kubernetes.Interface, config Config) (*Controller, error) {
+	if config.ClusterSecretSelector != "" {
+		return nil, errors.New("The multi-cluster mode can't be embedded")
+	}
+	config.ServiceLabelTemplates = maps.Clone(config.ServiceLabelTemplates)
+	config.ServiceAnnotationTemplates = maps.Clone(config.ServiceAnnotationTemplates)
+	return &Controller{client: client, config: config}, nil
+}
+
+// Run runs the controller until the context is done and cleans up with CleanupOnShutdown. The ConfigFile is applied
+// to the fields that are left at their defaults and reloaded like with the command, the environment variables are
+// not read. Run returns an error if the config is invalid or another controller is running, it can be called again
+// once it returned.
+func (controller *Controller) Run(ctx context.Context) error {
+	if !controllerRunning.CompareAndSwap(false, true) {
+		return errors.New("Another controller is already running in this process")
+	}
+	defer controllerRunning.Store(false)
+
+	configMutex.Lock()
+	resetConfig()
+	config = controller.config
+	config.ServiceLabelTemplates = maps.Clone(controller.config.ServiceLabelTemplates)
+	config.ServiceAnnotationTemplates = maps.Clone(controller.config.ServiceAnnotationTemplates)
+	// The fields that differ from the defaults take precedence over the config file, like the flags of the command
+	configFlags.VisitAll(func(f *flag.Flag) {
+		if repeatable, ok := f.Value.(repeatableValue); ok {
+			explicitFlags[f.Name] = len(repeatable.values()) > 0
+		} else {
+			explicitFlags[f.Name] = f.Value.String() != f.DefValue
+		}
+	})
+	err := setup()
+	configMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return runWithClient(ctx, controller.client)
+}
+
+// Runs the controller until the context is done. The error is the one of the cleanup on shutdown.
+func runWithClient(ctx context.Context, client kubernetes.Interface) error {
+	log.Print("Starting...")
+
+	if config.ConfigFile != "" {
+		go watchConfig(ctx, config.ConfigFile, configReloads)
+	}
+
+	var err error
+	if config.MetricsAddress != "" {
+		go serveMetrics(ctx, config.MetricsAddress, client)
+	}
+	if config.WhoamiAddress != "" {
+		go serveWhoami(ctx, config.WhoamiAddress, client, watchedNamespaces())
+	}
+	recorder = createEventRecorder(ctx, client)
+	coordinationClient, err = createCoordinationClient(client)
+	if err != nil {
+		panic(err.Error())
+	}
+	if !config.NamespacedRbac {
+		startNamespaceInformer(client, ctx.Done())
+		// The ips of the nodes are taken from the ConfigMap in the namespaced rbac mode
+		startNodeInformer(client, ctx.Done())
+	}
+
+	namespaces := watchedNamespaces()
+	for _, namespace := range namespaces {
+		serviceManagerRoutine(client, namespace)
+	}
+	if config.MetricsAddress != "" {
+		go reportCapacity(ctx, client, namespaces)
+	}
+	if config.LastReconciledInterval > 0 {
+		go reportLastReconciled(ctx, client, namespaces)
+	}
+	podManagerRoutine(ctx, client, namespaces)
+	// The pod loop only returns once the context is done
+	if config.CleanupOnShutdown {
+		return cleanupOnShutdown(client, namespaces)
+	}
+	return nil
+}
+
+// Command returns the command line of the controller with all subcommands, starting it without one runs the
+// controller. Its flags set the fields of the Config, starting from the defaults.
+func Command() *cobra.Command {
+	return rootCommand()
+}
+
+// Main runs the command line with the arguments of the process and exits if it fails
+func Main() {
+	if err := rootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,2719 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	authenticationV1 "k8s.io/api/authentication/v1"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacV1 "k8s.io/api/rbac/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8sTesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/yaml"
+)
+
+const testNamespace = "default"
+const testNodeName = "node-1"
+
+// Returns a fake clientset with a namespace and a node. Like the api server it assigns node ports to new services.
+func newTestClient(t testing.TB, objects ...runtime.Object) *fake.Clientset {
+	t.Helper()
+	err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects = append(objects,
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace}},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: testNodeName},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "203.0.113.10"},
+				{Type: v1.NodeInternalIP, Address: "10.0.0.10"},
+			}},
+		},
+	)
+	client := fake.NewSimpleClientset(objects...)
+
+	nextNodePort := int32(30000)
+	assignNodePorts := func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		// Create and update actions both implement GetObject
+		service := action.(k8sTesting.CreateAction).GetObject().(*v1.Service)
+		for i := range service.Spec.Ports {
+			if service.Spec.Ports[i].NodePort == 0 {
+				service.Spec.Ports[i].NodePort = nextNodePort
+				nextNodePort++
+			}
+		}
+		return false, nil, nil
+	}
+	client.PrependReactor("create", "services", assignNodePorts)
+	client.PrependReactor("update", "services", assignNodePorts)
+
+	stopChannel := make(chan struct{})
+	t.Cleanup(func() { close(stopChannel) })
+	startNamespaceInformer(client, stopChannel)
+	return client
+}
+
+func newTestPod(name string, labelValue string, annotations map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   testNamespace,
+			Labels:      map[string]string{labelKey: labelValue},
+			Annotations: annotations,
+		},
+		Spec: v1.PodSpec{
+			NodeName: testNodeName,
+			Containers: []v1.Container{
+				{Name: "app", Ports: []v1.ContainerPort{{ContainerPort: 8080}, {ContainerPort: 27015, Protocol: v1.ProtocolUDP}}},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			PodIP:      "10.1.0.5",
+			HostIP:     "10.0.0.10",
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func managedService(name string, forPod string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{managedByLabelKey: managedByLabelValue, forPodLabelKey: forPod},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: []v1.ServicePort{{Port: 8080, NodePort: 31000}}},
+	}
+}
+
+func serviceNames(t *testing.T, client *fake.Clientset) map[string]bool {
+	t.Helper()
+	services, err := client.CoreV1().Services(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, service := range services.Items {
+		found[service.Name] = true
+	}
+	return found
+}
+
+func TestCreateService(t *testing.T) {
+	pod := newTestPod("game-0", "27015", nil)
+	client := newTestClient(t, pod)
+	requestedPort := PortRequest{Port: 27015, Protocol: v1.ProtocolUDP}
+
+	err := createService(client, pod, requestedPort, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-27015-udp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != v1.ServiceTypeNodePort || service.Spec.Ports[0].Protocol != v1.ProtocolUDP {
+		t.Errorf("Unexpected service spec %+v", service.Spec)
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.10" {
+		t.Errorf("Expected the external ip of the node, got %v", service.Spec.ExternalIPs)
+	}
+	if service.Labels[forPodLabelKey] != "game-0" {
+		t.Errorf("Expected the for-pod label, got %v", service.Labels)
+	}
+
+	patched, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		podPortToAnnotation(requestedPort):         "30000",
+		podPortToEndpointAnnotation(requestedPort): "203.0.113.10:30000",
+		externalIpAnnotation:                       "203.0.113.10",
+	}
+	for key, value := range expected {
+		if patched.Annotations[key] != value {
+			t.Errorf("Expected annotation %s=%s, got '%s'", key, value, patched.Annotations[key])
+		}
+	}
+}
+
+func TestCreateServiceFallsBackToHostIp(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	pod.Spec.NodeName = "unknown-node"
+	client := newTestClient(t, pod)
+
+	err := createService(client, pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != pod.Status.HostIP {
+		t.Errorf("Expected the host ip, got %v", service.Spec.ExternalIPs)
+	}
+}
+
+func TestCreateServiceFallsBackToInternalIp(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	pod.Spec.NodeName = "kind-control-plane"
+	kindNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "kind-control-plane"},
+		Spec:       v1.NodeSpec{ProviderID: "kind://docker/kind/kind-control-plane"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "172.18.0.2"}}},
+	}
+	client := newTestClient(t, pod, kindNode)
+
+	requestedPort := PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}
+	err := createService(client, pod, requestedPort, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := patched.Annotations[podPortToEndpointAnnotation(requestedPort)]; endpoint != "172.18.0.2:30000" {
+		t.Errorf("Expected the endpoint on the internal ip, got '%s'", endpoint)
+	}
+}
+
+func TestCreateServiceWithAddressTypePriority(t *testing.T) {
+	pod := newTestPod("game-0", "8080", map[string]string{nodeAddressPreferenceAnnotation: "ExternalIP,ExternalDNS,InternalIP"})
+	pod.Spec.NodeName = "dns-node"
+	dnsNode := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "dns-node"},
+		Status: v1.NodeStatus{Addresses: []v1.NodeAddress{
+			{Type: v1.NodeInternalIP, Address: "10.0.0.20"},
+			{Type: v1.NodeExternalDNS, Address: "node.example.com"},
+		}},
+	}
+	client := newTestClient(t, pod, dnsNode)
+
+	requestedPort := PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}
+	err := createService(client, pod, requestedPort, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A DNS name can't be an external ip of the service
+	if len(service.Spec.ExternalIPs) != 0 {
+		t.Errorf("Expected no external ips, got %v", service.Spec.ExternalIPs)
+	}
+	patched, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := patched.Annotations[podPortToEndpointAnnotation(requestedPort)]; endpoint != "node.example.com:30000" {
+		t.Errorf("Expected the endpoint on the ExternalDNS name, got '%s'", endpoint)
+	}
+}
+
+func TestHandlePodEvent(t *testing.T) {
+	notRunning := newTestPod("game-0", "8080", nil)
+	notRunning.Status.Phase = v1.PodPending
+	noIp := newTestPod("game-0", "8080", nil)
+	noIp.Status.PodIP = ""
+
+	tests := []struct {
+		name             string
+		eventType        watch.EventType
+		pod              *v1.Pod
+		existing         []runtime.Object
+		expectedServices []string
+		expectErr        bool
+	}{
+		{
+			name:             "label value",
+			eventType:        watch.Added,
+			pod:              newTestPod("game-0", "8080.9000-9001", nil),
+			expectedServices: []string{"game-0-8080", "game-0-9000", "game-0-9001"},
+		},
+		{
+			name:             "auto label value",
+			eventType:        watch.Added,
+			pod:              newTestPod("game-0", "auto", nil),
+			expectedServices: []string{"game-0-8080", "game-0-27015-udp"},
+		},
+		{
+			name:             "ports annotation",
+			eventType:        watch.Modified,
+			pod:              newTestPod("game-0", "true", map[string]string{portsAnnotation: "27015/udp, app/8080"}),
+			expectedServices: []string{"game-0-8080", "game-0-27015-udp"},
+		},
+		{
+			name:      "not running",
+			eventType: watch.Added,
+			pod:       notRunning,
+		},
+		{
+			name:      "no ip",
+			eventType: watch.Added,
+			pod:       noIp,
+		},
+		{
+			name:      "paused",
+			eventType: watch.Added,
+			pod:       newTestPod("game-0", "8080", map[string]string{pausedAnnotation: "true"}),
+		},
+		{
+			name:      "already annotated",
+			eventType: watch.Added,
+			pod:       newTestPod("game-0", "8080", map[string]string{annotationPrefix + "/8080": "30123"}),
+		},
+		{
+			name:             "deleted",
+			eventType:        watch.Deleted,
+			pod:              newTestPod("game-0", "8080", nil),
+			existing:         []runtime.Object{managedService("game-0-8080", "game-0"), managedService("game-1-8080", "game-1")},
+			expectedServices: []string{"game-1-8080"},
+		},
+		{
+			name:      "invalid label value",
+			eventType: watch.Added,
+			pod:       newTestPod("game-0", "http", nil),
+			expectErr: true,
+		},
+		{
+			name:      "undeclared container port",
+			eventType: watch.Added,
+			pod:       newTestPod("game-0", "true", map[string]string{portsAnnotation: "app/9999"}),
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newTestClient(t, append(test.existing, test.pod)...)
+			handledPods := make(map[string]podState)
+
+			err := handlePodEvent(client, test.eventType, test.pod, handledPods, make(map[string][]string))
+			if (err != nil) != test.expectErr {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			found := serviceNames(t, client)
+			if len(found) != len(test.expectedServices) {
+				t.Errorf("Expected services %v, got %v", test.expectedServices, found)
+			}
+			for _, name := range test.expectedServices {
+				if !found[name] {
+					t.Errorf("Expected service %s, got %v", name, found)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePodEventOnlyOnce(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	handledPods := make(map[string]podState)
+
+	for i := 0; i < 2; i++ {
+		err := handlePodEvent(client, watch.Modified, pod, handledPods, make(map[string][]string))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creates := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "create" && action.GetResource().Resource == "services" {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Errorf("Expected a single service creation, got %d", creates)
+	}
+	if handledPods[testNamespace+"/game-0"] != podStateHandled {
+		t.Errorf("Expected the pod to be handled")
+	}
+}
+
+func TestDeleteStaleServices(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	unmanaged := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: testNamespace}}
+	client := newTestClient(t, pod, unmanaged, managedService("game-0-8080", "game-0"), managedService("game-1-8080", "game-1"))
+	events := record.NewFakeRecorder(10)
+	recorder = events
+	t.Cleanup(func() { recorder = &record.FakeRecorder{} })
+	counter := staleServicesDeletedTotal.WithLabelValues(testNamespace, "pod_not_found")
+	before := testutil.ToFloat64(counter)
+
+	err := deleteStaleServices(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := serviceNames(t, client)
+	if !found["game-0-8080"] || !found["other"] || found["game-1-8080"] {
+		t.Errorf("Expected only the service of the deleted pod to be removed, got %v", found)
+	}
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Errorf("Expected the deletion to be counted, got %f => %f", before, after)
+	}
+	if len(events.Events) != 1 || <-events.Events != "Normal StaleServiceDeleted Deleted the service of pod game-1, the pod does not exist" {
+		t.Errorf("Expected an event for the deleted service")
+	}
+}
+
+func TestRemovedLabel(t *testing.T) {
+	pod := newTestPod("game-0", "8080", map[string]string{"team": "gameops"})
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch reports the pod as deleted once it no longer matches the label selector
+	unlabeled, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(unlabeled.Labels, labelKey)
+	unlabeled, err = client.CoreV1().Pods(testNamespace).Update(context.Background(), unlabeled, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePodEvent(client, watch.Deleted, unlabeled, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found := serviceNames(t, client); found["game-0-8080"] {
+		t.Errorf("Expected the service to be deleted, got %v", found)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := outputAnnotationKeys(updated); len(keys) != 0 || updated.Annotations["team"] != "gameops" {
+		t.Errorf("Expected only the annotations of the controller to be removed, got %v", updated.Annotations)
+	}
+}
+
+func TestDeleteStaleServicesOfUnlabeledPod(t *testing.T) {
+	pod := newTestPod("game-0", "8080", map[string]string{names.Prefix + "/8080": "31000", externalIpAnnotation: "203.0.113.10"})
+	delete(pod.Labels, labelKey)
+	client := newTestClient(t, pod, managedService("game-0-8080", "game-0"))
+
+	err := deleteStaleServices(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceNames(t, client)["game-0-8080"] || len(updated.Annotations) != 0 {
+		t.Errorf("Expected the service and the annotations to be removed, got %v", updated.Annotations)
+	}
+}
+
+func TestDeleteStaleServicesOfRecreatedPod(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	pod.UID = "uid-2"
+	old := managedService("game-0-8080", "game-0")
+	old.Labels[podUidLabelKey] = "uid-1"
+	current := managedService("game-0-27015", "game-0")
+	current.Labels[podUidLabelKey] = "uid-2"
+	client := newTestClient(t, pod, old, current)
+
+	err := deleteStaleServices(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := serviceNames(t, client)
+	if found["game-0-8080"] || !found["game-0-27015"] {
+		t.Errorf("Expected only the service of the previous incarnation to be removed, got %v", found)
+	}
+}
+
+func TestPodIncarnations(t *testing.T) {
+	incarnations := newPodIncarnations()
+	pod := newTestPod("game-0", "8080", nil)
+	pod.UID = "uid-1"
+	recreated := newTestPod("game-0", "8080", nil)
+	recreated.UID = "uid-2"
+
+	if current, _ := incarnations.observe(watch.Added, pod); !current {
+		t.Error("Expected the first incarnation to be current")
+	}
+	if current, _ := incarnations.observe(watch.Deleted, pod); !current {
+		t.Error("Expected the deletion to be handled")
+	}
+	if current, _ := incarnations.observe(watch.Modified, pod); current {
+		t.Error("Expected a late event of the deleted incarnation to be dropped")
+	}
+	if current, previous := incarnations.observe(watch.Added, recreated); !current || previous != "" {
+		t.Errorf("Expected the new incarnation to be current, got %v %q", current, previous)
+	}
+
+	replaced := newTestPod("game-0", "8080", nil)
+	replaced.UID = "uid-3"
+	if _, previous := incarnations.observe(watch.Modified, replaced); previous != "uid-2" {
+		t.Errorf("Expected the unobserved deletion of uid-2 to be detected, got %q", previous)
+	}
+}
+
+func TestDeleteServicesOfIncarnation(t *testing.T) {
+	old := newTestPod("game-0", "8080", nil)
+	old.UID = "uid-1"
+	pod := newTestPod("game-0", "8080", nil)
+	pod.UID = "uid-2"
+	oldService := managedService("game-0-8080", "game-0")
+	oldService.Labels[podUidLabelKey] = "uid-1"
+	service := managedService("game-0-27015", "game-0")
+	service.Labels[podUidLabelKey] = "uid-2"
+	client := newTestClient(t, pod, oldService, service)
+
+	err := deletePodServices(client, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); found["game-0-8080"] || !found["game-0-27015"] {
+		t.Errorf("Expected the deletion of the previous incarnation to keep the new services, got %v", found)
+	}
+
+	client = newTestClient(t, pod, oldService, service)
+	err = deletePreviousIncarnationServices(client, pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); found["game-0-8080"] || !found["game-0-27015"] {
+		t.Errorf("Expected only the services of the previous incarnation to be deleted, got %v", found)
+	}
+}
+
+func TestHostPortWebhookMutate(t *testing.T) {
+	client := newTestClient(t)
+	pool, err := allocator.NewPool("40000-40002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := &hostPortWebhook{client: client, pool: pool, pending: make(map[string]time.Time)}
+
+	pod := newTestPod("game-0", "8080.9000", nil)
+	patch, warnings, err := webhook.mutate(pod, "default/game-0@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("Expected a warning about the undeclared port 9000, got %v", warnings)
+	}
+	containers := patch[0].Value.([]v1.Container)
+	annotations := patch[1].Value.(map[string]string)
+	if containers[0].Ports[0].HostPort != 40000 || annotations[podPortToAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})] != "40000" {
+		t.Errorf("Expected host port 40000 for the declared port, got %+v %v", containers[0].Ports, annotations)
+	}
+	// Undeclared ports are added to the container
+	if len(containers[0].Ports) != 3 || containers[0].Ports[2].ContainerPort != 9000 || containers[0].Ports[2].HostPort != 40001 {
+		t.Errorf("Expected host port 40001 for the undeclared port, got %+v", containers[0].Ports)
+	}
+
+	_, _, err = webhook.mutate(newTestPod("game-1", "8080.9000", nil), "default/game-1@2")
+	if !allocator.IsExhaustedError(err) {
+		t.Errorf("Expected the pool to be exhausted, got %v", err)
+	}
+	// The partial allocation of the rejected pod is released again
+	_, _, err = webhook.mutate(newTestPod("game-2", "8080", nil), "default/game-2@3")
+	if err != nil {
+		t.Errorf("Expected a free host port, got %v", err)
+	}
+}
+
+func TestWithoutExternalIps(t *testing.T) {
+	config.SetExternalIps = false
+	t.Cleanup(func() { config.SetExternalIps = true })
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	cachedExternalIPs := make(map[string][]string)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), cachedExternalIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != v1.ServiceTypeNodePort || len(service.Spec.ExternalIPs) != 0 || service.Annotations[externalIpAnnotation] != "203.0.113.10" {
+		t.Errorf("Expected a node port service without external ips, got %+v %v", service.Spec, service.Annotations)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := updated.Annotations[podPortToEndpointAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})]
+	if updated.Annotations[externalIpAnnotation] != "203.0.113.10" || endpoint != "203.0.113.10:30000" {
+		t.Errorf("Expected the annotations to advertise the node address, got %v", updated.Annotations)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), testNodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Status.Addresses[0].Address = "203.0.113.20"
+	_, err = client.CoreV1().Nodes().UpdateStatus(context.Background(), node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshNodePods(client, []string{testNamespace}, testNodeName, cachedExternalIPs)
+
+	service, err = client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.ExternalIPs) != 0 || service.Annotations[externalIpAnnotation] != "203.0.113.20" {
+		t.Errorf("Expected the new address in the annotation of the service, got %v %v", service.Spec.ExternalIPs, service.Annotations)
+	}
+}
+
+func TestVirtualIps(t *testing.T) {
+	vipService := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "vip", Namespace: "kube-system"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		Status:     v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "198.51.100.1"}}}},
+	}
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod, vipService)
+	config.VirtualIpsService = "kube-system/vip"
+	t.Cleanup(func() { config.VirtualIpsService = "" })
+	err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "198.51.100.1" {
+		t.Errorf("Expected the virtual ip on the service, got %v", service.Spec.ExternalIPs)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := updated.Annotations[podPortToEndpointAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})]
+	if updated.Annotations[externalIpAnnotation] != "198.51.100.1" || endpoint != "198.51.100.1:30000" {
+		t.Errorf("Expected the annotations to advertise the virtual ip, got %v", updated.Annotations)
+	}
+
+	config.VirtualIps = "198.51.100.2"
+	t.Cleanup(func() { config.VirtualIps = "" })
+	if parseConfig() == nil {
+		t.Error("Expected an error with more than one source of virtual ips")
+	}
+	config.VirtualIpsService = ""
+	config.VirtualIps = "198.51.100.2,not-an-ip"
+	if parseConfig() == nil {
+		t.Error("Expected an error with an invalid virtual ip")
+	}
+}
+
+func TestServiceNamespace(t *testing.T) {
+	config.ServiceNamespace = "dynamic-hostports-system"
+	t.Cleanup(func() { config.ServiceNamespace = "" })
+	pod := newTestPod("game-0", "8080", nil)
+	otherPod := newTestPod("game-0", "8080", nil)
+	otherPod.Namespace = "other"
+	client := newTestClient(t, pod, otherPod)
+
+	for _, p := range []*v1.Pod{pod, otherPod} {
+		err := handlePodEvent(client, watch.Added, p, make(map[string]podState), make(map[string][]string))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	services, err := client.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	for _, service := range services.Items {
+		found[service.Namespace+"/"+service.Name] = service.Labels[forPodNamespaceLabelKey]
+	}
+	if len(found) != 2 || found["dynamic-hostports-system/default-game-0-8080"] != testNamespace || found["dynamic-hostports-system/other-game-0-8080"] != "other" {
+		t.Errorf("Expected the services of both pods in the service namespace, got %v", found)
+	}
+	endpoints, err := client.CoreV1().Endpoints("dynamic-hostports-system").Get(context.Background(), "other-game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target := endpoints.Subsets[0].Addresses[0].TargetRef; target.Namespace != "other" || target.Name != "game-0" {
+		t.Errorf("Expected the endpoints to reference the pod in its namespace, got %+v", target)
+	}
+
+	// The service of the pod in the other namespace is not stale
+	err = deleteStaleServices(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePodEvent(client, watch.Deleted, otherPod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err = client.CoreV1().Services("dynamic-hostports-system").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 1 || services.Items[0].Name != "default-game-0-8080" {
+		t.Errorf("Expected only the service of the deleted pod to be removed, got %v", services.Items)
+	}
+}
+
+func TestServiceNamespaceReleasesPoolNodePorts(t *testing.T) {
+	config.ServiceNamespace = "dynamic-hostports-system"
+	config.NodePortPools = "31000-31009"
+	t.Cleanup(func() {
+		config.ServiceNamespace = ""
+		config.NodePortPools = ""
+		parseConfig()
+	})
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	// The node port of a service that could not be created is released again
+	failed := false
+	client.PrependReactor("create", "services", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if !failed {
+			failed = true
+			return true, nil, errors.New("Service creation failed")
+		}
+		return false, nil, nil
+	})
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err == nil {
+		t.Fatal("Expected the failed service")
+	}
+	err = handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := nodePortAllocator.Used(); used != 1 {
+		t.Fatalf("Expected one reserved node port, got %d", used)
+	}
+	err = handlePodEvent(client, watch.Deleted, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := nodePortAllocator.Used(); used != 0 {
+		t.Errorf("Expected the node ports to be released with the services, %d are still reserved", used)
+	}
+}
+
+func TestHostNetworkPod(t *testing.T) {
+	newHostNetworkPod := func() *v1.Pod {
+		pod := newTestPod("game-0", "8080", nil)
+		pod.Spec.HostNetwork = true
+		pod.Status.PodIP = pod.Status.HostIP
+		return pod
+	}
+	t.Cleanup(func() { config.HostNetworkPods = hostNetworkPodsAnnotate })
+
+	pod := newHostNetworkPod()
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); len(found) != 0 {
+		t.Errorf("Expected no services, got %v", found)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestedPort := PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}
+	if updated.Annotations[podPortToAnnotation(requestedPort)] != "8080" || updated.Annotations[podPortToEndpointAnnotation(requestedPort)] != "203.0.113.10:8080" {
+		t.Errorf("Expected the port to be advertised on the node, got %v", updated.Annotations)
+	}
+
+	config.HostNetworkPods = hostNetworkPodsSkip
+	pod = newHostNetworkPod()
+	client = newTestClient(t, pod)
+	events := record.NewFakeRecorder(10)
+	recorder = events
+	t.Cleanup(func() { recorder = &record.FakeRecorder{} })
+	err = handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); len(found) != 0 || len(updated.Annotations) != 0 {
+		t.Errorf("Expected the pod to be skipped, got %v %v", found, updated.Annotations)
+	}
+	if len(events.Events) != 1 || !strings.HasPrefix(<-events.Events, "Normal HostNetwork") {
+		t.Errorf("Expected an event that explains the skipped pod")
+	}
+
+	config.HostNetworkPods = hostNetworkPodsService
+	pod = newHostNetworkPod()
+	client = newTestClient(t, pod)
+	err = handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); !found["game-0-8080"] {
+		t.Errorf("Expected a node port service, got %v", found)
+	}
+
+	config.HostNetworkPods = "invalid"
+	if parseConfig() == nil {
+		t.Error("Expected an error with an invalid mode")
+	}
+}
+
+func TestAllocationsAnnotation(t *testing.T) {
+	pod := newTestPod("game-0", "true", map[string]string{portsAnnotation: "27015/udp, 8080"})
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allocations []annotations.Allocation
+	err = json.Unmarshal([]byte(updated.Annotations[allocationsAnnotation]), &allocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePort := func(key string) int32 {
+		port, _ := strconv.Atoi(updated.Annotations[annotationPrefix+"/"+key])
+		return int32(port)
+	}
+	tcp := annotations.Allocation{Port: 8080, Protocol: v1.ProtocolTCP, NodePort: nodePort("8080"), Address: "203.0.113.10", Service: "game-0-8080"}
+	udp := annotations.Allocation{Port: 27015, Protocol: v1.ProtocolUDP, NodePort: nodePort("27015-udp"), Address: "203.0.113.10", Service: "game-0-27015-udp"}
+	if !slices.Equal(allocations, []annotations.Allocation{tcp, udp}) || tcp.NodePort == 0 {
+		t.Errorf("Expected the allocations of both ports, got %s", updated.Annotations[allocationsAnnotation])
+	}
+
+	err = removePodAnnotations(client, updated, []string{annotationPrefix + "/27015-udp", annotationPrefix + "/endpoint-27015-udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocations = nil
+	err = json.Unmarshal([]byte(updated.Annotations[allocationsAnnotation]), &allocations)
+	if err != nil || !slices.Equal(allocations, []annotations.Allocation{tcp}) {
+		t.Errorf("Expected the allocations of the remaining port, got %s", updated.Annotations[allocationsAnnotation])
+	}
+}
+
+func TestCreateServiceWithServiceLB(t *testing.T) {
+	config.K3sServiceLB = true
+	t.Cleanup(func() { config.K3sServiceLB = false })
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+
+	err := createService(client, pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer || len(service.Spec.ExternalIPs) != 0 {
+		t.Errorf("Expected a LoadBalancer service without external ips, got %+v", service.Spec)
+	}
+	// ServiceLB binds the port on the nodes, so it has to be the unique node port
+	if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].Port != 30000 || service.Spec.Ports[0].TargetPort.IntVal != 8080 {
+		t.Errorf("Expected port 30000 with target port 8080, got %+v", service.Spec.Ports)
+	}
+}
+
+func TestServiceLBAllocations(t *testing.T) {
+	config.K3sServiceLB = true
+	t.Cleanup(func() { config.K3sServiceLB = false })
+	pod := newTestPod("game-0", "", map[string]string{portsAnnotation: "8080, 27015/udp"})
+	client := newTestClient(t, pod)
+	requestedPorts := []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}, {Port: 27015, Protocol: v1.ProtocolUDP}}
+	var services []*v1.Service
+	for i, requestedPort := range requestedPorts {
+		nodePort := int32(31000 + i)
+		service, err := client.CoreV1().Services(testNamespace).Create(context.Background(), &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: podPortToServiceName(pod, requestedPort)},
+			Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Port: nodePort, NodePort: nodePort, Protocol: requestedPort.Protocol}}},
+			Status:     v1.ServiceStatus{LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "203.0.113.10"}}}},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, service)
+	}
+
+	// Both ports are waited for with the pod before any of them was annotated
+	var wg sync.WaitGroup
+	for i := range requestedPorts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waitForServiceLB(client, pod, requestedPorts[i], services[i])
+		}()
+	}
+	wg.Wait()
+
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocations, err := annotations.ParseAllocations(updated.Annotations[allocationsAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 2 {
+		t.Errorf("Expected the allocations of both ports, got %+v", allocations)
+	}
+}
+
+func TestNamespacedRbac(t *testing.T) {
+	config.NamespacedRbac = true
+	config.Namespace = testNamespace
+	config.NodeIpsConfigMap = testNamespace + "/node-ips"
+	t.Cleanup(func() {
+		config.NamespacedRbac = false
+		config.Namespace = ""
+		config.NodeIpsConfigMap = ""
+	})
+	pod := newTestPod("game-0", "8080", nil)
+	unknownNodePod := newTestPod("game-1", "8080", nil)
+	unknownNodePod.Spec.NodeName = "unknown-node"
+	client := newTestClient(t, pod, unknownNodePod, &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-ips", Namespace: testNamespace},
+		Data:       map[string]string{testNodeName: "198.51.100.10, 2001:db8::10"},
+	})
+	client.PrependReactor("get", "nodes", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		t.Error("Expected the nodes to not be fetched")
+		return true, nil, errors.New("forbidden")
+	})
+
+	cachedExternalIPs := make(map[string][]string)
+	if ips := getPodExternalIps(client, pod, cachedExternalIPs); len(ips) != 2 || ips[0] != "198.51.100.10" || ips[1] != "2001:db8::10" {
+		t.Errorf("Expected the ips of the ConfigMap, got %v", ips)
+	}
+	if ips := getPodExternalIps(client, unknownNodePod, cachedExternalIPs); len(ips) != 1 || ips[0] != unknownNodePod.Status.HostIP {
+		t.Errorf("Expected the host ip, got %v", ips)
+	}
+
+	config.Namespace = ""
+	if err := parseConfig(); err == nil {
+		t.Error("Expected the namespaced rbac mode to require a namespace")
+	}
+}
+
+func TestTenant(t *testing.T) {
+	config.Tenant = "team-a"
+	t.Cleanup(func() { config.Tenant = "" })
+	pod := newTestPod("game-0", "8080", nil)
+	pod.Spec.ServiceAccountName = "team-a-games"
+	otherPod := newTestPod("game-1", "8080", nil)
+	otherService := managedService("stale-8080", "deleted-pod")
+	otherService.Labels[tenantLabel] = "team-b"
+	client := newTestClient(t, pod, otherPod, otherService, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a-games", Namespace: testNamespace, Labels: map[string]string{tenantLabel: "team-a"}},
+	})
+
+	for _, p := range []*v1.Pod{pod, otherPod} {
+		err := handlePodEvent(client, watch.Added, p, make(map[string]podState), make(map[string][]string))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := deleteStaleServices(client, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := serviceNames(t, client)
+	if !found["game-0-8080"] || found["game-1-8080"] || !found["stale-8080"] {
+		t.Errorf("Expected only the service of the tenant pod and the service of the other tenant, got %v", found)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Labels[tenantLabel] != "team-a" {
+		t.Errorf("Expected the tenant label, got %v", service.Labels)
+	}
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	pod := newTestPod("match-0", "8080", map[string]string{leaseTtlAnnotation: "10m"})
+	startTime := metav1.NewTime(time.Now())
+	pod.Status.StartTime = &startTime
+	client := newTestClient(t, pod)
+	handledPods := make(map[string]podState)
+
+	err := handlePodEvent(client, watch.Added, pod, handledPods, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serviceNames(t, client)["match-0-8080"] {
+		t.Fatal("Expected the service while the lease is valid")
+	}
+
+	// The pod is still running, but nobody renewed the lease
+	startTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	err = handlePodEvent(client, watch.Modified, pod, handledPods, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serviceNames(t, client)["match-0-8080"] {
+		t.Error("Expected the service to be deleted once the lease expired")
+	}
+
+	pod.Annotations[leaseRenewedAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	err = handlePodEvent(client, watch.Modified, pod, handledPods, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serviceNames(t, client)["match-0-8080"] {
+		t.Error("Expected the service to be created again after the renewal")
+	}
+}
+
+func TestServiceRecordsPodIncarnationAndNode(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	pod.UID = "uid-1"
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Labels[podUidLabelKey] != "uid-1" || service.Annotations[nodeAnnotation] != testNodeName {
+		t.Errorf("Expected the uid and node of the pod, got %v %v", service.Labels, service.Annotations)
+	}
+}
+
+func TestPortLabels(t *testing.T) {
+	config.PortLabels = true
+	t.Cleanup(func() { config.PortLabels = false })
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := annotationPrefix + "/np-8080"
+	if updated.Labels[label] == "" || updated.Labels[label] != updated.Annotations[annotationPrefix+"/8080"] {
+		t.Fatalf("Expected the node port as label, got %v", updated.Labels)
+	}
+
+	err = expireLease(client, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err = client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := updated.Labels[label]; ok || updated.Labels[labelKey] != "8080" {
+		t.Errorf("Expected only the port label to be removed with the annotations, got %v", updated.Labels)
+	}
+}
+
+func TestServicePortName(t *testing.T) {
+	pod := newTestPod("game-0", "27015/udp", nil)
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-27015-udp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := client.CoreV1().Endpoints(testNamespace).Get(context.Background(), "game-0-27015-udp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.Spec.Ports[0].Name != "udp-27015" || endpoints.Subsets[0].Ports[0].Name != "udp-27015" {
+		t.Errorf("Expected the port name udp-27015, got %q and %q", service.Spec.Ports[0].Name, endpoints.Subsets[0].Ports[0].Name)
+	}
+
+	t.Cleanup(func() {
+		config.ServicePortName = "{{ lower .Protocol }}-{{ .Port }}"
+		parseConfig()
+	})
+	config.ServicePortName = `{{ index .Pod.Labels "app" }}-{{ .Port }}`
+	err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Labels["app"] = "game"
+	if name, err := servicePortName(pod, PortRequest{Port: 7777, Protocol: v1.ProtocolUDP}); err != nil || name != "game-7777" {
+		t.Errorf("Expected the port name of the template, got %q %v", name, err)
+	}
+	pod.Labels["app"] = "Game_Server"
+	if _, err := servicePortName(pod, PortRequest{Port: 7777, Protocol: v1.ProtocolUDP}); err == nil {
+		t.Error("Expected an error for a port name that is no DNS label")
+	}
+}
+
+func TestServicePerPod(t *testing.T) {
+	config.ServicePerPod = true
+	t.Cleanup(func() { config.ServicePerPod = false })
+	pod := newTestPod("game-0", "", map[string]string{portsAnnotation: "8080, 27015/udp"})
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := client.CoreV1().Services(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 1 || services.Items[0].Name != "game-0" || len(services.Items[0].Spec.Ports) != 2 {
+		t.Fatalf("Expected a single service with both ports, got %+v", services.Items)
+	}
+	if services.Items[0].Spec.Ports[0].NodePort == services.Items[0].Spec.Ports[1].NodePort {
+		t.Errorf("Expected a node port per port, got %+v", services.Items[0].Spec.Ports)
+	}
+	endpoints, err := client.CoreV1().Endpoints(testNamespace).Get(context.Background(), "game-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints.Subsets) != 1 || len(endpoints.Subsets[0].Ports) != 2 {
+		t.Errorf("Expected the endpoints with both ports, got %+v", endpoints.Subsets)
+	}
+
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range services.Items[0].Spec.Ports {
+		key := annotationPrefix + "/" + servicePortRequest(port).Key()
+		if expected := strconv.Itoa(int(port.NodePort)); updated.Annotations[key] != expected {
+			t.Errorf("Expected %s to be %s, got %q", key, expected, updated.Annotations[key])
+		}
+	}
+	allocations, err := listAllocations(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 2 {
+		t.Errorf("Expected an allocation per port, got %+v", allocations)
+	}
+
+	err = handlePodEvent(client, watch.Deleted, updated, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err = client.CoreV1().Services(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 0 {
+		t.Errorf("Expected the service of the pod to be deleted, got %d", len(services.Items))
+	}
+}
+
+// Returns the verbs the roles of the manifest grant on the core resource
+func manifestVerbs(t *testing.T, path string, resource string) []string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verbs []string
+	for _, document := range strings.Split(string(content), "\n---") {
+		var role struct {
+			Kind  string              `json:"kind"`
+			Rules []rbacV1.PolicyRule `json:"rules"`
+		}
+		err := yaml.Unmarshal([]byte(document), &role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role.Kind != "Role" && role.Kind != "ClusterRole" {
+			continue
+		}
+		for _, rule := range role.Rules {
+			if slices.Contains(rule.APIGroups, "") && slices.Contains(rule.Resources, resource) {
+				verbs = append(verbs, rule.Verbs...)
+			}
+		}
+	}
+	return verbs
+}
+
+func TestServicePerPodPermissions(t *testing.T) {
+	config.ServicePerPod = true
+	t.Cleanup(func() { config.ServicePerPod = false })
+	pod := newTestPod("game-0", "", map[string]string{portsAnnotation: "8080, 27015/udp"})
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Removing one port updates the service and endpoints of the pod
+	err = deletePortService(client, pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePodEvent(client, watch.Deleted, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, manifest := range []string{"../../../deploy.yaml", "../../../deploy-namespaced.yaml"} {
+		for _, action := range client.Actions() {
+			resource := action.GetResource().Resource
+			if resource != "services" && resource != "endpoints" {
+				continue
+			}
+			if !slices.Contains(manifestVerbs(t, manifest, resource), action.GetVerb()) {
+				t.Errorf("%s doesn't grant %s on %s", manifest, action.GetVerb(), resource)
+			}
+			if !slices.ContainsFunc(controllerPermissions(), func(permission authorizationV1.ResourceAttributes) bool {
+				return permission.Verb == action.GetVerb() && permission.Resource == resource
+			}) {
+				t.Errorf("verify doesn't check %s on %s", action.GetVerb(), resource)
+			}
+		}
+	}
+}
+
+func TestNamespacedRbacPermissions(t *testing.T) {
+	config.NamespacedRbac = true
+	config.NodeIpsConfigMap = testNamespace + "/node-ips"
+	t.Cleanup(func() {
+		config.NamespacedRbac = false
+		config.NodeIpsConfigMap = ""
+	})
+	client := fake.NewSimpleClientset()
+	// Only allows what the Role of the namespaced manifest grants
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8sTesting.CreateAction).GetObject().(*authorizationV1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		resource := attributes.Resource
+		if attributes.Subresource != "" {
+			resource += "/" + attributes.Subresource
+		}
+		review.Status.Allowed = attributes.Namespace == testNamespace && slices.Contains(manifestVerbs(t, "../../../deploy-namespaced.yaml", resource), attributes.Verb)
+		return true, review, nil
+	})
+
+	result, err := checkPermissions(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range result.Permissions {
+		if !check.Allowed {
+			t.Errorf("%s %s (%s) is not granted by the namespaced manifest", check.Verb, check.Resource, check.Namespace)
+		}
+	}
+	if !slices.Contains(result.Permissions, permissionCheck{Verb: "get", Resource: "configmaps", Namespace: testNamespace, Allowed: true}) {
+		t.Errorf("The node ips ConfigMap is not checked: %v", result.Permissions)
+	}
+	if !result.Succeeded {
+		t.Error("The verification failed")
+	}
+}
+
+func TestServiceNamespacePermissions(t *testing.T) {
+	config.ServiceNamespace = "dynamic-hostports"
+	config.ServicePerPod = true
+	t.Cleanup(func() {
+		config.ServiceNamespace = ""
+		config.ServicePerPod = false
+	})
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		return true, action.(k8sTesting.CreateAction).GetObject(), nil
+	})
+	result, err := checkPermissions(client, []string{"team-a", "team-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkedNamespaces := make(map[string][]string)
+	for _, check := range result.Permissions {
+		checkedNamespaces[check.Resource] = append(checkedNamespaces[check.Resource], check.Namespace)
+	}
+	for _, resource := range []string{"services", "endpoints"} {
+		for _, namespace := range checkedNamespaces[resource] {
+			if namespace != "dynamic-hostports" {
+				t.Errorf("%s are checked in '%s' instead of the service namespace", resource, namespace)
+			}
+		}
+	}
+	// create, delete, list, get and update, once
+	if len(checkedNamespaces["services"]) != 5 {
+		t.Errorf("Expected 5 checks of the services, got %v", checkedNamespaces["services"])
+	}
+	if !slices.Contains(checkedNamespaces["pods"], "team-a") || !slices.Contains(checkedNamespaces["pods"], "team-b") {
+		t.Errorf("The pods are not checked in the watched namespaces: %v", checkedNamespaces["pods"])
+	}
+}
+
+func TestHeadlessService(t *testing.T) {
+	config.HeadlessService = true
+	t.Cleanup(func() { config.HeadlessService = false })
+	pod := newTestPod("game-0", "8080", nil)
+	stsPod := newTestPod("sts-0", "8080", nil)
+	stsPod.Spec.Hostname = "sts-0"
+	stsPod.Spec.Subdomain = "sts"
+	client := newTestClient(t, pod, stsPod)
+	for _, current := range []*v1.Pod{pod, stsPod} {
+		err := handlePodEvent(client, watch.Added, current, make(map[string]podState), make(map[string][]string))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-headless", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHeadlessService(service) || len(service.Spec.Ports) != 1 || service.Labels[forPodLabelKey] != "game-0" {
+		t.Errorf("Expected a headless service of the pod, got %+v", service)
+	}
+	endpoints, err := client.CoreV1().Endpoints(testNamespace).Get(context.Background(), "game-0-headless", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoints.Subsets[0].Addresses[0].IP != pod.Status.PodIP {
+		t.Errorf("Expected the pod ip in the endpoints, got %+v", endpoints.Subsets)
+	}
+	_, err = client.CoreV1().Services(testNamespace).Get(context.Background(), "sts-0-headless", metav1.GetOptions{})
+	if !k8sErrors.IsNotFound(err) {
+		t.Errorf("Expected the StatefulSet pod to reuse its governing service, got %v", err)
+	}
+
+	expected := map[string]string{"game-0": "game-0-headless.default.svc.cluster.local", "sts-0": "sts-0.sts.default.svc.cluster.local"}
+	for name, dnsName := range expected {
+		updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Annotations[clusterDnsAnnotation] != dnsName {
+			t.Errorf("Expected the DNS name %s of %s, got %q", dnsName, name, updated.Annotations[clusterDnsAnnotation])
+		}
+	}
+
+	allocations, err := listAllocations(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 2 {
+		t.Errorf("Expected the headless service to be no allocation, got %+v", allocations)
+	}
+}
+
+func TestStickyNodePortTaken(t *testing.T) {
+	config.NodePortPools = "31000-31009"
+	config.AllocationStrategy = "sticky"
+	t.Cleanup(func() {
+		config.NodePortPools = ""
+		config.AllocationStrategy = ""
+		parseConfig()
+	})
+	pod := newTestPod("game-0", "8080", nil)
+	requestedPort := PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}
+	sticky := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: stickyConfigMapName, Namespace: testNamespace},
+		Data:       map[string]string{stickyKey(pod, requestedPort): "31005"},
+	}
+	client := newTestClient(t, pod, sticky)
+	// The sticky node port is used by a service the controller doesn't know about
+	client.PrependReactor("create", "services", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		service := action.(k8sTesting.CreateAction).GetObject().(*v1.Service)
+		if service.Spec.Ports[0].NodePort == 31005 {
+			return true, nil, k8sErrors.NewInvalid(schema.GroupKind{Kind: "Service"}, service.Name, field.ErrorList{field.Invalid(field.NewPath("spec", "ports").Index(0).Child("nodePort"), 31005, "provided port is already allocated")})
+		}
+		return false, nil, nil
+	})
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake api server would pick 30000, the pool starts at 31000
+	if nodePort := updated.Annotations[podPortToAnnotation(requestedPort)]; nodePort != "31000" {
+		t.Errorf("Expected the first node port of the pool, got %q", nodePort)
+	}
+}
+
+func TestRelayClosesRemovedPorts(t *testing.T) {
+	var nodePorts []int32
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodePorts = append(nodePorts, int32(listener.Addr().(*net.TCPAddr).Port))
+		listener.Close()
+	}
+	r := &relay{listeners: make(map[string]net.Listener)}
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "game-0", Namespace: testNamespace},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "8080-tcp", Protocol: v1.ProtocolTCP, NodePort: nodePorts[0]},
+			{Name: "8081-tcp", Protocol: v1.ProtocolTCP, NodePort: nodePorts[1]},
+		}},
+	}
+	r.syncService(service, false)
+	if len(r.listeners) != 2 {
+		t.Fatalf("Expected a listener per port, got %v", r.listeners)
+	}
+
+	updated := service.DeepCopy()
+	updated.Spec.Ports = updated.Spec.Ports[:1]
+	r.syncService(updated, false)
+	if _, ok := r.listeners[relayListenerKey(service, nodePorts[1])]; ok || len(r.listeners) != 1 {
+		t.Errorf("Expected the listener of the removed port to be closed, got %v", r.listeners)
+	}
+	// The node port is free again
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(int(nodePorts[1])))
+	if err != nil {
+		t.Errorf("Expected the node port of the removed port to be released, got %v", err)
+	} else {
+		listener.Close()
+	}
+
+	r.syncService(updated, true)
+	if len(r.listeners) != 0 {
+		t.Errorf("Expected all listeners to be closed with the service, got %v", r.listeners)
+	}
+}
+
+func TestPortBlock(t *testing.T) {
+	config.NodePortPools = "31000-31002,31010-31019"
+	t.Cleanup(func() {
+		config.NodePortPools = ""
+		parseConfig()
+	})
+	pod := newTestPod("media-0", "", map[string]string{annotationPrefix + "/block-5004-udp": "4"})
+	client := newTestClient(t, pod)
+	nodePortAllocator.MarkUsed(31011, "other/service")
+
+	// The first attempt fails because a node port of the block is used by a service that is not known yet
+	failed := false
+	client.PrependReactor("create", "services", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		service := action.(k8sTesting.CreateAction).GetObject().(*v1.Service)
+		if service.Spec.Ports[0].NodePort == 31014 && !failed {
+			failed = true
+			return true, nil, k8sErrors.NewInvalid(schema.GroupKind{Kind: "Service"}, service.Name, field.ErrorList{field.Invalid(field.NewPath("spec", "ports").Index(0).Child("nodePort"), 31014, "provided port is already allocated")})
+		}
+		return false, nil, nil
+	})
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err == nil {
+		t.Fatal("Expected the failed service of the block")
+	}
+	services, err := client.CoreV1().Services(testNamespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 0 {
+		t.Fatalf("Expected the services of the incomplete block to be deleted, got %d", len(services.Items))
+	}
+
+	err = handlePodEvent(client, watch.Modified, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 31011 and 31014 are used, so the first free block starts after them
+	for i := 0; i < 4; i++ {
+		key := annotationPrefix + "/" + strconv.Itoa(5004+i) + "-udp"
+		if expected := strconv.Itoa(31015 + i); updated.Annotations[key] != expected {
+			t.Errorf("Expected %s to be %s, got %q", key, expected, updated.Annotations[key])
+		}
+	}
+	first := PortRequest{Port: 5004, Protocol: v1.ProtocolUDP}
+	if updated.Annotations[names.BlockNodePort(first)] != "31015" || updated.Annotations[names.BlockLength(first)] != "4" {
+		t.Errorf("Expected the base node port and length of the block, got %v", updated.Annotations)
+	}
+
+	config.NodePortPools = ""
+	parseConfig()
+	_, _, err = allocatePortBlocks(newTestPod("media-1", "", pod.Annotations), []PortRequest{first})
+	if !errors.Is(err, errBlockWithoutPools) {
+		t.Errorf("Expected blocks to require node port pools, got %v", err)
+	}
+}
+
+func TestAllocationLatency(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	pod.Namespace = "latency"
+	started := metav1.NewTime(time.Now().Add(-3 * time.Second))
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "app", State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: started}}}}
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := &dto.Metric{}
+	err = allocationLatencySeconds.WithLabelValues("latency").(prometheus.Histogram).Write(metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metric.Histogram.GetSampleCount() != 1 || metric.Histogram.GetSampleSum() < 3 {
+		t.Errorf("Expected one allocation of at least 3s, got %d with %fs", metric.Histogram.GetSampleCount(), metric.Histogram.GetSampleSum())
+	}
+}
+
+func TestRefreshNodePods(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	cachedExternalIPs := make(map[string][]string)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), cachedExternalIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(context.Background(), testNodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Status.Addresses[0].Address = "203.0.113.20"
+	_, err = client.CoreV1().Nodes().UpdateStatus(context.Background(), node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshNodePods(client, []string{testNamespace}, testNodeName, cachedExternalIPs)
+
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.20" {
+		t.Errorf("Expected the new address on the service, got %v", service.Spec.ExternalIPs)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := updated.Annotations[podPortToEndpointAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})]
+	if updated.Annotations[externalIpAnnotation] != "203.0.113.20" || endpoint != "203.0.113.20:"+strconv.Itoa(int(service.Spec.Ports[0].NodePort)) {
+		t.Errorf("Expected the annotations to advertise the new address, got %v", updated.Annotations)
+	}
+}
+
+func TestRefreshNodePodsAllocations(t *testing.T) {
+	config.AdvertiseAllNodeIps = true
+	t.Cleanup(func() { config.AdvertiseAllNodeIps = false })
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	setNodeAddresses := func(addresses ...string) {
+		node, err := client.CoreV1().Nodes().Get(context.Background(), testNodeName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Status.Addresses = nil
+		for _, address := range addresses {
+			node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: address})
+		}
+		_, err = client.CoreV1().Nodes().UpdateStatus(context.Background(), node, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// With two addresses the pod gets the endpoints annotation, which is removed once only one is left
+	setNodeAddresses("203.0.113.10", "203.0.113.11")
+	cachedExternalIPs := make(map[string][]string)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), cachedExternalIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setNodeAddresses("203.0.113.20")
+	refreshNodePods(client, []string{testNamespace}, testNodeName, cachedExternalIPs)
+
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Annotations[podPortToEndpointsAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})] != "" {
+		t.Errorf("Expected the endpoints annotation to be removed, got %v", updated.Annotations)
+	}
+	allocations, err := annotations.ParseAllocations(updated.Annotations[allocationsAnnotation])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].Address != "203.0.113.20" {
+		t.Errorf("Expected the allocations to advertise the new address, got %+v", allocations)
+	}
+}
+
+func TestNodeDeletion(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	cachedExternalIPs := make(map[string][]string)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), cachedExternalIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChannel := make(chan struct{})
+	t.Cleanup(func() { close(stopChannel) })
+	startNodeInformer(client, stopChannel)
+
+	err = client.CoreV1().Nodes().Delete(context.Background(), testNodeName, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case nodeName := <-nodeAddressChanges:
+		refreshNodePods(client, []string{testNamespace}, nodeName, cachedExternalIPs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the deletion of the node to be reported")
+	}
+
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Annotations[externalIpAnnotation] != pod.Status.HostIP {
+		t.Errorf("Expected the deleted node not to be advertised anymore, got %v", updated.Annotations)
+	}
+	if _, ok := cachedExternalIPs[testNodeName+"/"+addressTypesKey(nodeAddressTypes)]; ok {
+		t.Error("Expected the cached ips of the node to be dropped")
+	}
+}
+
+func TestCapacityMetrics(t *testing.T) {
+	managed := managedService("game-0-8080", "game-0")
+	managed.Annotations = map[string]string{nodeAnnotation: testNodeName}
+	unmanaged := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: testNamespace},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: []v1.ServicePort{{Port: 80, NodePort: 31001}}},
+	}
+	client := newTestClient(t, managed, unmanaged)
+
+	err := updateCapacityMetrics(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := testutil.ToFloat64(nodePortsTotal); total != 2768 {
+		t.Errorf("Expected the cluster node port range, got %f", total)
+	}
+	if free := testutil.ToFloat64(nodePortsFree); free != 2766 {
+		t.Errorf("Expected the managed and the other service to use a node port, got %f free", free)
+	}
+	if allocations := testutil.ToFloat64(nodeAllocations.WithLabelValues(testNodeName)); allocations != 1 {
+		t.Errorf("Expected one allocation on the node, got %f", allocations)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocations, err := listAllocations(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].Pod != "game-0" || allocations[0].Port != "8080/tcp" || allocations[0].Node != testNodeName {
+		t.Fatalf("Expected the allocation of the pod, got %+v", allocations)
+	}
+
+	allocations[0].Created = time.Now().Add(-90 * time.Second)
+	output := &bytes.Buffer{}
+	err = printAllocations(output, allocations, time.Now(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || strings.Fields(lines[0])[0] != "NAMESPACE" {
+		t.Fatalf("Expected a header and one row, got %q", output.String())
+	}
+	expected := []string{testNamespace, "game-0", "8080/tcp", strconv.Itoa(int(allocations[0].NodePort)), testNodeName, "203.0.113.10", "90s"}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected the row %v, got %v", expected, fields)
+	}
+}
+
+func TestTopView(t *testing.T) {
+	now := time.Now()
+	game := allocation{Namespace: "games", Pod: "game-0", Port: "8080/tcp", NodePort: 30002, Created: now.Add(-time.Hour)}
+	voice := allocation{Namespace: "voice", Pod: "voice-0", Port: "9000/udp", NodePort: 30001, Created: now.Add(-time.Minute)}
+	view := &topView{sortBy: "age"}
+	view.update([]allocation{game})
+	view.update([]allocation{voice})
+
+	changes := func() string {
+		var changes []string
+		for _, row := range view.visibleRows() {
+			changes = append(changes, row.change+row.Pod)
+		}
+		return strings.Join(changes, " ")
+	}
+	if changes := changes(); changes != "+voice-0 -game-0" {
+		t.Errorf("Expected the new allocation first and the released one marked, got %q", changes)
+	}
+
+	view.update([]allocation{game, voice})
+	view.nextSortOrder()
+	if changes := changes(); view.sortBy != "port" || changes != "voice-0 +game-0" {
+		t.Errorf("Expected the allocations sorted by node port, got %q sorted by %s", changes, view.sortBy)
+	}
+	view.nextNamespace()
+	if changes := changes(); view.namespace != "games" || changes != "+game-0" {
+		t.Errorf("Expected only the allocations of the first namespace, got %q of %q", changes, view.namespace)
+	}
+	view.nextNamespace()
+	view.nextNamespace()
+	if view.namespace != "" {
+		t.Errorf("Expected all namespaces after the last one, got %q", view.namespace)
+	}
+
+	output := &bytes.Buffer{}
+	err := view.render(output, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "2 allocations  namespace: all  sort: port") {
+		t.Errorf("Expected the header of the view, got %q", output.String())
+	}
+}
+
+func TestCleanupOutput(t *testing.T) {
+	pod := newTestPod("game-0", "8080", map[string]string{annotationPrefix + "/8080": "31000"})
+	client := newTestClient(t, pod, managedService("game-0-8080", "game-0"))
+
+	removed, err := cleanup(client, []string{testNamespace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputFormat = "yaml"
+	t.Cleanup(func() { outputFormat = "" })
+	output := &bytes.Buffer{}
+	err = printStructured(output, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `- kind: Service
+  name: game-0-8080
+  namespace: default
+- annotations:
+  - dynamic-hostports.k8s/8080
+  kind: Pod
+  name: game-0
+  namespace: default
+`
+	if output.String() != expected {
+		t.Errorf("Expected the removed service and annotations, got\n%s", output.String())
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	t.Cleanup(func() { outputFormat = "" })
+	root := rootCommand()
+	list, _, err := root.Find([]string{"list"})
+	if err != nil || list.Name() != "status" {
+		t.Fatalf("Expected list to be the status command, got %v %v", list, err)
+	}
+	for _, test := range []struct {
+		command string
+		format  string
+		valid   bool
+	}{
+		{"status", "wide", true},
+		{"status", "json", true},
+		{"verify", "wide", false},
+		{"cleanup", "wide", false},
+		{"cleanup", "yaml", true},
+		{"verify", "table", false},
+	} {
+		command, _, err := root.Find([]string{test.command})
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputFormat = test.format
+		if err := command.PreRunE(command, nil); (err == nil) != test.valid {
+			t.Errorf("Expected -o %s of %s to be valid: %v, got %v", test.format, test.command, test.valid, err)
+		}
+	}
+}
+
+func TestCreateServicesWithOnePatch(t *testing.T) {
+	pod := newTestPod("game-0", "auto", map[string]string{portsAnnotation: "27015-27020/udp"})
+	client := newTestClient(t, pod)
+	patches := 0
+	client.PrependReactor("patch", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "" {
+			patches++
+		}
+		return false, nil, nil
+	})
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := serviceNames(t, client); len(found) != 6 {
+		t.Errorf("Expected 6 services, got %v", found)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port := 27015; port <= 27020; port++ {
+		if _, ok := updated.Annotations[podPortToAnnotation(PortRequest{Port: int32(port), Protocol: v1.ProtocolUDP})]; !ok {
+			t.Errorf("Expected the annotation of port %d, got %v", port, updated.Annotations)
+		}
+	}
+	if patches != 1 {
+		t.Errorf("Expected the annotations of all ports to be added with one patch, got %d patches", patches)
+	}
+}
+
+func TestPodCondition(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var condition *v1.PodCondition
+	for i := range updated.Status.Conditions {
+		if updated.Status.Conditions[i].Type == podConditionType {
+			condition = &updated.Status.Conditions[i]
+		}
+	}
+	if condition == nil || condition.Status != v1.ConditionTrue || condition.Reason != "Allocated" {
+		t.Fatalf("Expected the allocated condition, got %v", updated.Status.Conditions)
+	}
+	if len(updated.Status.Conditions) != 2 {
+		t.Errorf("Expected the ready condition to be kept, got %v", updated.Status.Conditions)
+	}
+
+	patches := 0
+	client.PrependReactor("patch", "pods", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		patches++
+		return false, nil, nil
+	})
+	setPodCondition(client, updated, v1.ConditionTrue, "Allocated", condition.Message)
+	if patches != 0 {
+		t.Errorf("Expected an unchanged condition not to be patched, got %d patches", patches)
+	}
+}
+
+func TestCreateServicesWithinQuota(t *testing.T) {
+	config.DefaultNamespaceQuota = 2
+	t.Cleanup(func() { config.DefaultNamespaceQuota = -1 })
+	pod := newTestPod("game-0", "auto", map[string]string{portsAnnotation: "27015-27017/udp"})
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if !errors.Is(err, errNamespaceQuotaExceeded) {
+		t.Errorf("Expected the quota to be exceeded, got %v", err)
+	}
+	if found := serviceNames(t, client); len(found) != 2 {
+		t.Errorf("Expected the services that fit into the quota, got %v", found)
+	}
+}
+
+func TestZeroNamespaceQuota(t *testing.T) {
+	config.NamespaceQuotas = testNamespace + "=0"
+	t.Cleanup(func() { config.NamespaceQuotas = "" })
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if !errors.Is(err, errNamespaceQuotaExceeded) {
+		t.Errorf("Expected the quota to be exceeded, got %v", err)
+	}
+	if found := serviceNames(t, client); len(found) != 0 {
+		t.Errorf("Expected no services with a quota of 0, got %v", found)
+	}
+
+	// Other namespaces have no quota
+	otherPod := newTestPod("game-1", "8080", nil)
+	otherPod.Namespace = "team-a"
+	_, err = client.CoreV1().Pods("team-a").Create(context.Background(), otherPod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handlePodEvent(client, watch.Added, otherPod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Errorf("Expected a namespace without quota to be unlimited, got %v", err)
+	}
+}
+
+func TestServicePerPodWithinQuota(t *testing.T) {
+	config.DefaultNamespaceQuota = 3
+	config.ServicePerPod = true
+	t.Cleanup(func() {
+		config.DefaultNamespaceQuota = -1
+		config.ServicePerPod = false
+	})
+	pod := newTestPod("game-0", "", map[string]string{portsAnnotation: "27015-27016/udp"})
+	otherPod := newTestPod("game-1", "", map[string]string{portsAnnotation: "27015-27016/udp"})
+	client := newTestClient(t, pod, otherPod)
+
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The service of the first pod has two of the three ports of the quota
+	err = handlePodEvent(client, watch.Added, otherPod, make(map[string]podState), make(map[string][]string))
+	if !errors.Is(err, errNamespaceQuotaExceeded) {
+		t.Errorf("Expected the quota to be exceeded, got %v", err)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.Ports) != 1 {
+		t.Errorf("Expected only the port that fits into the quota, got %+v", service.Spec.Ports)
+	}
+}
+
+func TestPodDebouncer(t *testing.T) {
+	debouncer := newPodDebouncer(50 * time.Millisecond)
+	for _, phase := range []v1.PodPhase{v1.PodPending, v1.PodPending, v1.PodRunning} {
+		pod := newTestPod("game-0", "8080", nil)
+		pod.Status.Phase = phase
+		debouncer.add(watch.Modified, pod)
+	}
+	deletedPod := newTestPod("game-1", "8080", nil)
+	debouncer.add(watch.Modified, deletedPod)
+	debouncer.drop(deletedPod)
+
+	select {
+	case event := <-debouncer.channel:
+		if event.pod.Name != "game-0" || event.pod.Status.Phase != v1.PodRunning {
+			t.Errorf("Expected the latest version of game-0, got %s in phase %s", event.pod.Name, event.pod.Status.Phase)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the coalesced event")
+	}
+	select {
+	case event := <-debouncer.channel:
+		t.Errorf("Expected a single event, got another one of %s", event.pod.Name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestGetNodeSharesConcurrentLookups(t *testing.T) {
+	client := newTestClient(t)
+	release := make(chan struct{})
+	var calls atomic.Int32
+	client.PrependReactor("get", "nodes", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		calls.Add(1)
+		<-release
+		return false, nil, nil
+	})
+
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			node, err := getNode(client, testNodeName)
+			if err != nil || node.Name != testNodeName {
+				t.Errorf("Expected node %s, got %v %v", testNodeName, node, err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wait.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("Expected one api call for all lookups, got %d", calls.Load())
+	}
+}
+
+func TestNodeTopologyAnnotations(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	node, err := client.CoreV1().Nodes().Get(context.Background(), testNodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Labels = map[string]string{v1.LabelTopologyZone: "eu-west-1a", v1.LabelTopologyRegion: "eu-west-1"}
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = createService(client, pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Annotations[zoneAnnotation] != "eu-west-1a" || updated.Annotations[regionAnnotation] != "eu-west-1" {
+		t.Errorf("Expected the zone and region of the node, got %v", updated.Annotations)
+	}
+}
+
+func TestAdvertiseNodeNames(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	config.AdvertiseNodeNames = "ExternalDNS,Hostname"
+	t.Cleanup(func() {
+		config.AdvertiseNodeNames = ""
+		nodeNameTypes = nil
+	})
+	if err := parseNodeNameTypes(); err != nil {
+		t.Fatal(err)
+	}
+	node, err := client.CoreV1().Nodes().Get(context.Background(), testNodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Status.Addresses = append(node.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalDNS, Address: "node-1.example.com"})
+	_, err = client.CoreV1().Nodes().Update(context.Background(), node, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = createService(client, pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}, make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePort := updated.Annotations[podPortToAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})]
+	if endpoint := updated.Annotations[podPortToEndpointAnnotation(PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})]; endpoint != "node-1.example.com:"+nodePort {
+		t.Errorf("Expected the endpoint to use the DNS name of the node, got %q", endpoint)
+	}
+	if updated.Annotations[externalHostnameAnnotation] != "node-1.example.com" || updated.Annotations[externalIpAnnotation] != "203.0.113.10" {
+		t.Errorf("Expected the DNS name and the ip of the node, got %v", updated.Annotations)
+	}
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), podPortToServiceName(pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.10" {
+		t.Errorf("Expected the service to keep the ip of the node, got %v", service.Spec.ExternalIPs)
+	}
+
+	// The pod can opt out of the names
+	updated.Annotations[advertiseNodeNamesAnnotation] = ""
+	if nodeNames := getPodNodeNames(client, updated, make(map[string][]string)); nodeNames != nil {
+		t.Errorf("Expected no node names for the opted out pod, got %v", nodeNames)
+	}
+}
+
+func TestLastReconciled(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	paused := newTestPod("game-1", "8080", map[string]string{pausedAnnotation: "true"})
+	client := newTestClient(t, pod, paused)
+	for _, current := range []*v1.Pod{pod, paused} {
+		err := createService(client, current, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP}, make(map[string][]string))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	err := stampLastReconciled(client, []string{testNamespace}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"game-0": "2024-05-01T12:00:00Z", "game-1": ""} {
+		service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), name+"-8080", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated, err := client.CoreV1().Pods(testNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if service.Annotations[lastReconciledAnnotation] != expected || updated.Annotations[lastReconciledAnnotation] != expected {
+			t.Errorf("Expected %s to be stamped with %q, got %q and %q", name, expected, service.Annotations[lastReconciledAnnotation], updated.Annotations[lastReconciledAnnotation])
+		}
+	}
+}
+
+func TestPodEventQueue(t *testing.T) {
+	queue := newPodEventQueue()
+	newer := newTestPod("game-0", "8080", map[string]string{"version": "2"})
+	queue.push(watch.Event{Type: watch.Added, Object: newTestPod("game-0", "8080", nil)})
+	queue.push(watch.Event{Type: watch.Added, Object: newTestPod("game-1", "8080", nil)})
+	queue.push(watch.Event{Type: watch.Modified, Object: newer})
+	queue.push(watch.Event{Type: watch.Added, Object: newTestPod("game-2", "8080", nil)})
+	queue.push(watch.Event{Type: watch.Deleted, Object: newTestPod("game-1", "8080", nil)})
+
+	// The queue is ready as long as it has events
+	var handled []string
+	for len(queue.ready) > 0 {
+		<-queue.ready
+		event, ok := queue.pop()
+		if !ok {
+			t.Fatal("Expected an event of the ready queue")
+		}
+		pod := event.Object.(*v1.Pod)
+		handled = append(handled, string(event.Type)+" "+pod.Name+pod.Annotations["version"])
+	}
+	// The deletion goes first, and the older event of the deleted pod is dropped
+	expected := []string{"DELETED game-1", "MODIFIED game-02", "ADDED game-2"}
+	if strings.Join(handled, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, handled)
+	}
+	if _, ok := queue.popDeletion(); ok {
+		t.Errorf("Expected no deletion to be left")
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	handledPods := make(map[string]podState)
+	cachedExternalIPs := make(map[string][]string)
+	statuses := make(podReconcileStatuses)
+	err := handlePodEvent(client, watch.Added, pod, handledPods, cachedExternalIPs)
+	statuses.record(watch.Added, pod, err)
+	statuses.record(watch.Modified, newTestPod("game-1", "8080", nil), errNamespaceQuotaExceeded)
+	events := newPodEventQueue()
+	events.push(watch.Event{Type: watch.Deleted, Object: newTestPod("game-2", "8080", nil)})
+
+	go func() {
+		reply := <-debugStateRequests
+		reply <- newDebugState(handledPods, cachedExternalIPs, events, newPodDebouncer(time.Second), newPodRetries(), statuses)
+	}()
+	response := httptest.NewRecorder()
+	serveDebugState(response, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+
+	var state debugState
+	err = json.Unmarshal(response.Body.Bytes(), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.HandledPods[testNamespace+"/game-0"] != "handled" || len(state.NodeIPCache) == 0 {
+		t.Errorf("Expected the handled pod and the cached node ips, got %+v", state)
+	}
+	if state.Pods[testNamespace+"/game-1"].Error != errNamespaceQuotaExceeded.Error() || len(state.Queue.Deletions) != 1 {
+		t.Errorf("Expected the failed reconcile and the queued deletion, got %+v", state)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	dog := &watchdog{timeout: time.Minute, lastBeat: time.Now(), watchers: make(map[string]watch.Interface), lastEvents: make(map[string]time.Time)}
+	watcher := watch.NewFake()
+	dog.watchStarted(testNamespace, watcher)
+
+	dog.check()
+	if !dog.healthy() {
+		t.Fatal("Expected a beating loop to be healthy")
+	}
+
+	dog.lastBeat = time.Now().Add(-2 * time.Minute)
+	dog.lastEvents[testNamespace] = time.Now().Add(-2 * time.Minute)
+	dog.check()
+	if dog.healthy() {
+		t.Error("Expected the loop to be stalled")
+	}
+	if !watcher.IsStopped() {
+		t.Error("Expected the silent watch to be restarted")
+	}
+
+	dog.beat()
+	if !dog.healthy() {
+		t.Error("Expected the loop to recover with the next beat")
+	}
+}
+
+func TestWatchPodsResumes(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	watchers := make(chan *watch.FakeWatcher, 2)
+	var resourceVersions []string
+	var mutex sync.Mutex
+	client.PrependWatchReactor("pods", func(action k8sTesting.Action) (bool, watch.Interface, error) {
+		options := action.(k8sTesting.WatchActionImpl).ListOptions
+		if !options.AllowWatchBookmarks {
+			t.Error("Expected the watch to allow bookmarks")
+		}
+		mutex.Lock()
+		resourceVersions = append(resourceVersions, options.ResourceVersion)
+		mutex.Unlock()
+		watcher := watch.NewFake()
+		watchers <- watcher
+		return true, watcher, nil
+	})
+	dog := &watchdog{timeout: time.Minute, lastBeat: time.Now(), watchers: make(map[string]watch.Interface), lastEvents: make(map[string]time.Time)}
+	events := newPodEventQueue()
+	go watchPods(context.Background(), client, testNamespace, events, dog)
+
+	// The pods are listed once, the watch starts with the resource version of the list
+	<-events.ready
+	if event, ok := events.pop(); !ok || event.Type != watch.Added {
+		t.Fatalf("Expected the listed pod, got %v", event)
+	}
+	watcher := <-watchers
+	bookmark := &v1.Pod{ObjectMeta: metav1.ObjectMeta{ResourceVersion: "42"}}
+	watcher.Action(watch.Bookmark, bookmark)
+	modified := newTestPod("game-0", "8080", nil)
+	modified.ResourceVersion = "43"
+	watcher.Modify(modified)
+	<-events.ready
+	if event, ok := events.pop(); !ok || event.Type != watch.Modified {
+		t.Fatalf("Expected only the modification to be queued, got %v", event)
+	}
+
+	// A restarted watch resumes without listing the pods again
+	watcher.Stop()
+	<-watchers
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(resourceVersions) != 2 || resourceVersions[1] != "43" {
+		t.Errorf("Expected the watch to resume from the last resource version, got %v", resourceVersions)
+	}
+	if len(events.ready) != 0 {
+		t.Errorf("Expected no events of a second list")
+	}
+}
+
+func TestApiRequestVerbAndResource(t *testing.T) {
+	cases := []struct {
+		method   string
+		url      string
+		verb     string
+		resource string
+	}{
+		{http.MethodGet, "/api/v1/namespaces/default/pods", "list", "pods"},
+		{http.MethodGet, "/api/v1/namespaces/default/pods?watch=true", "watch", "pods"},
+		{http.MethodGet, "/api/v1/nodes/node-1", "get", "nodes"},
+		{http.MethodGet, "/api/v1/namespaces/default", "get", "namespaces"},
+		{http.MethodPatch, "/api/v1/namespaces/default/pods/game-0", "patch", "pods"},
+		{http.MethodPut, "/api/v1/namespaces/default/pods/game-0/status", "update", "pods/status"},
+		{http.MethodPost, "/api/v1/namespaces/default/services", "create", "services"},
+		{http.MethodDelete, "/apis/apps/v1/namespaces/default/statefulsets/game", "delete", "statefulsets"},
+		{http.MethodGet, "/version", "get", "other"},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(c.method, c.url, nil)
+		verb, resource := apiRequestVerbAndResource(request)
+		if verb != c.verb || resource != c.resource {
+			t.Errorf("%s %s: expected %s %s, got %s %s", c.method, c.url, c.verb, c.resource, verb, resource)
+		}
+	}
+}
+
+func TestApiRequestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Conflict","code":409}`, http.StatusConflict)
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	instrumentConfig(config)
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := apiRequestErrorsTotal.WithLabelValues("patch", "pods", "409")
+	before := testutil.ToFloat64(counter)
+	client.CoreV1().Pods(testNamespace).Patch(context.Background(), "game-0", types.MergePatchType, []byte("{}"), metav1.PatchOptions{})
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Errorf("Expected the conflict to be counted, got %f => %f", before, after)
+	}
+}
+
+func TestInvalidLabelValue(t *testing.T) {
+	newTestClient(t)
+	_, err := getRequestedPorts(nil, newTestPod("game-0", "8080_8081", nil))
+
+	var invalid annotations.InvalidValueError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Expected an InvalidValueError, got %v", err)
+	}
+	if invalid.Key != labelKey || invalid.Value != "8080_8081" || invalid.Syntax != annotations.LabelValueSyntax {
+		t.Errorf("Unexpected error %+v", invalid)
+	}
+}
+
+func TestUndeclaredPorts(t *testing.T) {
+	newTestClient(t)
+	requests := []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}, {Port: 8080, Protocol: v1.ProtocolUDP}, {Port: 9000, Protocol: v1.ProtocolTCP}}
+
+	undeclared := undeclaredPorts(newTestPod("game-0", "8080", nil), requests)
+	if len(undeclared) != 2 || undeclared[0].Protocol != v1.ProtocolUDP || undeclared[1].Port != 9000 {
+		t.Errorf("Expected 8080/udp and 9000/tcp to be undeclared, got %v", undeclared)
+	}
+
+	allowed := newTestPod("game-0", "8080", map[string]string{allowUndeclaredPortsAnnotation: "true"})
+	if undeclared := undeclaredPorts(allowed, requests); len(undeclared) != 0 {
+		t.Errorf("Expected the annotation to allow undeclared ports, got %v", undeclared)
+	}
+}
+
+func TestPolicyHook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		hookRequest := policyHookRequest{}
+		json.NewDecoder(request.Body).Decode(&hookRequest)
+		response := policyHookResponse{}
+		for _, port := range hookRequest.Ports {
+			if port.Protocol == v1.ProtocolUDP {
+				response.Denied = append(response.Denied, policyHookPort{Port: port.Port, Protocol: port.Protocol, Reason: "No UDP in namespace " + hookRequest.Namespace})
+			}
+		}
+		json.NewEncoder(writer).Encode(response)
+	}))
+	defer server.Close()
+	config.PolicyHookUrl = server.URL
+	t.Cleanup(func() { config.PolicyHookUrl = "" })
+
+	pod := newTestPod("game-0", "8080.27015/udp", nil)
+	client := newTestClient(t, pod)
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := serviceNames(t, client)
+	if !found["game-0-8080"] || found["game-0-27015-udp"] {
+		t.Errorf("Expected only the TCP port to be exposed, got %v", found)
+	}
+
+	config.PolicyHookUrl = server.URL + "/unreachable\x00"
+	_, err = filterPolicyHookPorts(pod, []PortRequest{{Port: 8080, Protocol: v1.ProtocolTCP}})
+	if !isPolicyHookError(err) {
+		t.Errorf("Expected a policy hook error, got %v", err)
+	}
+}
+
+func TestDnsRecords(t *testing.T) {
+	var mutex sync.Mutex
+	stored := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var txn struct {
+			Success []struct {
+				RequestPut         *struct{ Key, Value []byte } `json:"request_put"`
+				RequestDeleteRange *struct {
+					Key      []byte
+					RangeEnd []byte `json:"range_end"`
+				} `json:"request_delete_range"`
+			}
+		}
+		json.NewDecoder(request.Body).Decode(&txn)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, operation := range txn.Success {
+			if deleteRange := operation.RequestDeleteRange; deleteRange != nil {
+				for key := range stored {
+					if key >= string(deleteRange.Key) && key < string(deleteRange.RangeEnd) {
+						delete(stored, key)
+					}
+				}
+			}
+			if put := operation.RequestPut; put != nil {
+				stored[string(put.Key)] = string(put.Value)
+			}
+		}
+		writer.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	pod := newTestPod("game-0", "8080.27015/udp", nil)
+	client := newTestClient(t, pod)
+	config.DnsEtcdEndpoint = server.URL
+	config.DnsZone = "games.example.com"
+	t.Cleanup(func() {
+		config.DnsEtcdEndpoint = ""
+		config.DnsZone = ""
+	})
+	err := handlePodEvent(client, watch.Added, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	record := stored["/skydns/com/example/games/"+testNamespace+"/game-0/_udp/_27015/x1"]
+	mutex.Unlock()
+	service, err := client.CoreV1().Services(testNamespace).Get(context.Background(), "game-0-27015-udp", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"host":"203.0.113.10","port":` + strconv.Itoa(int(service.Spec.Ports[0].NodePort)) + `,"ttl":30}`
+	if record != expected || len(stored) != 2 {
+		t.Errorf("Expected the SRV record %s next to the one of 8080, got %v", expected, stored)
+	}
+
+	err = handlePodEvent(client, watch.Deleted, pod, make(map[string]podState), make(map[string][]string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(stored) != 0 {
+		t.Errorf("Expected the records to be removed with the pod, got %v", stored)
+	}
+}
+
+func TestHttpAuthToken(t *testing.T) {
+	config.HttpAuth = httpAuthToken
+	t.Cleanup(func() { config.HttpAuth = httpAuthNone })
+	client := newTestClient(t)
+	client.PrependReactor("create", "tokenreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8sTesting.CreateAction).GetObject().(*authenticationV1.TokenReview)
+		review.Status.Authenticated = review.Spec.Token == "valid" || review.Spec.Token == "forbidden"
+		review.Status.User.Username = review.Spec.Token
+		return true, review, nil
+	})
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8sTesting.CreateAction).GetObject().(*authorizationV1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "valid" && review.Spec.NonResourceAttributes.Path == "/metrics"
+		return true, review, nil
+	})
+
+	handler := newHttpAuthenticator(client).wrap(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "invalid": http.StatusUnauthorized, "forbidden": http.StatusForbidden, "valid": http.StatusOK} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		if response.Code != expected {
+			t.Errorf("Expected status %d for token '%s', got %d", expected, token, response.Code)
+		}
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	pod := newTestPod("game-0", "8080", map[string]string{allocationsAnnotation: `[{"port":8080,"protocol":"TCP","nodePort":30000,"address":"203.0.113.10","service":"game-0-8080"}]`})
+	pod.UID = "uid-game-0"
+	otherPod := newTestPod("game-1", "8080", nil)
+	otherPod.UID = "uid-game-1"
+	unmanaged := newTestPod("other", "", nil)
+	unmanaged.Labels = nil
+	hostNetworkPod := newTestPod("host-0", "8080", nil)
+	hostNetworkPod.Spec.HostNetwork = true
+	hostNetworkPod.Status.PodIP = hostNetworkPod.Status.HostIP
+	client := newTestClient(t, pod, otherPod, unmanaged, hostNetworkPod)
+	// The bound service account tokens of the pods
+	tokenPods := map[string]*v1.Pod{"token-game-0": pod, "token-game-1": otherPod}
+	var reviews atomic.Int32
+	client.PrependReactor("create", "tokenreviews", func(action k8sTesting.Action) (bool, runtime.Object, error) {
+		reviews.Add(1)
+		review := action.(k8sTesting.CreateAction).GetObject().(*authenticationV1.TokenReview)
+		if tokenPod, ok := tokenPods[review.Spec.Token]; ok {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationV1.UserInfo{
+				Username: "system:serviceaccount:" + tokenPod.Namespace + ":default",
+				Extra: map[string]authenticationV1.ExtraValue{
+					podNameExtra: {tokenPod.Name},
+					podUidExtra:  {string(tokenPod.UID)},
+				},
+			}
+		}
+		return true, review, nil
+	})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	handler := newWhoamiHandler(client, startWhoamiInformers(client, []string{testNamespace}, stop))
+	request := func(query string, token string, remoteAddr string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/whoami?"+query, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		request.RemoteAddr = remoteAddr
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := request("namespace=default&name=game-0", "token-game-0", "10.1.0.99:41234")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d %s", response.Code, response.Body.String())
+	}
+	var answer whoamiResponse
+	err := json.Unmarshal(response.Body.Bytes(), &answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Node != testNodeName || len(answer.Allocations) != 1 || answer.Allocations[0].NodePort != 30000 {
+		t.Errorf("Expected the allocations of the pod, got %+v", answer)
+	}
+	// The review is cached and the pod comes from the informer
+	request("namespace=default&name=game-0", "token-game-0", "10.1.0.99:41234")
+	if count := reviews.Load(); count != 1 {
+		t.Errorf("Expected one token review, got %d", count)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "pods" {
+			t.Errorf("Expected the pods to be read from the informer, got %v", action)
+		}
+	}
+
+	for _, test := range []struct {
+		query      string
+		token      string
+		remoteAddr string
+		status     int
+	}{
+		{"namespace=default", "token-game-0", "10.1.0.5:41234", http.StatusBadRequest},
+		{"namespace=default&name=game-0", "token-game-1", "10.1.0.5:41234", http.StatusForbidden},
+		{"namespace=default&name=game-0", "invalid", "10.1.0.5:41234", http.StatusUnauthorized},
+		// The source ip is only checked with --whoami-source-ip-auth
+		{"namespace=default&name=game-0", "", "10.1.0.5:41234", http.StatusUnauthorized},
+		{"namespace=default&name=missing", "token-game-0", "10.1.0.5:41234", http.StatusNotFound},
+		{"namespace=default&name=other", "token-game-0", "10.1.0.5:41234", http.StatusNotFound},
+		{"namespace=team-a&name=game-0", "token-game-0", "10.1.0.5:41234", http.StatusNotFound},
+	} {
+		if response := request(test.query, test.token, test.remoteAddr); response.Code != test.status {
+			t.Errorf("Expected status %d for %s with token %q, got %d", test.status, test.query, test.token, response.Code)
+		}
+	}
+
+	config.WhoamiSourceIpAuth = true
+	t.Cleanup(func() { config.WhoamiSourceIpAuth = false })
+	for _, test := range []struct {
+		query      string
+		token      string
+		remoteAddr string
+		status     int
+	}{
+		{"namespace=default&name=game-0", "", "10.1.0.5:41234", http.StatusOK},
+		{"namespace=default&name=game-0", "", "10.1.0.6:41234", http.StatusForbidden},
+		// A token still has to be bound to the pod
+		{"namespace=default&name=game-0", "token-game-1", "10.1.0.5:41234", http.StatusForbidden},
+		// Every host network pod of the node has the same ip
+		{"namespace=default&name=host-0", "", "10.0.0.10:41234", http.StatusForbidden},
+	} {
+		if response := request(test.query, test.token, test.remoteAddr); response.Code != test.status {
+			t.Errorf("Expected status %d for %s from %s, got %d", test.status, test.query, test.remoteAddr, response.Code)
+		}
+	}
+}
+
+// Points --config to a file with the content and resets the flags of the file after the test
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := t.TempDir() + "/config.yaml"
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConfigFile = path
+	t.Cleanup(func() {
+		os.WriteFile(path, nil, 0o600)
+		reloadConfig()
+		config.ConfigFile = ""
+	})
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	newTestClient(t)
+	// service-per-pod can't be combined with ServiceLB, but it is restart only and not applied anyway
+	writeTestConfig(t, "service-per-pod: true\nk3s-servicelb: true\nexclude-namespaces: [kube-system]\n")
+	err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServicePerPod || !config.K3sServiceLB || !isNamespaceExcluded("kube-system") {
+		t.Errorf("Expected only the reloadable flags to change, got service-per-pod %t, k3s-servicelb %t", config.ServicePerPod, config.K3sServiceLB)
+	}
+}
+
+func TestReloadConfigWhileReading(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	path := writeTestConfig(t, "")
+	stop := make(chan struct{})
+	handler := newWhoamiHandler(client, startWhoamiInformers(client, []string{testNamespace}, stop))
+
+	var readers sync.WaitGroup
+	for _, read := range []func(){
+		func() { updateCapacityMetrics(client, []string{testNamespace}) },
+		func() { stampLastReconciled(client, []string{testNamespace}, time.Now()) },
+		func() {
+			request := httptest.NewRequest(http.MethodGet, "/whoami?namespace=default&name=game-0", nil)
+			request.RemoteAddr = "10.1.0.5:41234"
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+		},
+	} {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+
+	configs := []string{
+		"node-address-preference: InternalIP\nexclude-namespaces: [kube-system]\nallowed-ports: 1-30000\nnodeport-pools: 31000-31009\n",
+		"node-address-preference: ExternalIP\ndenied-ports: [22]\nnodeport-pools: 31000-31019\n",
+	}
+	for i := 0; i < 20; i++ {
+		err := os.WriteFile(path, []byte(configs[i%len(configs)]), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = reloadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	readers.Wait()
+}
+
+func TestControllerRun(t *testing.T) {
+	pod := newTestPod("game-0", "8080", nil)
+	client := newTestClient(t, pod)
+	t.Cleanup(func() {
+		recorder = &record.FakeRecorder{}
+		configMutex.Lock()
+		resetConfig()
+		configMutex.Unlock()
+	})
+	path := t.TempDir() + "/config.yaml"
+	err := os.WriteFile(path, []byte("port-labels: true\nset-external-ips: true\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runConfig := DefaultConfig()
+	runConfig.Namespace = testNamespace
+	runConfig.MetricsAddress = ""
+	runConfig.ConfigFile = path
+	runConfig.SetExternalIps = false
+	runConfig.ServiceLabelTemplates = map[string]string{"node-port": "{{ .NodePort }}"}
+	controller, err := New(client, runConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The controller can be run again once it stopped, the second run handles a new pod
+	for run, pod := range []*v1.Pod{pod, newTestPod("game-1", "8080", nil)} {
+		// The names depend on the config, which the controller sets while it starts
+		serviceName := podPortToServiceName(pod, PortRequest{Port: 8080, Protocol: v1.ProtocolTCP})
+		if run > 0 {
+			_, err := client.CoreV1().Pods(testNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- controller.Run(ctx) }()
+
+		var service *v1.Service
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			service, err = client.CoreV1().Services(testNamespace).Get(context.Background(), serviceName, metav1.GetOptions{})
+			if err == nil && service.Labels["node-port"] != "" {
+				break
+			}
+		}
+		if err != nil || service.Labels["node-port"] != strconv.Itoa(int(service.Spec.Ports[0].NodePort)) {
+			t.Fatalf("Expected the service with the templated label in run %d, got %v %v", run, service, err)
+		}
+		configMutex.RLock()
+		portLabels, setExternalIps := config.PortLabels, config.SetExternalIps
+		configMutex.RUnlock()
+		if !portLabels || setExternalIps {
+			t.Errorf("Expected the config file to only set the fields left at their defaults, got port-labels %t, set-external-ips %t", portLabels, setExternalIps)
+		}
+		if err := controller.Run(context.Background()); err == nil {
+			t.Error("Expected a second controller to be rejected while the first one runs")
+		}
+
+		stop()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected Run to return once the context is done")
+		}
+	}
+	if runConfig.ServiceLabelTemplates["node-port"] != "{{ .NodePort }}" || len(runConfig.ServiceLabelTemplates) != 1 {
+		t.Errorf("Expected the config of the caller to be left alone, got %v", runConfig.ServiceLabelTemplates)
+	}
+
+	_, err = New(client, Config{ClusterSecretSelector: "cluster.x-k8s.io/cluster-name"})
+	if err == nil {
+		t.Error("Expected the multi-cluster mode to be rejected")
+	}
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+// Client of the hub cluster, nil if the node ports are not coordinated
+var coordinationClient kubernetes.Interface
+
+type errNodePortReserved struct {
+	nodePort int32
+	owner    string
+}
+
+func (err errNodePortReserved) Error() string {
+	return "Node port " + strconv.Itoa(int(err.nodePort)) + " is reserved by '" + err.owner + "'"
+}
+
+func isNodePortReservedError(err error) bool {
+	var reserved errNodePortReserved
+	return errors.As(err, &reserved)
+}
+
+func createCoordinationClient(client kubernetes.Interface) (kubernetes.Interface, error) {
+	if config.CoordinationConfigMap == "" {
+		return nil, nil
+	}
+	if config.ClusterId == "" {
+		return nil, errors.New("The node port coordination requires a --cluster-id")
+	}
+	if config.CoordinationKubeconfig == "" {
+		return client, nil
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags("", config.CoordinationKubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	instrumentConfig(restConfig)
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// The ConfigMap maps node port => CLUSTER:NAMESPACE/NAME of the service that uses it
+func coordinationOwner(serviceKey string) string {
+	return config.ClusterId + ":" + serviceKey
+}
+
+// Returns the cluster and the service key of the owner. The service key never contains a ':'
+func splitCoordinationOwner(owner string) (string, string) {
+	i := strings.LastIndex(owner, ":")
+	if i < 0 {
+		return "", owner
+	}
+	return owner[:i], owner[i+1:]
+}
+
+// Applies the change to the data of the coordination ConfigMap, which is created if it doesn't exist yet
+func updateCoordinationConfigMap(change func(data map[string]string) (bool, error)) error {
+	namespace, name := splitNamespacedName(config.CoordinationConfigMap)
+	configMaps := coordinationClient.CoreV1().ConfigMaps(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(context.Background(), name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			data := map[string]string{}
+			if _, err := change(data); err != nil {
+				return err
+			}
+			_, err = configMaps.Create(context.Background(), &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+					Labels: map[string]string{
+						managedByLabelKey: managedByLabelValue,
+					},
+				},
+				Data: data,
+			}, metav1.CreateOptions{})
+			if k8sErrors.IsAlreadyExists(err) {
+				// Created by another cluster in the meantime
+				return k8sErrors.NewConflict(v1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		changed, err := change(configMap.Data)
+		if err != nil || !changed {
+			return err
+		}
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Reserves the node port for the service across all clusters. Returns errNodePortReserved if another cluster uses it.
+func reserveGlobalNodePort(nodePort int32, serviceKey string) error {
+	if coordinationClient == nil {
+		return nil
+	}
+	owner := coordinationOwner(serviceKey)
+	return updateCoordinationConfigMap(func(data map[string]string) (bool, error) {
+		key := strconv.Itoa(int(nodePort))
+		if current, ok := data[key]; ok {
+			if current == owner {
+				return false, nil
+			}
+			return false, errNodePortReserved{nodePort: nodePort, owner: current}
+		}
+		data[key] = owner
+		return true, nil
+	})
+}
+
+// Releases all node ports of the service. Errors are only logged, a leaked reservation is removed by the next sync.
+func releaseGlobalNodePorts(serviceKey string) {
+	if coordinationClient == nil {
+		return
+	}
+	owner := coordinationOwner(serviceKey)
+	err := updateCoordinationConfigMap(func(data map[string]string) (bool, error) {
+		changed := false
+		for nodePort, current := range data {
+			if current == owner {
+				delete(data, nodePort)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+	if err != nil {
+		logErr.Printf("Failed to release the node ports of service '%s' in the coordination ConfigMap %s", serviceKey, err)
+	}
+}
+
+// Releases a single node port of the service, errors are only logged like for releaseGlobalNodePorts
+func releaseGlobalNodePort(nodePort int32, serviceKey string) {
+	if coordinationClient == nil {
+		return
+	}
+	owner := coordinationOwner(serviceKey)
+	err := updateCoordinationConfigMap(func(data map[string]string) (bool, error) {
+		key := strconv.Itoa(int(nodePort))
+		if data[key] != owner {
+			return false, nil
+		}
+		delete(data, key)
+		return true, nil
+	})
+	if err != nil {
+		logErr.Printf("Failed to release node port %d of service '%s' in the coordination ConfigMap %s", nodePort, serviceKey, err)
+	}
+}
+
+// Reserves the node ports of all managed services of the namespace and removes the reservations of this cluster
+// whose service doesn't exist anymore. Node ports that are reserved by other clusters are marked as used in the pool.
+func syncGlobalNodePorts(client kubernetes.Interface, namespace string) error {
+	if coordinationClient == nil {
+		return nil
+	}
+	services, err := client.CoreV1().Services(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: managedByLabelKey + "=" + managedByLabelValue,
+	})
+	if err != nil {
+		return err
+	}
+	owners := make(map[string]string)
+	for _, service := range services.Items {
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 {
+				owners[strconv.Itoa(int(port.NodePort))] = coordinationOwner(allocator.ServiceKey(service.Namespace, service.Name))
+			}
+		}
+	}
+
+	return updateCoordinationConfigMap(func(data map[string]string) (bool, error) {
+		changed := false
+		for nodePort, current := range data {
+			cluster, serviceKey := splitCoordinationOwner(current)
+			if cluster != config.ClusterId {
+				if port, err := strconv.Atoi(nodePort); err == nil && nodePortAllocator != nil {
+					nodePortAllocator.MarkUsed(int32(port), current)
+				}
+				continue
+			}
+			serviceNamespace, _ := splitNamespacedName(serviceKey)
+			if owners[nodePort] != current && (namespace == "" || namespace == serviceNamespace) {
+				delete(data, nodePort)
+				changed = true
+			}
+		}
+		for nodePort, owner := range owners {
+			if current, ok := data[nodePort]; !ok {
+				data[nodePort] = owner
+				changed = true
+			} else if current != owner {
+				logErr.Printf("Node port %s of service '%s' is also reserved by '%s'", nodePort, owner, current)
+			}
+		}
+		return changed, nil
+	})
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// A pod that keeps changing is still reconciled after this many debounce intervals
+const maxDebounceIntervals = 10
+
+type podEvent struct {
+	eventType watch.EventType
+	pod       *v1.Pod
+}
+
+type pendingPodEvent struct {
+	event podEvent
+	first time.Time
+	timer *time.Timer
+}
+
+// Coalesces bursts of events of the same pod (e.g. the status updates during the startup), only the latest one is
+// handled once no other event came within the debounce interval
+type podDebouncer struct {
+	delay   time.Duration
+	channel chan podEvent
+	mutex   sync.Mutex
+	pending map[types.NamespacedName]*pendingPodEvent
+}
+
+func newPodDebouncer(delay time.Duration) *podDebouncer {
+	return &podDebouncer{
+		delay:   delay,
+		channel: make(chan podEvent),
+		pending: make(map[types.NamespacedName]*pendingPodEvent),
+	}
+}
+
+func (debouncer *podDebouncer) add(eventType watch.EventType, pod *v1.Pod) {
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+
+	if pending, ok := debouncer.pending[key]; ok {
+		pending.event = podEvent{eventType: eventType, pod: pod}
+		if time.Since(pending.first)+debouncer.delay < maxDebounceIntervals*debouncer.delay {
+			pending.timer.Reset(debouncer.delay)
+		}
+		return
+	}
+	pending := &pendingPodEvent{event: podEvent{eventType: eventType, pod: pod}, first: time.Now()}
+	pending.timer = time.AfterFunc(debouncer.delay, func() {
+		debouncer.mutex.Lock()
+		current, ok := debouncer.pending[key]
+		// A reset timer might fire again after the event was already sent
+		if !ok || current != pending {
+			debouncer.mutex.Unlock()
+			return
+		}
+		delete(debouncer.pending, key)
+		event := current.event
+		debouncer.mutex.Unlock()
+		debouncer.channel <- event
+	})
+	debouncer.pending[key] = pending
+}
+
+// Drops the pending event of the pod, e.g. because it was deleted in the meantime
+func (debouncer *podDebouncer) drop(pod *v1.Pod) {
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	if pending, ok := debouncer.pending[key]; ok {
+		pending.timer.Stop()
+		delete(debouncer.pending, key)
+	}
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// How long /debug/state waits for the pod loop, which answers in between two events
+const debugStateTimeout = 5 * time.Second
+
+// Receives the requests of /debug/state, the pod loop sends its state to the reply channel
+var debugStateRequests = make(chan chan debugState)
+
+func (state podState) String() string {
+	switch state {
+	case podStateNew:
+		return "new"
+	case podStatePreAllocated:
+		return "preAllocated"
+	case podStateHandled:
+		return "handled"
+	case podStateLeaseExpired:
+		return "leaseExpired"
+	}
+	return "unknown"
+}
+
+// The result of the last reconcile of a pod
+type podReconcileStatus struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+type debugQueueState struct {
+	Deletions  []string `json:"deletions"`
+	Others     []string `json:"others"`
+	Debouncing []string `json:"debouncing"`
+}
+
+// The in-memory state of the pod loop, keyed by namespace/name
+type debugState struct {
+	HandledPods map[string]string             `json:"handledPods"`
+	NodeIPCache map[string][]string           `json:"nodeIpCache"`
+	Queue       debugQueueState               `json:"queue"`
+	Retries     map[string]string             `json:"retries"`
+	Pods        map[string]podReconcileStatus `json:"pods"`
+}
+
+// Keeps the results of the last reconciles, pods that were deleted successfully are forgotten
+type podReconcileStatuses map[string]podReconcileStatus
+
+func (statuses podReconcileStatuses) record(eventType watch.EventType, pod *v1.Pod, err error) {
+	key := pod.Namespace + "/" + pod.Name
+	if eventType == watch.Deleted && err == nil {
+		delete(statuses, key)
+		return
+	}
+	status := podReconcileStatus{Event: string(eventType), Time: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	statuses[key] = status
+}
+
+// Copies the state, it must be called from the pod loop
+func newDebugState(handledPods map[string]podState, cachedExternalIPs map[string][]string, events *podEventQueue, debouncer *podDebouncer, retries *podRetries, statuses podReconcileStatuses) debugState {
+	state := debugState{
+		HandledPods: make(map[string]string),
+		NodeIPCache: make(map[string][]string),
+		Queue:       events.keys(),
+		Retries:     make(map[string]string),
+		Pods:        make(map[string]podReconcileStatus),
+	}
+	for key, podState := range handledPods {
+		state.HandledPods[key] = podState.String()
+	}
+	for key, ips := range cachedExternalIPs {
+		state.NodeIPCache[key] = ips
+	}
+	state.Queue.Debouncing = debouncer.keys()
+	for key, delay := range retries.delays {
+		state.Retries[key.String()] = delay.String()
+	}
+	for key, status := range statuses {
+		state.Pods[key] = status
+	}
+	return state
+}
+
+// Returns the pods with queued events in the order they are handled
+func (queue *podEventQueue) keys() debugQueueState {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	state := debugQueueState{Deletions: []string{}, Others: []string{}}
+	for _, event := range queue.deletions {
+		if pod, ok := event.Object.(*v1.Pod); ok {
+			state.Deletions = append(state.Deletions, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	for _, event := range queue.others {
+		if pod, ok := event.Object.(*v1.Pod); ok {
+			state.Others = append(state.Others, pod.Namespace+"/"+pod.Name)
+		}
+	}
+	return state
+}
+
+func (debouncer *podDebouncer) keys() []string {
+	debouncer.mutex.Lock()
+	defer debouncer.mutex.Unlock()
+	keys := []string{}
+	for key := range debouncer.pending {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serveDebugState(writer http.ResponseWriter, request *http.Request) {
+	reply := make(chan debugState, 1)
+	select {
+	case debugStateRequests <- reply:
+	case <-time.After(debugStateTimeout):
+		http.Error(writer, "The pod loop did not answer, it is busy or not running", http.StatusServiceUnavailable)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(<-reply)
+}
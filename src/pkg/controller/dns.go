@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+func validateDnsPublisher() error {
+	if config.DnsEtcdEndpoint == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(config.DnsZone); len(errs) > 0 {
+		return errors.New("Invalid DNS zone '" + config.DnsZone + "' (--dns-zone is required with --dns-etcd-endpoint) " + strings.Join(errs, ", "))
+	}
+	if config.DnsTtl <= 0 {
+		return errors.New("Invalid DNS ttl '" + strconv.Itoa(config.DnsTtl) + "'")
+	}
+	return nil
+}
+
+// A record in the format of SkyDNS, which CoreDNS answers A/AAAA queries with the host and SRV queries with the host
+// and port for.
+type dnsRecord struct {
+	Host string `json:"host"`
+	Port int32  `json:"port"`
+	TTL  int    `json:"ttl"`
+}
+
+// The records of the published pods, so unchanged records are not written again on every event
+var publishedRecords = make(map[string]string)
+var publishedRecordsMutex sync.Mutex
+
+// Returns the etcd key of the DNS name, e.g. '/skydns/com/example/game-0' for 'game-0.example.com'
+func dnsKey(name string) string {
+	labels := strings.Split(name, ".")
+	slices.Reverse(labels)
+	return strings.TrimSuffix(config.DnsEtcdPrefix, "/") + "/" + strings.Join(labels, "/")
+}
+
+// The name of the pod, its SRV records are _PORT._PROTOCOL.POD.NAMESPACE.ZONE
+func podDnsName(pod *v1.Pod) string {
+	return pod.Name + "." + pod.Namespace + "." + config.DnsZone
+}
+
+// Returns the records of the allocated ports of the pod by etcd key. Every advertised ip gets its own record per port.
+func podDnsRecords(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) (map[string]dnsRecord, error) {
+	services, err := listPodServices(client, pod)
+	if err != nil {
+		return nil, err
+	}
+	ips := nodeaddr.IPs(getPodExternalIps(client, pod, cachedExternalIPs))
+
+	records := make(map[string]dnsRecord)
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !isServiceOfPod(service, pod) || isHeadlessService(service) {
+			continue
+		}
+		for _, port := range service.Spec.Ports {
+			requestedPort := servicePortRequest(port)
+			name := "_" + strconv.Itoa(int(requestedPort.Port)) + "._" + strings.ToLower(string(requestedPort.Protocol)) + "." + podDnsName(pod)
+			for i, ip := range ips {
+				records[dnsKey(name)+"/x"+strconv.Itoa(i+1)] = dnsRecord{Host: ip, Port: port.NodePort, TTL: config.DnsTtl}
+			}
+		}
+	}
+	return records, nil
+}
+
+// Replaces the DNS records of the pod with the ones of its current allocations
+func publishPodRecords(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) error {
+	if config.DnsEtcdEndpoint == "" {
+		return nil
+	}
+	records, err := podDnsRecords(client, pod, cachedExternalIPs)
+	if err != nil {
+		return err
+	}
+	return writePodRecords(pod, records)
+}
+
+// Removes all DNS records of the pod
+func deletePodRecords(pod *v1.Pod) error {
+	if config.DnsEtcdEndpoint == "" {
+		return nil
+	}
+	return writePodRecords(pod, nil)
+}
+
+func writePodRecords(pod *v1.Pod, records map[string]dnsRecord) error {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var fingerprint strings.Builder
+	for _, key := range keys {
+		fingerprint.WriteString(key + "=" + records[key].Host + ":" + strconv.Itoa(int(records[key].Port)) + ";")
+	}
+
+	podKey := pod.Namespace + "/" + pod.Name
+	publishedRecordsMutex.Lock()
+	defer publishedRecordsMutex.Unlock()
+	if published, ok := publishedRecords[podKey]; ok && published == fingerprint.String() {
+		return nil
+	}
+
+	// The old records are deleted and the new ones are written in one transaction, so a lookup never sees a mix.
+	// Only the SRV names are deleted, a pod name with dots would have the records of another pod below its name.
+	prefix := dnsKey(podDnsName(pod)) + "/_"
+	operations := []map[string]interface{}{
+		{"request_delete_range": map[string]string{"key": etcdBytes(prefix), "range_end": etcdBytes(etcdPrefixEnd(prefix))}},
+	}
+	for _, key := range keys {
+		value, err := json.Marshal(records[key])
+		if err != nil {
+			return err
+		}
+		operations = append(operations, map[string]interface{}{
+			"request_put": map[string]string{"key": etcdBytes(key), "value": etcdBytes(string(value))},
+		})
+	}
+	err := etcdRequest("/v3/kv/txn", map[string]interface{}{"success": operations})
+	if err != nil {
+		delete(publishedRecords, podKey)
+		return err
+	}
+	if len(records) == 0 {
+		delete(publishedRecords, podKey)
+	} else {
+		publishedRecords[podKey] = fingerprint.String()
+	}
+	if len(records) > 0 {
+		log.Printf("[%s] Published %d DNS records of %s", pod.Name, len(records), podDnsName(pod))
+	}
+	return nil
+}
+
+// The etcd JSON gateway expects keys and values base64 encoded
+func etcdBytes(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// Returns the end of the key range that contains all keys with the prefix
+func etcdPrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+var dnsEtcdClient = &http.Client{}
+
+// Sends the request to the JSON gateway of etcd
+func etcdRequest(path string, request interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.DnsTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(config.DnsEtcdEndpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := dnsEtcdClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return errors.New("Unexpected status " + strconv.Itoa(httpResponse.StatusCode) + " of etcd")
+	}
+	return nil
+}
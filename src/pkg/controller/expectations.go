@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The uids of deleted pods are remembered this long, late events of them are dropped in the meantime
+const podTombstoneTtl = 10 * time.Minute
+
+// Tracks the incarnations of the pods by their uid, similar to the expectations of the ReplicaSet controller. A pod
+// that is deleted and recreated with the same name (e.g. by a StatefulSet) must neither lose its services to a late
+// event of the previous incarnation nor inherit its state.
+type podIncarnations struct {
+	// Pod => uid of its latest incarnation
+	current map[types.NamespacedName]types.UID
+	// Uid of a deleted pod => time of the deletion
+	deleted map[types.UID]time.Time
+}
+
+func newPodIncarnations() *podIncarnations {
+	return &podIncarnations{
+		current: make(map[types.NamespacedName]types.UID),
+		deleted: make(map[types.UID]time.Time),
+	}
+}
+
+// Returns false if the event belongs to an incarnation that was already deleted, e.g. a debounced update or a retry
+// that was on its way while the pod was deleted. The previous uid is returned if the pod was replaced by a new
+// incarnation without its deletion being observed.
+func (incarnations *podIncarnations) observe(eventType watch.EventType, pod *v1.Pod) (bool, types.UID) {
+	if pod.UID == "" {
+		return true, ""
+	}
+	if _, ok := incarnations.deleted[pod.UID]; ok {
+		return false, ""
+	}
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	previous := incarnations.current[key]
+
+	if eventType == watch.Deleted {
+		for uid, deletedAt := range incarnations.deleted {
+			if time.Since(deletedAt) > podTombstoneTtl {
+				delete(incarnations.deleted, uid)
+			}
+		}
+		incarnations.deleted[pod.UID] = time.Now()
+		if previous == pod.UID {
+			delete(incarnations.current, key)
+		}
+		return true, ""
+	}
+
+	incarnations.current[key] = pod.UID
+	if previous != "" && previous != pod.UID {
+		return true, previous
+	}
+	return true, ""
+}
+
+// Deletes the services that a previous incarnation of the pod left behind, they would block the new ones
+func deletePreviousIncarnationServices(client kubernetes.Interface, pod *v1.Pod) error {
+	services, err := listManagedServices(client, pod.Namespace, forPodLabelKey+"="+pod.Name+","+podUidLabelKey+"!="+string(pod.UID))
+	if err != nil {
+		return err
+	}
+	for _, service := range services.Items {
+		if _, ok := service.Labels[podUidLabelKey]; !ok {
+			// Created by an older version, it can't be told apart from the current incarnation
+			continue
+		}
+		log.Printf("[%s] Deleting service %s of the previous incarnation.", pod.Name, service.Name)
+		err := deleteService(client, service.Namespace, service.Name)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package controller
+
+import (
+	"flag"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Config is the configuration of the controller. Every field is set by the flag of the command in its comment, see
+// the help of the command or the README for what it does. Start from DefaultConfig, the zero value is not valid.
+type Config struct {
+	// The connection to the api server, only used by the commands. New is given the client instead
+	Kubeconfig string // --kubeconfig
+	Context    string // --context
+	As         string // --as
+	AsGroups   string // --as-group
+	AsUid      string // --as-uid
+
+	// The YAML config file, it sets the fields that are left at their defaults and is reloaded on changes
+	ConfigFile string // --config
+
+	// The managed pods
+	LabelKey          string // --label-key
+	AnnotationPrefix  string // --annotation-prefix
+	PodSelector       string // --pod-selector
+	Namespace         string // --namespace
+	Namespaces        string // --namespaces
+	ExcludeNamespaces string // --exclude-namespaces
+	NamespaceOptIn    bool   // --namespace-opt-in
+	Tenant            string // --tenant
+	NamespacedRbac    bool   // --namespaced-rbac
+	NodeIpsConfigMap  string // --node-ips-configmap
+	ServiceNamespace  string // --service-namespace
+	HostNetworkPods   string // --host-network-pods
+	RequireReady      bool   // --require-ready
+	PreAllocate       bool   // --pre-allocate
+	DefaultProtocol   string // --default-protocol
+
+	// The generated services and endpoints
+	ServicePerPod              bool              // --service-per-pod
+	ServiceType                string            // --service-type
+	K3sServiceLB               bool              // --k3s-servicelb
+	HeadlessService            bool              // --headless-service
+	ClusterDomain              string            // --cluster-domain
+	IpFamilyPolicy             string            // --ip-family-policy
+	IpFamilies                 string            // --ip-families
+	ExternalTrafficPolicy      string            // --external-traffic-policy
+	InternalTrafficPolicy      string            // --internal-traffic-policy
+	SessionAffinity            string            // --session-affinity
+	SessionAffinityTimeout     int               // --session-affinity-timeout
+	PublishNotReadyAddresses   bool              // --publish-not-ready-addresses
+	SetExternalIps             bool              // --set-external-ips
+	PropagateLabels            string            // --propagate-labels
+	PropagateAnnotations       string            // --propagate-annotations
+	ServicePortName            string            // --service-port-name
+	ServiceLabelTemplates      map[string]string // --service-label-template, KEY=TEMPLATE
+	ServiceAnnotationTemplates map[string]string // --service-annotation-template, KEY=TEMPLATE
+
+	// The advertised node addresses
+	NodeAddressPreference string // --node-address-preference
+	PreferredAddressCidrs string // --preferred-address-cidrs
+	AdvertiseAllNodeIps   bool   // --advertise-all-node-ips
+	AdvertiseNodeNames    string // --advertise-node-names
+	VirtualIps            string // --virtual-ips
+	VirtualIpsService     string // --virtual-ips-service
+	VirtualIpsConfigMap   string // --virtual-ips-configmap
+
+	// The node port allocation
+	AllocationStrategy     string        // --allocation-strategy
+	NodePortPools          string        // --nodeport-pools
+	ClusterNodePortRange   string        // --cluster-nodeport-range
+	NamespaceQuotas        string        // --namespace-quotas
+	DefaultNamespaceQuota  int           // --default-namespace-quota
+	AllowedPorts           string        // --allowed-ports
+	DeniedPorts            string        // --denied-ports
+	PortGroupsConfigMap    string        // --port-groups-configmap
+	PolicyHookUrl          string        // --policy-hook-url
+	PolicyHookTimeout      time.Duration // --policy-hook-timeout
+	LeaseTtl               time.Duration // --lease-ttl
+	CoordinationConfigMap  string        // --coordination-configmap
+	CoordinationKubeconfig string        // --coordination-kubeconfig
+	ClusterId              string        // --cluster-id
+
+	// What is published for the pods
+	PortLabels             bool          // --port-labels
+	PodCondition           bool          // --pod-condition
+	WorkloadAnnotation     bool          // --workload-annotation
+	DiscoveryConfigMaps    bool          // --discovery-configmaps
+	LastReconciledInterval time.Duration // --last-reconciled-interval
+	DnsEtcdEndpoint        string        // --dns-etcd-endpoint
+	DnsEtcdPrefix          string        // --dns-etcd-prefix
+	DnsZone                string        // --dns-zone
+	DnsTtl                 int           // --dns-ttl
+	DnsTimeout             time.Duration // --dns-timeout
+	WhoamiAddress          string        // --whoami-address
+	WhoamiSourceIpAuth     bool          // --whoami-source-ip-auth
+
+	// The http endpoints of the metrics
+	MetricsAddress   string // --metrics-address
+	HttpAuth         string // --http-auth
+	HttpTlsCertFile  string // --http-tls-cert-file
+	HttpTlsKeyFile   string // --http-tls-key-file
+	HttpClientCaFile string // --http-client-ca-file
+
+	// The pod loop
+	EventDebounce     time.Duration // --event-debounce
+	WatchdogTimeout   time.Duration // --watchdog-timeout
+	CleanupOnShutdown bool          // --cleanup-on-shutdown
+
+	// The admission webhook of the webhook command
+	HostPortRanges  string // --hostport-ranges
+	WebhookAddress  string // --webhook-address
+	WebhookCertFile string // --webhook-cert-file
+	WebhookKeyFile  string // --webhook-key-file
+
+	// The relay command
+	RelayGatewaySelector string // --relay-gateway-selector
+
+	// The multi-cluster mode, only available with Main
+	ClusterSecretSelector   string // --cluster-secret-selector
+	ClusterSecretsNamespace string // --cluster-secrets-namespace
+	ClusterSecretKey        string // --cluster-secret-key
+}
+
+// The active config. Once the controller runs it is only changed under the configMutex.
+var config Config
+
+// The flags of the active config. The environment variables, the config file and the reloads set the flags by name.
+var configFlags = newConfigFlags()
+
+// Returns new flags of the active config, which is reset to the defaults
+func newConfigFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("k8s-dynamic-hostport", flag.ContinueOnError)
+	config.addFlags(flags)
+	return flags
+}
+
+// Resets the active config to the defaults and forgets where the flags were set
+func resetConfig() {
+	configFlags = newConfigFlags()
+	explicitFlags = map[string]bool{}
+	configFileFlags = map[string]bool{}
+	nodePortAllocator = nil
+	parsedNodePortPools = ""
+}
+
+// DefaultConfig returns the config with the defaults of the flags
+func DefaultConfig() Config {
+	var config Config
+	config.addFlags(flag.NewFlagSet("defaults", flag.ContinueOnError))
+	return config
+}
+
+// Binds the fields to the flags of the command and sets them to their defaults
+func (config *Config) addFlags(flags *flag.FlagSet) {
+	flags.StringVar(&config.Kubeconfig, "kubeconfig", defaultKubeconfig(), "(optional) absolute path to the kubeconfig file (only used outside of a cluster)")
+	flags.StringVar(&config.Context, "context", "", "(optional) the kubeconfig context to use")
+	flags.StringVar(&config.As, "as", "", "Username to impersonate")
+	flags.StringVar(&config.AsGroups, "as-group", "", "Comma separated groups to impersonate")
+	flags.StringVar(&config.AsUid, "as-uid", "", "UID to impersonate")
+	flags.StringVar(&config.ConfigFile, "config", "", "(optional) path to a YAML config file. Its keys are the flag names, flags on the command line and environment variables take precedence")
+	flags.StringVar(&config.LabelKey, "label-key", annotations.DefaultLabelKey, "The label key of the pods that should be managed")
+	flags.StringVar(&config.AnnotationPrefix, "annotation-prefix", annotations.DefaultPrefix, "The prefix of all annotations and labels (e.g. hostports.example.com). Has to differ between multiple instances in one cluster")
+	flags.StringVar(&config.PodSelector, "pod-selector", "", "Additional label selector (e.g. team=gameops,env=prod) of the pods that should be managed")
+	flags.StringVar(&config.Namespace, "namespace", "", "The namespace that this should apply to (can also be set via KUBERNETES_NAMESPACE environment variable)")
+	flags.StringVar(&config.Namespaces, "namespaces", "", "Comma separated namespaces that this should apply to, each of them is watched separately. Takes precedence over --namespace")
+	flags.StringVar(&config.ExcludeNamespaces, "exclude-namespaces", "", "Comma separated namespaces (e.g. kube-system,monitoring) whose pods and services are never touched")
+	flags.BoolVar(&config.NamespaceOptIn, "namespace-opt-in", false, "Only manage pods in namespaces that have the '<annotation-prefix>/enabled=true' label")
+	flags.StringVar(&config.Tenant, "tenant", "", "(optional) the tenant this instance is bound to. Only pods whose namespace or ServiceAccount has the '<annotation-prefix>/tenant' label with this value are managed, and services of other tenants are never touched")
+	flags.BoolVar(&config.NamespacedRbac, "namespaced-rbac", false, "Only use namespaced permissions (a Role per watched namespace), e.g. to run an own instance per tenant. The nodes are never fetched and labels and annotations of the namespaces are ignored")
+	flags.StringVar(&config.NodeIpsConfigMap, "node-ips-configmap", "", "(optional) NAMESPACE/NAME of a ConfigMap with the comma separated ips that are advertised for every node (NODE: IPS), used instead of the host ip of the pod in the namespaced rbac mode")
+	flags.StringVar(&config.ServiceNamespace, "service-namespace", "", "(optional) namespace (e.g. dynamic-hostports-system) the services and endpoints of all pods are created in instead of the namespace of the pod")
+	flags.StringVar(&config.HostNetworkPods, "host-network-pods", hostNetworkPodsAnnotate, "How pods with hostNetwork are handled, their ports are already bound on the node: 'annotate' advertises NODEIP:PORT without a service, 'skip' ignores them and 'service' creates node port services like for other pods")
+	flags.BoolVar(&config.RequireReady, "require-ready", false, "Wait until the pod is ready (instead of running) before its services are created")
+	flags.BoolVar(&config.PreAllocate, "pre-allocate", false, "Create the services as soon as the pod is scheduled. The endpoints are added once the pod is running")
+	flags.StringVar(&config.DefaultProtocol, "default-protocol", string(v1.ProtocolTCP), "The protocol of ports without an explicit protocol (TCP, UDP or SCTP)")
+	flags.BoolVar(&config.ServicePerPod, "service-per-pod", false, "Create one multi-port service (and endpoints) per pod carrying all its ports instead of one service per port")
+	flags.StringVar(&config.ServiceType, "service-type", string(v1.ServiceTypeNodePort), "The type of the generated services (NodePort or LoadBalancer)")
+	flags.BoolVar(&config.K3sServiceLB, "k3s-servicelb", false, "Create LoadBalancer services that are exposed by the ServiceLB (klipper-lb) of k3s instead of NodePort services with external ips")
+	flags.BoolVar(&config.HeadlessService, "headless-service", false, "Also create a headless service per pod, so in-cluster clients get a stable DNS name for it. StatefulSet pods reuse their governing service")
+	flags.StringVar(&config.ClusterDomain, "cluster-domain", "cluster.local", "The DNS domain of the cluster, used for the cluster DNS name of the pods")
+	flags.StringVar(&config.IpFamilyPolicy, "ip-family-policy", "", "The ipFamilyPolicy of the generated services (SingleStack, PreferDualStack or RequireDualStack). Defaults to PreferDualStack for dual-stack nodes")
+	flags.StringVar(&config.IpFamilies, "ip-families", "", "Comma separated ipFamilies of the generated services (IPv4, IPv6)")
+	flags.StringVar(&config.ExternalTrafficPolicy, "external-traffic-policy", "", "The externalTrafficPolicy of the generated services (Cluster or Local). Local preserves the client source ip")
+	flags.StringVar(&config.InternalTrafficPolicy, "internal-traffic-policy", "", "The internalTrafficPolicy of the generated services (Cluster or Local)")
+	flags.StringVar(&config.SessionAffinity, "session-affinity", "", "The sessionAffinity of the generated services (None or ClientIP)")
+	flags.IntVar(&config.SessionAffinityTimeout, "session-affinity-timeout", 0, "The ClientIP session affinity timeout in seconds (0 uses the Kubernetes default)")
+	flags.BoolVar(&config.PublishNotReadyAddresses, "publish-not-ready-addresses", false, "Set publishNotReadyAddresses on the generated services, so they are routable even if the pod is not ready")
+	flags.BoolVar(&config.SetExternalIps, "set-external-ips", true, "Limit the services to the advertised ips with externalIPs. If disabled the services are plain node ports and the ips are only advertised in the annotations")
+	flags.StringVar(&config.PropagateLabels, "propagate-labels", "", "Regex of pod label keys (e.g. ^(team|app)$) that are copied to the generated services and endpoints")
+	flags.StringVar(&config.PropagateAnnotations, "propagate-annotations", "", "Regex of pod annotation keys that are copied to the generated services and endpoints")
+	flags.StringVar(&config.ServicePortName, "service-port-name", "{{ lower .Protocol }}-{{ .Port }}", "Go template of the port name of the generated services and endpoints, e.g. 'udp-7777' for the protocol detection of service meshes. Empty leaves the ports unnamed")
+	flags.Var(templatesValue{&config.ServiceLabelTemplates}, "service-label-template", "KEY=TEMPLATE of a label that is added to the generated services (can be repeated)")
+	flags.Var(templatesValue{&config.ServiceAnnotationTemplates}, "service-annotation-template", "KEY=TEMPLATE of an annotation that is added to the generated services (can be repeated)")
+	flags.StringVar(&config.NodeAddressPreference, "node-address-preference", "ExternalIP,InternalIP", "Comma separated, ordered list of node address types (ExternalIP, ExternalDNS, InternalIP, InternalDNS, Hostname). The first type the node has is advertised")
+	flags.StringVar(&config.PreferredAddressCidrs, "preferred-address-cidrs", "", "Comma separated, ordered list of cidrs. Node addresses inside an earlier cidr are preferred")
+	flags.BoolVar(&config.AdvertiseAllNodeIps, "advertise-all-node-ips", false, "Advertise all matching addresses of a node instead of only the first one")
+	flags.StringVar(&config.AdvertiseNodeNames, "advertise-node-names", "", "Comma separated, ordered list of node address types (ExternalDNS, InternalDNS, Hostname). If the node has one of them, its name is advertised in the endpoint annotations instead of its ip")
+	flags.StringVar(&config.VirtualIps, "virtual-ips", "", "(optional) comma separated virtual ips (e.g. of kube-vip) that are advertised instead of the address of the pod's node")
+	flags.StringVar(&config.VirtualIpsService, "virtual-ips-service", "", "(optional) NAMESPACE/NAME of a LoadBalancer service whose ingress ips are advertised instead of the address of the pod's node")
+	flags.StringVar(&config.VirtualIpsConfigMap, "virtual-ips-configmap", "", "(optional) NAMESPACE/NAME of a ConfigMap with the comma separated ips (key 'ips') that are advertised instead of the address of the pod's node")
+	flags.StringVar(&config.AllocationStrategy, "allocation-strategy", "", "How node ports are chosen (apiserver, sequential, random-from-pool or sticky). Defaults to sequential if node port pools are set, otherwise apiserver")
+	flags.StringVar(&config.NodePortPools, "nodeport-pools", "", "Comma separated node port ranges (e.g. 30000-30099,31000) the node ports are chosen from. By default the api server picks any free node port")
+	flags.StringVar(&config.ClusterNodePortRange, "cluster-nodeport-range", "30000-32767", "The service-node-port-range of the cluster")
+	flags.StringVar(&config.NamespaceQuotas, "namespace-quotas", "", "Comma separated maximum number of dynamic hostports per namespace (e.g. team-a=10,team-b=50). A quota of 0 denies all ports of the namespace")
+	flags.IntVar(&config.DefaultNamespaceQuota, "default-namespace-quota", -1, "Maximum number of dynamic hostports of namespaces without an explicit quota (-1 is unlimited, 0 denies all ports)")
+	flags.StringVar(&config.AllowedPorts, "allowed-ports", "", "Comma separated port ranges (e.g. 7000-8999,27015) that may be exposed. By default all ports are allowed")
+	flags.StringVar(&config.DeniedPorts, "denied-ports", "", "Comma separated port ranges (e.g. 1-1023,2379) that must not be exposed. Takes precedence over the allowed ports")
+	flags.StringVar(&config.PortGroupsConfigMap, "port-groups-configmap", "", "The namespace/name of the ConfigMap that defines the port groups")
+	flags.StringVar(&config.PolicyHookUrl, "policy-hook-url", "", "(optional) URL that is asked to approve the requested ports of every pod before they are exposed")
+	flags.DurationVar(&config.PolicyHookTimeout, "policy-hook-timeout", 5*time.Second, "Timeout of a policy hook request")
+	flags.DurationVar(&config.LeaseTtl, "lease-ttl", 0, "(optional) how long the services of a pod live unless its lease is renewed with the '<annotation-prefix>/lease-renewed' annotation (0 disables the leases)")
+	flags.StringVar(&config.CoordinationConfigMap, "coordination-configmap", "", "(optional) NAMESPACE/NAME of a ConfigMap in the hub cluster that reserves the node ports of all registered clusters, so they are unique across clusters behind a shared NAT")
+	flags.StringVar(&config.CoordinationKubeconfig, "coordination-kubeconfig", "", "(optional) kubeconfig of the hub cluster with the coordination ConfigMap, defaults to the own cluster")
+	flags.StringVar(&config.ClusterId, "cluster-id", "", "Unique name of this cluster within the coordination ConfigMap")
+	flags.BoolVar(&config.PortLabels, "port-labels", false, "Also set the node ports as pod labels (e.g. <annotation-prefix>/np-8080: '31544'), so they can be used in label selectors and downward API projections")
+	flags.BoolVar(&config.PodCondition, "pod-condition", true, "Report the allocation state with the DynamicHostPortsReady condition of the pods, which needs the permission to patch pods/status")
+	flags.BoolVar(&config.WorkloadAnnotation, "workload-annotation", false, "Maintain an annotation on the owning Deployment or StatefulSet with the node ports of all its pods")
+	flags.BoolVar(&config.DiscoveryConfigMaps, "discovery-configmaps", false, "Maintain a WORKLOAD-dynamic-hostports ConfigMap with the endpoints of all pods of each Deployment or StatefulSet")
+	flags.DurationVar(&config.LastReconciledInterval, "last-reconciled-interval", 0, "How often the managed services and pods are stamped with the last-reconciled annotation, so consumers can detect allocations that are no longer maintained (0 disables it)")
+	flags.StringVar(&config.DnsEtcdEndpoint, "dns-etcd-endpoint", "", "(optional) URL of the etcd (e.g. http://etcd:2379) the DNS records of the pods are written to, as read by the etcd plugin of CoreDNS")
+	flags.StringVar(&config.DnsEtcdPrefix, "dns-etcd-prefix", "/skydns", "The etcd key prefix of the DNS records, the path of the CoreDNS etcd plugin")
+	flags.StringVar(&config.DnsZone, "dns-zone", "", "The DNS zone of the records, a pod gets the name POD.NAMESPACE.ZONE")
+	flags.IntVar(&config.DnsTtl, "dns-ttl", 30, "The TTL of the DNS records in seconds")
+	flags.DurationVar(&config.DnsTimeout, "dns-timeout", 5*time.Second, "Timeout of a request to the etcd of the DNS records")
+	flags.StringVar(&config.WhoamiAddress, "whoami-address", "", "(optional) address (e.g. :8081) of the whoami service, which answers pods with their own allocations so they don't need the permission to read pods")
+	flags.BoolVar(&config.WhoamiSourceIpAuth, "whoami-source-ip-auth", false, "Answer whoami requests without a service account token if they come from one of the ips of the pod, e.g. for pods that don't mount a token. Required with --namespaced-rbac, which can't review tokens")
+	flags.StringVar(&config.MetricsAddress, "metrics-address", ":8080", "The address the prometheus metrics are served on (empty to disable)")
+	flags.StringVar(&config.HttpAuth, "http-auth", "none", "Authentication of the HTTP endpoints like /metrics (none, token or mtls). Authenticated users need the permission to get the path (nonResourceURLs)")
+	flags.StringVar(&config.HttpTlsCertFile, "http-tls-cert-file", "", "(optional) TLS certificate the HTTP endpoints are served with, required for mtls")
+	flags.StringVar(&config.HttpTlsKeyFile, "http-tls-key-file", "", "(optional) TLS key the HTTP endpoints are served with, required for mtls")
+	flags.StringVar(&config.HttpClientCaFile, "http-client-ca-file", "", "CA of the client certificates for mtls")
+	// Disabled by default, the debounce interval delays every allocation, which is the path game servers wait for
+	flags.DurationVar(&config.EventDebounce, "event-debounce", 0, "(optional) updates of a pod within this time (e.g. 100ms) are coalesced into a single reconcile of its latest version, 0 handles every event right away")
+	flags.DurationVar(&config.WatchdogTimeout, "watchdog-timeout", 5*time.Minute, "The pod loop is considered stalled if it didn't process anything for this time, which fails /healthz. Pod watches without events or bookmarks for this time are restarted (0 disables the watchdog)")
+	flags.BoolVar(&config.CleanupOnShutdown, "cleanup-on-shutdown", false, "Delete all managed services, endpoints and ConfigMaps and the pod annotations when the controller is terminated, e.g. when it is uninstalled")
+	flags.StringVar(&config.HostPortRanges, "hostport-ranges", "", "Ranges of the host ports that are assigned by the webhook, e.g. '40000-40999'. They should not be used by anything else")
+	flags.StringVar(&config.WebhookAddress, "webhook-address", ":8443", "Address the mutating webhook is served on (/mutate)")
+	flags.StringVar(&config.WebhookCertFile, "webhook-cert-file", "/etc/dynamic-hostports/tls/tls.crt", "TLS certificate of the webhook")
+	flags.StringVar(&config.WebhookKeyFile, "webhook-key-file", "/etc/dynamic-hostports/tls/tls.key", "TLS key of the webhook")
+	flags.StringVar(&config.RelayGatewaySelector, "relay-gateway-selector", "", "(optional) label selector of the gateway nodes (e.g. dynamic-hostports/gateway=true) that run the relay. Their addresses are advertised instead of the address of the pod's node")
+	flags.StringVar(&config.ClusterSecretSelector, "cluster-secret-selector", "", "(optional) label selector of Secrets with the kubeconfigs of the clusters that should be managed (e.g. cluster.x-k8s.io/cluster-name). Enables the multi-cluster mode")
+	flags.StringVar(&config.ClusterSecretsNamespace, "cluster-secrets-namespace", "", "The namespace of the cluster Secrets, all namespaces by default")
+	flags.StringVar(&config.ClusterSecretKey, "cluster-secret-key", "value", "The key of the kubeconfig within the cluster Secrets")
+}
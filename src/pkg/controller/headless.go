@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+func headlessServiceName(pod *v1.Pod) string {
+	return podServiceBaseName(pod) + "-headless"
+}
+
+// Headless services are managed like the node port services, but they don't allocate anything
+func isHeadlessService(service *v1.Service) bool {
+	return service.Spec.ClusterIP == v1.ClusterIPNone
+}
+
+// Returns the DNS name the pod already has, e.g. by the governing service of its StatefulSet
+func existingPodDnsName(pod *v1.Pod) (string, bool) {
+	if pod.Spec.Hostname == "" || pod.Spec.Subdomain == "" {
+		return "", false
+	}
+	return pod.Spec.Hostname + "." + pod.Spec.Subdomain + "." + pod.Namespace + ".svc." + config.ClusterDomain, true
+}
+
+// Creates the headless service and endpoints of the pod with all its ports, unless the pod already has a DNS name.
+// The DNS name is added as pod annotation.
+func createHeadlessService(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest) error {
+	enabled, err := podBoolSetting(pod, headlessServiceAnnotation, config.HeadlessService)
+	if err != nil || !enabled || len(requestedPorts) == 0 {
+		return err
+	}
+
+	dnsName, ok := existingPodDnsName(pod)
+	if !ok {
+		dnsName = headlessServiceName(pod) + "." + serviceNamespace(pod.Namespace) + ".svc." + config.ClusterDomain
+		err := createHeadlessServiceObjects(client, pod, requestedPorts)
+		if err != nil {
+			return err
+		}
+	}
+	if pod.Annotations[clusterDnsAnnotation] == dnsName {
+		return nil
+	}
+	return patchPodAnnotations(client, pod, map[string]string{clusterDnsAnnotation: dnsName})
+}
+
+func createHeadlessServiceObjects(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest) error {
+	meta := serviceMeta(pod, requestedPorts[0])
+	meta.Name = headlessServiceName(pod)
+
+	var servicePorts []v1.ServicePort
+	var endpointPorts []v1.EndpointPort
+	for _, requestedPort := range requestedPorts {
+		name, err := servicePortName(pod, requestedPort)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			// The ports of a multi-port service have to be named
+			name = defaultServicePortName(requestedPort)
+		}
+		servicePorts = append(servicePorts, v1.ServicePort{Name: name, Port: requestedPort.Port, TargetPort: intstr.FromInt(int(requestedPort.Port)), Protocol: requestedPort.Protocol})
+		endpointPorts = append(endpointPorts, v1.EndpointPort{Name: name, Port: requestedPort.Port, Protocol: requestedPort.Protocol})
+	}
+
+	log.Printf("[%s] Create headless service %s", pod.Name, meta.Name)
+	_, err := client.CoreV1().Endpoints(meta.Namespace).Create(context.Background(), &v1.Endpoints{
+		ObjectMeta: meta,
+		Subsets:    []v1.EndpointSubset{{Addresses: podEndpointAddresses(pod), Ports: endpointPorts}},
+	}, metav1.CreateOptions{})
+	if err != nil && !k8sErrors.IsAlreadyExists(err) {
+		return err
+	}
+	_, err = client.CoreV1().Services(meta.Namespace).Create(context.Background(), &v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			ClusterIP: v1.ClusterIPNone,
+			Ports:     servicePorts,
+		},
+	}, metav1.CreateOptions{})
+	if k8sErrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
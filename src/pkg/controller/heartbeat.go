@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Stamps the managed services and their pods with the time. Paused pods are not maintained, so they keep their
+// previous time.
+func stampLastReconciled(client kubernetes.Interface, namespaces []string, now time.Time) error {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	timestamp := now.UTC().Format(time.RFC3339)
+	for _, namespace := range namespaces {
+		if isNamespaceExcluded(namespace) {
+			continue
+		}
+		services, err := listManagedServices(client, namespace, "")
+		if err != nil {
+			return err
+		}
+		pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: podLabelSelector()})
+		if err != nil {
+			return err
+		}
+		podsByName := make(map[string]*v1.Pod)
+		for i := range pods.Items {
+			podsByName[pods.Items[i].Namespace+"/"+pods.Items[i].Name] = &pods.Items[i]
+		}
+
+		stampedPods := make(map[string]bool)
+		for i := range services.Items {
+			service := &services.Items[i]
+			pod, ok := podsByName[servicePodNamespace(service)+"/"+service.Labels[forPodLabelKey]]
+			if !ok || !isServiceOfPod(service, pod) || isPaused(pod) {
+				// Services without their pod are deleted, they are not maintained either
+				continue
+			}
+			err := patchServiceAnnotations(client, service, map[string]string{lastReconciledAnnotation: timestamp})
+			if err != nil {
+				logErr.Printf("[%s] Failed to stamp service %s %s", pod.Name, service.Name, err)
+			}
+			if !stampedPods[pod.Namespace+"/"+pod.Name] {
+				stampedPods[pod.Namespace+"/"+pod.Name] = true
+				err := patchPodAnnotations(client, pod, map[string]string{lastReconciledAnnotation: timestamp})
+				if err != nil {
+					logErr.Printf("[%s] Failed to stamp the pod %s", pod.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func patchServiceAnnotations(client kubernetes.Interface, service *v1.Service, annotations map[string]string) error {
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Services(service.Namespace).Patch(context.Background(), service.Name, types.MergePatchType, serializedJson, metav1.PatchOptions{})
+	return err
+}
+
+func reportLastReconciled(ctx context.Context, client kubernetes.Interface, namespaces []string) {
+	for {
+		err := stampLastReconciled(client, namespaces, time.Now())
+		if err != nil {
+			logErr.Printf("Failed to stamp the last-reconciled time %s", err)
+		}
+		select {
+		case <-time.After(config.LastReconciledInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var nodeNameTypes []v1.NodeAddressType
+
+func parseNodeNameTypes() error {
+	var err error
+	nodeNameTypes, err = nodeaddr.ParseNameTypes(config.AdvertiseNodeNames)
+	if err != nil {
+		return errors.New("Invalid advertised node names " + err.Error())
+	}
+	return nil
+}
+
+// Returns the (cached) name of the pod's node that is advertised instead of its ips, or nil if there is none. Names
+// are only advertised for the pod's own node, not for overridden addresses, virtual ips, relay gateways or in the
+// namespaced rbac mode.
+func getPodNodeNames(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) []string {
+	types := nodeNameTypes
+	if setting, ok := pod.Annotations[advertiseNodeNamesAnnotation]; ok {
+		var err error
+		types, err = nodeaddr.ParseNameTypes(setting)
+		if err != nil {
+			logErr.Printf("[%s] Ignoring advertised node names %s", pod.Name, err)
+			types = nodeNameTypes
+		}
+	}
+	if len(types) == 0 || pod.Spec.NodeName == "" || pod.Annotations[externalIpOverrideAnnotation] != "" || config.NamespacedRbac || config.RelayGatewaySelector != "" || hasVirtualIps() {
+		return nil
+	}
+
+	cacheKey := pod.Spec.NodeName + "/names/" + addressTypesKey(types)
+	nodeNames, ok := cachedExternalIPs[cacheKey]
+	if !ok {
+		node, err := getNode(client, pod.Spec.NodeName)
+		if err != nil {
+			logErr.Printf("[%s] Failed to get the names of node '%s' %s", pod.Name, pod.Spec.NodeName, err)
+			return nil
+		}
+		nodeNames, _ = nodeaddr.AddressesByPriority(node, types, nil, false)
+		cachedExternalIPs[cacheKey] = nodeNames
+	}
+	return nodeNames
+}
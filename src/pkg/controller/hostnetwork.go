@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// The ports are advertised with the address of the node, without any service
+	hostNetworkPodsAnnotate = "annotate"
+	// The pod is ignored
+	hostNetworkPodsSkip = "skip"
+	// The pod gets node port services like any other pod
+	hostNetworkPodsService = "service"
+)
+
+func validateHostNetworkPods() error {
+	switch config.HostNetworkPods {
+	case hostNetworkPodsAnnotate, hostNetworkPodsSkip, hostNetworkPodsService:
+		return nil
+	}
+	return errors.New("Invalid host network pods mode '" + config.HostNetworkPods + "'")
+}
+
+func isAnnotatedHostNetworkPod(pod *v1.Pod) bool {
+	return pod.Spec.HostNetwork && config.HostNetworkPods == hostNetworkPodsAnnotate
+}
+
+// Handles a pod with hostNetwork, whose ports are reachable on its node without a node port service
+func handleHostNetworkPod(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest, handledPods map[string]podState, cachedExternalIPs map[string][]string) error {
+	namespacedPodName := pod.Namespace + "/" + pod.Name
+	if config.HostNetworkPods == hostNetworkPodsSkip {
+		handledPods[namespacedPodName] = podStateHandled
+		log.Printf("[%s] Ignoring pod because it uses the host network.", pod.Name)
+		recorder.Eventf(pod, v1.EventTypeNormal, "HostNetwork", "The pod uses the host network, its ports are reachable on the node without node port services")
+		return nil
+	}
+
+	if pod.Status.PodIP == "" || pod.Status.Phase != v1.PodRunning {
+		log.Printf("[%s] Ignoring pod because it is not running.", pod.Name)
+		return nil
+	}
+	handledPods[namespacedPodName] = podStateHandled
+
+	annotations := hostNetworkPortAnnotations(client, pod, requestedPorts, cachedExternalIPs)
+	for key, value := range nodeTopologyAnnotations(client, pod, cachedExternalIPs) {
+		annotations[key] = value
+	}
+	log.Printf("[%s] Advertising the ports of the host network pod on its node.", pod.Name)
+	err := patchPodAnnotations(client, pod, annotations)
+	if err != nil {
+		return err
+	}
+	recorder.Eventf(pod, v1.EventTypeNormal, "HostNetwork", "The pod uses the host network, its ports are advertised on the node without node port services")
+	setPodCondition(client, pod, v1.ConditionTrue, "HostNetwork", strconv.Itoa(len(requestedPorts))+" host network ports are advertised")
+	return nil
+}
+
+// Returns the annotations of the ports, which are their own node ports. Relay gateways and virtual ips don't forward
+// them, so the address of the node is advertised.
+func hostNetworkPortAnnotations(client kubernetes.Interface, pod *v1.Pod, requestedPorts []PortRequest, cachedExternalIPs map[string][]string) map[string]string {
+	externalIps := podAdvertisedIps(client, pod, cachedExternalIPs, true)
+	nodeNames := getPodNodeNames(client, pod, cachedExternalIPs)
+	annotations := make(map[string]string)
+	for _, requestedPort := range requestedPorts {
+		for key, value := range portAnnotations(requestedPort, requestedPort.Port, externalIps, nodeNames) {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+// Advertises the current addresses of the node for the annotated ports of the host network pod
+func refreshHostNetworkPodAddresses(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) error {
+	requestedPorts, err := getRequestedPorts(client, pod)
+	if err != nil {
+		return err
+	}
+	var annotatedPorts []PortRequest
+	for _, requestedPort := range requestedPorts {
+		if pod.Annotations[podPortToAnnotation(requestedPort)] != "" {
+			annotatedPorts = append(annotatedPorts, requestedPort)
+		}
+	}
+
+	annotations := hostNetworkPortAnnotations(client, pod, annotatedPorts, cachedExternalIPs)
+	var staleKeys []string
+	for _, requestedPort := range annotatedPorts {
+		for _, key := range []string{podPortToEndpointAnnotation(requestedPort), podPortToEndpointsAnnotation(requestedPort)} {
+			if _, ok := annotations[key]; !ok && pod.Annotations[key] != "" {
+				staleKeys = append(staleKeys, key)
+			}
+		}
+	}
+	for key, value := range annotations {
+		if pod.Annotations[key] == value {
+			delete(annotations, key)
+		}
+	}
+	if len(annotations) > 0 || len(staleKeys) > 0 {
+		return updatePodAnnotations(client, pod, annotations, staleKeys)
+	}
+	return nil
+}
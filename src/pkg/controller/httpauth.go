@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationV1 "k8s.io/api/authentication/v1"
+	authorizationV1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	httpAuthNone  = "none"
+	httpAuthToken = "token"
+	httpAuthMtls  = "mtls"
+)
+
+// The liveness probe of the kubelet has no credentials
+var unauthenticatedPaths = map[string]bool{"/healthz": true}
+
+// Successful reviews are cached, so not every scrape causes requests to the api server
+const httpAuthCacheTtl = time.Minute
+
+func validateHttpAuth() error {
+	switch config.HttpAuth {
+	case httpAuthNone, httpAuthToken:
+	case httpAuthMtls:
+		if config.HttpTlsCertFile == "" || config.HttpTlsKeyFile == "" || config.HttpClientCaFile == "" {
+			return errors.New("The mtls http auth requires --http-tls-cert-file, --http-tls-key-file and --http-client-ca-file")
+		}
+	default:
+		return errors.New("Invalid http auth '" + config.HttpAuth + "'")
+	}
+	return nil
+}
+
+// Authenticates the requests with a bearer token (TokenReview) or a client certificate and authorizes them with a
+// SubjectAccessReview for the path, like the endpoints of the kubelet or kube-rbac-proxy
+type httpAuthenticator struct {
+	client kubernetes.Interface
+	mutex  sync.Mutex
+	// Hash of the credential + path => expiry of the successful review
+	allowed map[string]time.Time
+}
+
+func newHttpAuthenticator(client kubernetes.Interface) *httpAuthenticator {
+	return &httpAuthenticator{client: client, allowed: make(map[string]time.Time)}
+}
+
+func credentialKey(credential string, path string) string {
+	hash := sha256.Sum256([]byte(credential + "\x00" + path))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns the user and groups of the request and a credential that identifies it
+func (authenticator *httpAuthenticator) authenticate(request *http.Request) (string, []string, string, error) {
+	if config.HttpAuth == httpAuthMtls {
+		// The certificate is already verified against the client CA by the TLS handshake
+		if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+			return "", nil, "", errors.New("No client certificate")
+		}
+		certificate := request.TLS.VerifiedChains[0][0]
+		return certificate.Subject.CommonName, certificate.Subject.Organization, string(certificate.Raw), nil
+	}
+
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", nil, "", errors.New("No bearer token")
+	}
+	review, err := authenticator.client.AuthenticationV1().TokenReviews().Create(context.Background(), &authenticationV1.TokenReview{
+		Spec: authenticationV1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", nil, "", err
+	}
+	if !review.Status.Authenticated {
+		return "", nil, "", errors.New("Invalid bearer token")
+	}
+	return review.Status.User.Username, review.Status.User.Groups, token, nil
+}
+
+func (authenticator *httpAuthenticator) authorize(user string, groups []string, path string) (bool, error) {
+	review, err := authenticator.client.AuthorizationV1().SubjectAccessReviews().Create(context.Background(), &authorizationV1.SubjectAccessReview{
+		Spec: authorizationV1.SubjectAccessReviewSpec{
+			User:                  user,
+			Groups:                groups,
+			NonResourceAttributes: &authorizationV1.NonResourceAttributes{Path: path, Verb: "get"},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+func (authenticator *httpAuthenticator) wrap(handler http.Handler) http.Handler {
+	if config.HttpAuth == httpAuthNone {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if unauthenticatedPaths[request.URL.Path] {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		user, groups, credential, err := authenticator.authenticate(request)
+		if err != nil {
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		key := credentialKey(credential, request.URL.Path)
+		authenticator.mutex.Lock()
+		expiry, cached := authenticator.allowed[key]
+		authenticator.mutex.Unlock()
+		if !cached || time.Now().After(expiry) {
+			allowed, err := authenticator.authorize(user, groups, request.URL.Path)
+			if err != nil {
+				logErr.Printf("Failed to authorize '%s' for %s %s", user, request.URL.Path, err)
+				http.Error(writer, "Authorization failed", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				http.Error(writer, "Forbidden", http.StatusForbidden)
+				return
+			}
+			authenticator.mutex.Lock()
+			authenticator.allowed[key] = time.Now().Add(httpAuthCacheTtl)
+			authenticator.mutex.Unlock()
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Serves the handler with the configured TLS and authentication. Every HTTP endpoint of the controller goes through it.
+func serveHttp(ctx context.Context, address string, client kubernetes.Interface, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: newHttpAuthenticator(client).wrap(handler),
+	}
+	defer context.AfterFunc(ctx, func() { server.Close() })()
+	if config.HttpTlsCertFile == "" {
+		return server.ListenAndServe()
+	}
+
+	if config.HttpAuth == httpAuthMtls {
+		caCertificates, err := os.ReadFile(config.HttpClientCaFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCertificates) {
+			return errors.New("No certificates in the client CA file '" + config.HttpClientCaFile + "'")
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	return server.ListenAndServeTLS(config.HttpTlsCertFile, config.HttpTlsKeyFile)
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// How long ServiceLB may take to bind the port and report the addresses of the service
+const serviceLBTimeout = 2 * time.Minute
+const serviceLBPollInterval = 2 * time.Second
+
+// Serializes the annotations of the ports that ServiceLB exposed
+var serviceLBAnnotationsMutex sync.Mutex
+
+// ServiceLB binds the service port as host port on the nodes. The port has to be unique, so it is the node port.
+func alignServiceLBPort(client kubernetes.Interface, service *v1.Service) (*v1.Service, error) {
+	port := service.Spec.Ports[0]
+	if port.Port == port.NodePort {
+		return service, nil
+	}
+	// With a strategic merge the port would be added, because it is the merge key of the ports
+	serializedJson, err := json.Marshal([]map[string]interface{}{
+		{"op": "replace", "path": "/spec/ports/0/port", "value": port.NodePort},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.CoreV1().Services(service.Namespace).Patch(context.Background(), service.Name, types.JSONPatchType, serializedJson, metav1.PatchOptions{})
+}
+
+// Waits until ServiceLB reports the addresses the port is bound on and adds them to the pod annotations
+func waitForServiceLB(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, service *v1.Service) {
+	var ips []string
+	err := wait.PollUntilContextTimeout(context.Background(), serviceLBPollInterval, serviceLBTimeout, true, func(ctx context.Context) (bool, error) {
+		current, err := client.CoreV1().Services(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			// The pod might be deleted in the meantime
+			return false, err
+		}
+		for _, ingress := range current.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				ips = append(ips, ingress.IP)
+			}
+		}
+		return len(ips) > 0, nil
+	})
+	if err != nil {
+		logErr.Printf("[%s] ServiceLB did not expose service '%s' %s", pod.Name, service.Name, err)
+		recorder.Eventf(pod, v1.EventTypeWarning, "ServiceLBTimeout", "ServiceLB did not expose port %s within %s", requestedPort, serviceLBTimeout)
+		return
+	}
+
+	log.Printf("[%s] ServiceLB exposed port %s on %v", pod.Name, requestedPort, ips)
+	// The ports of the pod are waited for concurrently. The annotations are added one after another to the current pod,
+	// so the allocations annotation contains the ports of the other patches.
+	serviceLBAnnotationsMutex.Lock()
+	defer serviceLBAnnotationsMutex.Unlock()
+	current, err := client.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		logErr.Printf("[%s] Failed to get the pod to add the ServiceLB addresses %s", pod.Name, err)
+		return
+	}
+	if current.UID != pod.UID {
+		return
+	}
+	addPodPortAnnotation(client, current, requestedPort, service.Spec.Ports[0].Port, ips)
+}
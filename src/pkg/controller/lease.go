@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Receives the pods whose lease might have expired, so they are handled again
+var leaseExpiries = make(chan types.NamespacedName)
+
+var scheduledLeasesMutex sync.Mutex
+
+// Pod => expiry of its lease that a check is scheduled for
+var scheduledLeases = make(map[types.NamespacedName]time.Time)
+
+// Returns when the lease of the pod expires, the zero time if it has no lease. The lease starts with the pod and
+// every renewal starts it again.
+func leaseExpiry(pod *v1.Pod) (time.Time, error) {
+	ttl, err := time.ParseDuration(podSetting(pod, leaseTtlAnnotation, config.LeaseTtl.String()))
+	if err != nil {
+		return time.Time{}, errors.New("Invalid lease ttl " + err.Error())
+	}
+	if ttl <= 0 {
+		return time.Time{}, nil
+	}
+
+	start := pod.CreationTimestamp.Time
+	if pod.Status.StartTime != nil {
+		start = pod.Status.StartTime.Time
+	}
+	if renewed, ok := pod.Annotations[leaseRenewedAnnotation]; ok {
+		renewedAt, err := time.Parse(time.RFC3339, renewed)
+		if err != nil {
+			return time.Time{}, errors.New("Invalid lease renewal '" + renewed + "', expected an RFC 3339 timestamp")
+		}
+		if renewedAt.After(start) {
+			start = renewedAt
+		}
+	}
+	return start.Add(ttl), nil
+}
+
+// Handles the pod again once its lease expired. Renewals schedule a new check, the previous one is dropped.
+func scheduleLeaseCheck(pod *v1.Pod, expiry time.Time) {
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	scheduledLeasesMutex.Lock()
+	defer scheduledLeasesMutex.Unlock()
+	if scheduledLeases[key].Equal(expiry) {
+		return
+	}
+	scheduledLeases[key] = expiry
+
+	time.AfterFunc(time.Until(expiry), func() {
+		scheduledLeasesMutex.Lock()
+		current := scheduledLeases[key].Equal(expiry)
+		if current {
+			delete(scheduledLeases, key)
+		}
+		scheduledLeasesMutex.Unlock()
+		if current {
+			leaseExpiries <- key
+		}
+	})
+}
+
+// Tears down the services and port annotations of a pod whose lease expired, even if the pod is still running
+func expireLease(client kubernetes.Interface, pod *v1.Pod) error {
+	log.Printf("[%s] Deleting the services because the lease expired.", pod.Name)
+	err := deletePodServices(client, pod)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for key := range pod.Annotations {
+		if names.IsOutput(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		err = removePodAnnotations(client, pod, keys)
+		if err != nil {
+			return err
+		}
+	}
+	leaseExpiredTotal.WithLabelValues(pod.Namespace).Inc()
+	recorder.Eventf(pod, v1.EventTypeWarning, "LeaseExpired", "The lease was not renewed, the dynamic hostports were released")
+	setPodCondition(client, pod, v1.ConditionFalse, "LeaseExpired", "The lease was not renewed, the dynamic hostports were released")
+	return nil
+}
+
+// Renews the lease of the pod, which is what the workload or its operator does periodically
+func renewLease(client kubernetes.Interface, namespace string, podName string) error {
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				leaseRenewedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(namespace).Patch(context.Background(), podName, types.MergePatchType, serializedJson, metav1.PatchOptions{})
+	return err
+}
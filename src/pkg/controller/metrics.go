@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+)
+
+const metricsNamespace = "dynamic_hostports"
+
+var nodePortExhaustedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "nodeport_exhausted_total",
+	Help:      "Number of service creations that failed because no node port was left",
+}, []string{"namespace"})
+
+var invalidPortRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "invalid_port_requests_total",
+	Help:      "Number of pod events whose label or ports annotation could not be parsed",
+}, []string{"namespace"})
+
+var leaseExpiredTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "lease_expired_total",
+	Help:      "Number of pods whose services were deleted because their lease was not renewed",
+}, []string{"namespace"})
+
+var staleServicesDeletedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "stale_services_deleted_total",
+	Help:      "Number of services that were deleted on start because their pod is gone (pod_not_found), was recreated (pod_recreated) or lost its label (pod_unlabeled)",
+}, []string{"namespace", "reason"})
+
+var watchdogStallsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "watchdog_stalls_total",
+	Help:      "Number of times the watchdog found the pod loop stalled (loop) or restarted a silent pod watch (watch)",
+}, []string{"reason"})
+
+var apiRequestErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "api_request_errors_total",
+	Help:      "Number of failed requests to the api server by verb, resource and status code ('error' if there was no response)",
+}, []string{"verb", "resource", "code"})
+
+var reconcileRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "reconcile_retries_total",
+	Help:      "Number of pods that were scheduled to be handled again, by the reason of the retry",
+}, []string{"namespace", "reason"})
+
+var allocationLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Name:      "allocation_latency_seconds",
+	Help:      "Time from the pod becoming eligible (running with an ip, or ready if that is required) until its port annotations were added",
+	Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+}, []string{"namespace"})
+
+var nodeAllocations = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "node_allocations",
+	Help:      "Number of managed services per node of their pod",
+}, []string{"node"})
+
+var nodePortsTotal = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "nodeports_total",
+	Help:      "Number of node ports in the node port pools, or in the cluster node port range without pools",
+})
+
+var nodePortsFree = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "nodeports_free",
+	Help:      "Number of node ports of nodeports_total that no service uses, including services that are not managed",
+})
+
+var clusterControllerRestartsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "cluster_controller_restarts_total",
+	Help:      "Number of times the controller of a cluster exited in multi-cluster mode",
+}, []string{"cluster"})
+
+// Serves the metrics until the context is done
+func serveMetrics(ctx context.Context, address string, client kubernetes.Interface) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/debug/state", serveDebugState)
+	log.Printf("Serving metrics on %s", address)
+	err := serveHttp(ctx, address, client, mux)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logErr.Printf("Metrics server failed %s", err)
+	}
+}
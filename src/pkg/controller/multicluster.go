@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Label of cluster-api kubeconfig Secrets with the name of their cluster
+const clusterNameLabel = "cluster.x-k8s.io/cluster-name"
+
+// How long a crashed cluster controller is restarted after
+const clusterRestartDelay = 10 * time.Second
+
+// Flags that differ between the cluster controllers and are set for each of them
+var perClusterFlags = map[string]bool{
+	"kubeconfig":                true,
+	"context":                   true,
+	"as":                        true,
+	"as-group":                  true,
+	"as-uid":                    true,
+	"metrics-address":           true,
+	"whoami-address":            true,
+	"cluster-secret-selector":   true,
+	"cluster-secrets-namespace": true,
+	"cluster-secret-key":        true,
+	"cluster-id":                true,
+}
+
+// A controller process that manages a single cluster
+type clusterController struct {
+	kubeconfig []byte
+	stop       context.CancelFunc
+}
+
+type clusterSecretEvent struct {
+	secret  *v1.Secret
+	deleted bool
+}
+
+func clusterName(secret *v1.Secret) string {
+	if name := secret.Labels[clusterNameLabel]; name != "" {
+		return secret.Namespace + "/" + name
+	}
+	return secret.Namespace + "/" + secret.Name
+}
+
+// Returns the arguments of a cluster controller. They are the flags of this instance, so the config file and its
+// reloads still apply. The environment is inherited, so the per cluster flags are overridden explicitly.
+func clusterControllerArgs(name string, kubeconfigPath string) []string {
+	args := []string{"run"}
+	configFlags.VisitAll(func(f *flag.Flag) {
+		if !explicitFlags[f.Name] || perClusterFlags[f.Name] {
+			return
+		}
+		if repeatable, ok := f.Value.(repeatableValue); ok {
+			for _, value := range repeatable.values() {
+				args = append(args, "--"+f.Name+"="+value)
+			}
+		} else {
+			args = append(args, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return append(args,
+		"--kubeconfig="+kubeconfigPath,
+		"--context=",
+		"--as=",
+		"--as-group=",
+		"--as-uid=",
+		"--metrics-address=",
+		"--whoami-address=",
+		"--cluster-secret-selector=",
+		// Used by the node port coordination
+		"--cluster-id="+name,
+	)
+}
+
+// Prefixes every line of the cluster controller with the name of the cluster
+func forwardClusterOutput(name string, reader io.Reader, writer io.Writer) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		io.WriteString(writer, "["+name+"] "+scanner.Text()+"\n")
+	}
+}
+
+// Runs the cluster controller and restarts it whenever it exits, until it is stopped
+func superviseClusterController(ctx context.Context, name string, kubeconfigPath string) {
+	executable, err := os.Executable()
+	if err != nil {
+		logErr.Printf("Failed to find the executable %s", err)
+		return
+	}
+
+	for {
+		cmd := exec.CommandContext(ctx, executable, clusterControllerArgs(name, kubeconfigPath)...)
+		stdout, _ := cmd.StdoutPipe()
+		stderr, _ := cmd.StderrPipe()
+		err := cmd.Start()
+		if err == nil {
+			log.Printf("Started controller of cluster '%s'", name)
+			go forwardClusterOutput(name, stdout, os.Stdout)
+			go forwardClusterOutput(name, stderr, os.Stderr)
+			err = cmd.Wait()
+		}
+		if ctx.Err() != nil {
+			log.Printf("Stopped controller of cluster '%s'", name)
+			return
+		}
+		clusterControllerRestartsTotal.WithLabelValues(name).Inc()
+		logErr.Printf("Controller of cluster '%s' exited, restarting in %s %v", name, clusterRestartDelay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(clusterRestartDelay):
+		}
+	}
+}
+
+// Starts, restarts or stops the controller of the cluster of the Secret. Only called by the multi-cluster routine.
+func handleClusterSecret(event clusterSecretEvent, controllers map[string]*clusterController, dir string) {
+	name := clusterName(event.secret)
+	kubeconfigPath := filepath.Join(dir, event.secret.Namespace+"_"+event.secret.Name)
+	kubeconfigContent, ok := event.secret.Data[config.ClusterSecretKey]
+	if !ok && !event.deleted {
+		logErr.Printf("Secret '%s/%s' has no key '%s', ignoring it", event.secret.Namespace, event.secret.Name, config.ClusterSecretKey)
+	}
+
+	controller, running := controllers[name]
+	if running && (event.deleted || !ok || !bytes.Equal(controller.kubeconfig, kubeconfigContent)) {
+		controller.stop()
+		delete(controllers, name)
+		os.Remove(kubeconfigPath)
+	}
+	if event.deleted || !ok || (running && bytes.Equal(controller.kubeconfig, kubeconfigContent)) {
+		return
+	}
+
+	err := os.WriteFile(kubeconfigPath, kubeconfigContent, 0o600)
+	if err != nil {
+		logErr.Printf("Failed to write the kubeconfig of cluster '%s' %s", name, err)
+		return
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	controllers[name] = &clusterController{kubeconfig: kubeconfigContent, stop: stop}
+	go superviseClusterController(ctx, name, kubeconfigPath)
+}
+
+// Runs a separate controller process per cluster Secret. Each of them has its own client, caches and node port pools,
+// so a failing cluster never affects the other ones.
+func runMultiCluster() {
+	log.Printf("Starting in multi-cluster mode, watching Secrets '%s'", config.ClusterSecretSelector)
+
+	client, err := createClientset()
+	if err != nil {
+		panic(err.Error())
+	}
+	if config.MetricsAddress != "" {
+		go serveMetrics(context.Background(), config.MetricsAddress, client)
+	}
+	dir, err := os.MkdirTemp("", "dynamic-hostports-clusters")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	events := make(chan clusterSecretEvent)
+	watchClusterSecrets(client, events)
+
+	controllers := make(map[string]*clusterController)
+	for event := range events {
+		handleClusterSecret(event, controllers, dir)
+	}
+}
+
+func watchClusterSecrets(client kubernetes.Interface, events chan<- clusterSecretEvent) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(config.ClusterSecretsNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = config.ClusterSecretSelector
+		}),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if secret, ok := obj.(*v1.Secret); ok {
+				events <- clusterSecretEvent{secret: secret}
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if secret, ok := newObj.(*v1.Secret); ok {
+				events <- clusterSecretEvent{secret: secret}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if secret, ok := obj.(*v1.Secret); ok {
+				events <- clusterSecretEvent{secret: secret, deleted: true}
+			}
+		},
+	})
+	factory.Start(make(chan struct{}))
+}
@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Rejects the features that need cluster wide permissions
+func validateNamespacedRbac() error {
+	if !config.NamespacedRbac {
+		return nil
+	}
+	for _, namespace := range watchedNamespaces() {
+		if namespace == "" {
+			return errors.New("The namespaced rbac mode requires --namespace or --namespaces")
+		}
+	}
+	if config.NamespaceOptIn {
+		return errors.New("The namespace opt-in requires to watch the namespaces, which is not possible in the namespaced rbac mode")
+	}
+	if config.RelayGatewaySelector != "" {
+		return errors.New("The relay gateway nodes can't be listed in the namespaced rbac mode")
+	}
+	if config.HttpAuth != httpAuthNone {
+		return errors.New("The http auth requires to create TokenReviews and SubjectAccessReviews, which is not possible in the namespaced rbac mode")
+	}
+	return nil
+}
+
+// Returns the (cached) ips of the node of the pod from the node ips ConfigMap, or the host ip of the pod
+func getNamespacedNodeIps(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) []string {
+	if config.NodeIpsConfigMap != "" {
+		ips, err := getConfigMapNodeIps(client, pod.Spec.NodeName, cachedExternalIPs)
+		if err == nil {
+			return ips
+		}
+		log.Printf("[%s] Got an error while reading the ips of node '%s' from the ConfigMap, falling back to host ip '%s'. %s", pod.Name, pod.Spec.NodeName, pod.Status.HostIP, err)
+	}
+	if pod.Status.HostIP == "" {
+		return nil
+	}
+	return []string{pod.Status.HostIP}
+}
+
+func getConfigMapNodeIps(client kubernetes.Interface, nodeName string, cachedExternalIPs map[string][]string) ([]string, error) {
+	cacheKey := "configmap/" + nodeName
+	if ips, ok := cachedExternalIPs[cacheKey]; ok {
+		return ips, nil
+	}
+
+	namespace, name := splitNamespacedName(config.NodeIpsConfigMap)
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := configMap.Data[nodeName]
+	if !ok {
+		return nil, errors.New("No entry for node '" + nodeName + "'")
+	}
+	var ips []string
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, errors.New("Invalid ip '" + ip + "' of node '" + nodeName + "'")
+		}
+		ips = append(ips, ip)
+	}
+	log.Printf("Caching ips of node '%s' from the ConfigMap => %s", nodeName, strings.Join(ips, ","))
+	cachedExternalIPs[cacheKey] = ips
+	return ips, nil
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coreListers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var namespaceLister coreListers.NamespaceLister
+
+// Receives the names of namespaces that just got enrolled, so their existing pods are handled
+var enrolledNamespaces = make(chan string)
+
+// Starts the namespace informer and waits until its cache is synced
+func startNamespaceInformer(client kubernetes.Interface, stopChannel <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Core().V1().Namespaces()
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNs, ok := oldObj.(*v1.Namespace)
+			if !ok {
+				return
+			}
+			newNs, ok := newObj.(*v1.Namespace)
+			if !ok {
+				return
+			}
+			if !isNamespaceEnrolled(oldNs) && isNamespaceEnrolled(newNs) {
+				log.Printf("Namespace '%s' got enrolled", newNs.Name)
+				select {
+				case enrolledNamespaces <- newNs.Name:
+				case <-stopChannel:
+				}
+			}
+		},
+	})
+	namespaceLister = informer.Lister()
+
+	factory.Start(stopChannel)
+	for informerType, synced := range factory.WaitForCacheSync(stopChannel) {
+		if !synced {
+			logErr.Panicf("Failed to sync informer %s", informerType)
+		}
+	}
+}
+
+// Returns the namespace from the informer cache
+func getNamespace(name string) (*v1.Namespace, error) {
+	if namespaceLister == nil {
+		// The namespaces are not watched in the namespaced rbac mode
+		return nil, errors.New("Namespace '" + name + "' is not watched")
+	}
+	return namespaceLister.Get(name)
+}
+
+// Returns the annotation of the namespace, which is used as default for the settings of its pods
+func namespaceAnnotation(namespace string, annotation string) (string, bool) {
+	if namespaceLister == nil {
+		return "", false
+	}
+	ns, err := getNamespace(namespace)
+	if err != nil {
+		return "", false
+	}
+	value, ok := ns.Annotations[annotation]
+	return value, ok
+}
+
+// Will split a string of 'kube-system,monitoring' into a set of namespaces
+func parseNamespaceList(namespacesString string) map[string]bool {
+	namespaces := make(map[string]bool)
+	for _, namespace := range strings.Split(namespacesString, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" {
+			namespaces[namespace] = true
+		}
+	}
+	return namespaces
+}
+
+// Returns true if the namespace is excluded via flag or label. Nothing in excluded namespaces is ever touched
+func isNamespaceExcluded(namespace string) bool {
+	if excludedNamespaces[namespace] {
+		return true
+	}
+	ns, err := getNamespace(namespace)
+	if err != nil {
+		return false
+	}
+	return ns.Labels[namespaceExcludedLabel] == "true"
+}
+
+// Field selector that already filters the excluded namespaces on the api server
+func excludedNamespacesFieldSelector() string {
+	var selectors []string
+	for namespace := range excludedNamespaces {
+		selectors = append(selectors, "metadata.namespace!="+namespace)
+	}
+	sort.Strings(selectors)
+	return strings.Join(selectors, ",")
+}
+
+func isNamespaceEnrolled(ns *v1.Namespace) bool {
+	return ns.Labels[namespaceEnabledLabel] == "true"
+}
+
+// Returns true if pods of the namespace should be managed. Always true if the namespace opt-in is disabled
+func isNamespaceEnabled(namespace string) bool {
+	if !config.NamespaceOptIn {
+		return true
+	}
+	ns, err := getNamespace(namespace)
+	if err != nil {
+		logErr.Printf("Failed to get namespace '%s' %s", namespace, err)
+		return false
+	}
+	return isNamespaceEnrolled(ns)
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"context"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A running node lookup that concurrent lookups of the same node wait for
+type nodeLookup struct {
+	done chan struct{}
+	node *v1.Node
+	err  error
+}
+
+// Every cluster has its own client in multi-cluster mode
+type nodeLookupKey struct {
+	client kubernetes.Interface
+	name   string
+}
+
+var nodeLookupsMutex sync.Mutex
+var nodeLookups = make(map[nodeLookupKey]*nodeLookup)
+
+// Fetches the node. Concurrent lookups of the same node share one api call, e.g. when many pods land on a new node
+// at once before its ips are cached.
+func getNode(client kubernetes.Interface, name string) (*v1.Node, error) {
+	key := nodeLookupKey{client: client, name: name}
+	nodeLookupsMutex.Lock()
+	if lookup, ok := nodeLookups[key]; ok {
+		nodeLookupsMutex.Unlock()
+		<-lookup.done
+		return lookup.node, lookup.err
+	}
+	lookup := &nodeLookup{done: make(chan struct{})}
+	nodeLookups[key] = lookup
+	nodeLookupsMutex.Unlock()
+
+	lookup.node, lookup.err = client.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+
+	nodeLookupsMutex.Lock()
+	delete(nodeLookups, key)
+	nodeLookupsMutex.Unlock()
+	close(lookup.done)
+	return lookup.node, lookup.err
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Receives the nodes whose addresses changed, that were deleted or that registered again after their deletion. The
+// advertised addresses of their pods are refreshed.
+var nodeAddressChanges = make(chan string)
+
+func startNodeInformer(client kubernetes.Interface, stopChannel <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Core().V1().Nodes().Informer()
+	// The handlers are called one after another, so they don't need a lock
+	deletedNodes := make(map[string]bool)
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			node, ok := obj.(*v1.Node)
+			if !ok || !deletedNodes[node.Name] {
+				return
+			}
+			delete(deletedNodes, node.Name)
+			log.Printf("Node '%s' registered again", node.Name)
+			select {
+			case nodeAddressChanges <- node.Name:
+			case <-stopChannel:
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			// The kubelet updates the status regularly, only changed addresses matter
+			if !reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses) {
+				log.Printf("The addresses of node '%s' changed", newNode.Name)
+				select {
+				case nodeAddressChanges <- newNode.Name:
+				case <-stopChannel:
+				}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			node, ok := obj.(*v1.Node)
+			if !ok {
+				return
+			}
+			// Pods can still be reported on the node for a while, e.g. while the kubelet registers again
+			log.Printf("Node '%s' was deleted", node.Name)
+			deletedNodes[node.Name] = true
+			select {
+			case nodeAddressChanges <- node.Name:
+			case <-stopChannel:
+			}
+		},
+	})
+	factory.Start(stopChannel)
+	for informerType, synced := range factory.WaitForCacheSync(stopChannel) {
+		if !synced {
+			logErr.Panicf("Failed to sync informer %s", informerType)
+		}
+	}
+}
+
+// Drops the cached addresses and topology of the node. The gateway ips are dropped as well, the node might be one.
+func forgetNode(nodeName string, cachedExternalIPs map[string][]string) {
+	for cacheKey := range cachedExternalIPs {
+		if strings.HasPrefix(cacheKey, nodeName+"/") || cacheKey == "topology/"+nodeName || strings.HasPrefix(cacheKey, "gateways/") {
+			delete(cachedExternalIPs, cacheKey)
+		}
+	}
+}
+
+// Updates the external ips of the services and the endpoint annotations of all managed pods on the node
+func refreshNodePods(client kubernetes.Interface, namespaces []string, nodeName string, cachedExternalIPs map[string][]string) {
+	forgetNode(nodeName, cachedExternalIPs)
+	for _, namespace := range namespaces {
+		pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+			LabelSelector: podLabelSelector(),
+			FieldSelector: "spec.nodeName=" + nodeName,
+		})
+		if err != nil {
+			logErr.Printf("Failed to list the pods of node '%s' %s", nodeName, err)
+			continue
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Spec.NodeName != nodeName || isNamespaceExcluded(pod.Namespace) || isPaused(pod) {
+				continue
+			}
+			err := refreshPodAddresses(client, pod, cachedExternalIPs)
+			if err != nil {
+				logErr.Printf("[%s] Failed to refresh the advertised addresses %s", pod.Name, err)
+			}
+		}
+	}
+}
+
+// Advertises the current addresses of the pod's node on its services and in its annotations
+func refreshPodAddresses(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) error {
+	if isAnnotatedHostNetworkPod(pod) {
+		return refreshHostNetworkPodAddresses(client, pod, cachedExternalIPs)
+	}
+	services, err := listPodServices(client, pod)
+	if err != nil {
+		return err
+	}
+	externalIps := getPodExternalIps(client, pod, cachedExternalIPs)
+	nodeNames := getPodNodeNames(client, pod, cachedExternalIPs)
+
+	annotations := make(map[string]string)
+	var staleKeys []string
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !isServiceOfPod(service, pod) || isHeadlessService(service) {
+			continue
+		}
+		// Without any address left the previous ones are kept, the service would be exposed over all nodes otherwise
+		if ips := nodeaddr.IPs(externalIps); !config.K3sServiceLB && len(ips) > 0 && !slices.Equal(ips, serviceAdvertisedIps(service)) {
+			log.Printf("[%s] Advertising %s on service %s", pod.Name, strings.Join(ips, ","), service.Name)
+			var err error
+			if config.SetExternalIps {
+				err = patchServiceExternalIps(client, service, ips)
+			} else {
+				err = patchServiceAnnotations(client, service, map[string]string{externalIpAnnotation: strings.Join(ips, ",")})
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, port := range service.Spec.Ports {
+			requestedPort := servicePortRequest(port)
+			if pod.Annotations[podPortToAnnotation(requestedPort)] == "" {
+				continue
+			}
+			portAnnotations := portAnnotations(requestedPort, port.NodePort, externalIps, nodeNames)
+			for key, value := range portAnnotations {
+				annotations[key] = value
+			}
+			// The address might be gone, or there is only one left
+			for _, key := range []string{podPortToEndpointAnnotation(requestedPort), podPortToEndpointsAnnotation(requestedPort)} {
+				if _, ok := portAnnotations[key]; !ok && pod.Annotations[key] != "" {
+					staleKeys = append(staleKeys, key)
+				}
+			}
+		}
+	}
+	if len(externalIps) == 0 && pod.Annotations[externalIpAnnotation] != "" {
+		staleKeys = append(staleKeys, externalIpAnnotation)
+	}
+	if len(nodeNames) == 0 && pod.Annotations[externalHostnameAnnotation] != "" {
+		staleKeys = append(staleKeys, externalHostnameAnnotation)
+	}
+
+	for key, value := range annotations {
+		if pod.Annotations[key] == value {
+			delete(annotations, key)
+		}
+	}
+	if len(annotations) > 0 || len(staleKeys) > 0 {
+		// One patch, otherwise the allocations of the second one are calculated without the first one
+		err := updatePodAnnotations(client, pod, annotations, staleKeys)
+		if err != nil {
+			return err
+		}
+	}
+	err = publishPodRecords(client, pod, cachedExternalIPs)
+	if err != nil {
+		return err
+	}
+	return updateWorkloadOutputs(client, pod)
+}
+
+// Returns the ips the service is advertised with, its external ips or the annotation with --set-external-ips=false
+func serviceAdvertisedIps(service *v1.Service) []string {
+	if len(service.Spec.ExternalIPs) > 0 {
+		return service.Spec.ExternalIPs
+	}
+	if ips := service.Annotations[externalIpAnnotation]; ips != "" {
+		return strings.Split(ips, ",")
+	}
+	return nil
+}
+
+func patchServiceExternalIps(client kubernetes.Interface, service *v1.Service, ips []string) error {
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"externalIPs": ips,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Services(service.Namespace).Patch(context.Background(), service.Name, types.MergePatchType, serializedJson, metav1.PatchOptions{})
+	return err
+}
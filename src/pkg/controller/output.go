@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// The output format of the cli commands, the human readable output is the default
+var outputFormat string
+
+// Adds -o to the command, wide is only accepted by commands that print additional columns with it. The logs go to
+// stderr with json and yaml, so stdout can be piped into other tools.
+func addOutputFlag(command *cobra.Command, wide bool) *cobra.Command {
+	formats := "json or yaml"
+	if wide {
+		formats = "json, yaml or wide"
+	}
+	command.Flags().StringVarP(&outputFormat, "output", "o", "", "Output format, one of "+formats)
+	command.PreRunE = func(cmd *cobra.Command, args []string) error {
+		switch outputFormat {
+		case "":
+		case "wide":
+			if !wide {
+				return errors.New("Invalid output format '" + outputFormat + "', expected " + formats)
+			}
+		case "json", "yaml":
+			log.SetOutput(os.Stderr)
+		default:
+			return errors.New("Invalid output format '" + outputFormat + "', expected " + formats)
+		}
+		return nil
+	}
+	return command
+}
+
+func isStructuredOutput() bool {
+	return outputFormat == "json" || outputFormat == "yaml"
+}
+
+// Prints the value in the json or yaml output format
+func printStructured(writer io.Writer, value interface{}) error {
+	serializedJson, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if outputFormat == "yaml" {
+		serializedYaml, err := yaml.JSONToYAML(serializedJson)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(serializedYaml)
+		return err
+	}
+	_, err = writer.Write(append(serializedJson, '\n'))
+	return err
+}
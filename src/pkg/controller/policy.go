@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Returns true if the port may be exposed according to the allow and deny lists. The deny list takes precedence.
+func isPortAllowed(port int32) bool {
+	if allocator.PortInRanges(port, deniedPorts) {
+		return false
+	}
+	return len(allowedPorts) == 0 || allocator.PortInRanges(port, allowedPorts)
+}
+
+// Returns the ports that may be exposed and emits an event for every other port
+func filterAllowedPorts(pod *v1.Pod, requestedPorts []PortRequest) []PortRequest {
+	var allowed []PortRequest
+	for _, requestedPort := range requestedPorts {
+		if !isPortAllowed(requestedPort.Port) {
+			log.Printf("[%s] Ignoring port %s because it is not allowed to be exposed.", pod.Name, requestedPort)
+			recorder.Eventf(pod, v1.EventTypeWarning, "PortNotAllowed", "Port %s is not allowed to be exposed by the port policy", requestedPort)
+			continue
+		}
+		allowed = append(allowed, requestedPort)
+	}
+	return allowed
+}
+
+// Returns the requested ports that no container declares, unless the pod allows them with an annotation
+func undeclaredPorts(pod *v1.Pod, requestedPorts []PortRequest) []PortRequest {
+	allowed, err := podBoolSetting(pod, allowUndeclaredPortsAnnotation, false)
+	if err != nil {
+		logErr.Printf("[%s] Ignoring invalid value of annotation '%s' %s", pod.Name, allowUndeclaredPortsAnnotation, err)
+	}
+	if allowed {
+		return nil
+	}
+	return annotations.UndeclaredPorts(pod, requestedPorts)
+}
+
+// The ports are still exposed, the warning only points out the likely mistake
+func warnUndeclaredPorts(pod *v1.Pod, requestedPorts []PortRequest) {
+	for _, requestedPort := range undeclaredPorts(pod, requestedPorts) {
+		log.Printf("[%s] Port %s is not declared by any container.", pod.Name, requestedPort)
+		recorder.Eventf(pod, v1.EventTypeWarning, "PortNotDeclared", "Port %s is not declared by any container, traffic to it is probably lost. Set the annotation %s=true if this is intended", requestedPort, allowUndeclaredPortsAnnotation)
+	}
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Returned if the policy hook could not be asked, the pod is retried later
+type errPolicyHook struct {
+	err error
+}
+
+func (err errPolicyHook) Error() string {
+	return "Policy hook failed " + err.err.Error()
+}
+
+func (err errPolicyHook) Unwrap() error {
+	return err.err
+}
+
+func isPolicyHookError(err error) bool {
+	var hookErr errPolicyHook
+	return errors.As(err, &hookErr)
+}
+
+type policyHookPort struct {
+	Port      int32       `json:"port"`
+	Protocol  v1.Protocol `json:"protocol"`
+	Container string      `json:"container,omitempty"`
+	// Only set in the response
+	Reason string `json:"reason,omitempty"`
+}
+
+type policyHookRequest struct {
+	Namespace       string            `json:"namespace"`
+	Pod             string            `json:"pod"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	Ports           []policyHookPort  `json:"ports"`
+}
+
+// Ports that are not denied are allowed
+type policyHookResponse struct {
+	Denied []policyHookPort `json:"denied"`
+}
+
+var policyHookClient = &http.Client{}
+
+func askPolicyHook(request policyHookRequest) (*policyHookResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.PolicyHookTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, config.PolicyHookUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := policyHookClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected status " + strconv.Itoa(httpResponse.StatusCode))
+	}
+	response := &policyHookResponse{}
+	err = json.NewDecoder(httpResponse.Body).Decode(response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Returns the reason of every port that is denied by the policy hook, keyed by the port key
+func deniedByPolicyHook(pod *v1.Pod, requestedPorts []PortRequest) (map[string]string, error) {
+	if config.PolicyHookUrl == "" || len(requestedPorts) == 0 {
+		return nil, nil
+	}
+	request := policyHookRequest{
+		Namespace:   pod.Namespace,
+		Pod:         pod.Name,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+	}
+	if pod.Name == "" {
+		// Pods of the host port webhook are not created yet
+		request.Pod = pod.GenerateName
+	}
+	if namespaceLister != nil {
+		if namespace, err := getNamespace(pod.Namespace); err == nil {
+			request.NamespaceLabels = namespace.Labels
+		}
+	}
+	for _, requestedPort := range requestedPorts {
+		request.Ports = append(request.Ports, policyHookPort{Port: requestedPort.Port, Protocol: requestedPort.Protocol, Container: requestedPort.Container})
+	}
+
+	response, err := askPolicyHook(request)
+	if err != nil {
+		return nil, errPolicyHook{err: err}
+	}
+	denied := make(map[string]string)
+	for _, port := range response.Denied {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = v1.ProtocolTCP
+		}
+		denied[PortRequest{Port: port.Port, Protocol: protocol}.Key()] = port.Reason
+	}
+	return denied, nil
+}
+
+// Returns the ports that are approved by the policy hook and emits an event for every other port
+func filterPolicyHookPorts(pod *v1.Pod, requestedPorts []PortRequest) ([]PortRequest, error) {
+	denied, err := deniedByPolicyHook(pod, requestedPorts)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []PortRequest
+	for _, requestedPort := range requestedPorts {
+		if reason, ok := denied[requestedPort.Key()]; ok {
+			log.Printf("[%s] Ignoring port %s because it is denied by the policy hook. %s", pod.Name, requestedPort, reason)
+			recorder.Eventf(pod, v1.EventTypeWarning, "PortDenied", "Port %s was denied by the policy hook: %s", requestedPort, reason)
+			continue
+		}
+		allowed = append(allowed, requestedPort)
+	}
+	return allowed, nil
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Returns the ranges of the pod's node port pool annotation or all ranges of the pool.
+// The ranges of the annotation have to be inside the pool.
+func nodePortRangesForPod(pod *v1.Pod) ([]allocator.PortRange, error) {
+	rangesString := podSetting(pod, nodePortPoolAnnotation, "")
+	if rangesString == "" {
+		return nodePortAllocator.Ranges(), nil
+	}
+	ranges, err := allocator.ParsePortRanges(rangesString)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		for nodePort := r.First; nodePort <= r.Last; nodePort++ {
+			if !nodePortAllocator.Contains(nodePort) {
+				return nil, errors.New("Node port pool '" + rangesString + "' is not inside the node port pools")
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// Releases the node port of a service that was not created. With one service per pod only the node port of the
+// port that failed is released, the other ports of the service keep theirs.
+func releaseNodePort(serviceDef *v1.Service, nodePort int32) {
+	serviceKey := allocator.ServiceKey(serviceDef.Namespace, serviceDef.Name)
+	if config.ServicePerPod {
+		if nodePortAllocator != nil {
+			nodePortAllocator.ReleaseNodePort(nodePort, serviceKey)
+		}
+		releaseGlobalNodePort(nodePort, serviceKey)
+		return
+	}
+	if nodePortAllocator != nil {
+		nodePortAllocator.Release(serviceKey)
+	}
+	releaseGlobalNodePorts(serviceKey)
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Prefix of entries that reference a port group, e.g. 'group:source-engine'
+const portGroupPrefix = "group:"
+
+// PortRequest is a single port of a pod that should be exposed
+type PortRequest = annotations.PortRequest
+
+// Returns the entries of the port group that is defined in the port groups ConfigMap
+func getPortGroupEntries(client kubernetes.Interface, groupName string) ([]string, error) {
+	if config.PortGroupsConfigMap == "" {
+		return nil, errors.New("Port group '" + groupName + "' is used, but no port groups ConfigMap is configured (--port-groups-configmap)")
+	}
+	namespace, name := splitNamespacedName(config.PortGroupsConfigMap)
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	group, ok := configMap.Data[groupName]
+	if !ok {
+		return nil, errors.New("Unknown port group '" + groupName + "'")
+	}
+	return strings.Split(group, ","), nil
+}
+
+// Splits 'namespace/name' into its parts
+func splitNamespacedName(namespacedName string) (string, string) {
+	if i := strings.Index(namespacedName, "/"); i >= 0 {
+		return namespacedName[:i], namespacedName[i+1:]
+	}
+	return "", namespacedName
+}
+
+// Returns the ports of the pod. The ports annotation takes precedence over the label value.
+// The label value 'auto' exposes all declared container ports. The ports of the block annotations are always added.
+func getRequestedPorts(client kubernetes.Interface, pod *v1.Pod) ([]PortRequest, error) {
+	defaultProtocol, err := annotations.ParseProtocol(podSetting(pod, defaultProtocolAnnotation, config.DefaultProtocol))
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := getPortBlocks(pod, defaultProtocol)
+	if err != nil {
+		return nil, err
+	}
+
+	var requests []PortRequest
+	if portsAnnotationValue, ok := pod.Annotations[portsAnnotation]; ok {
+		for _, entry := range strings.Split(portsAnnotationValue, ",") {
+			entry = strings.TrimSpace(entry)
+
+			entries := []string{entry}
+			if strings.HasPrefix(entry, portGroupPrefix) {
+				var err error
+				entries, err = getPortGroupEntries(client, strings.TrimPrefix(entry, portGroupPrefix))
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			for _, groupEntry := range entries {
+				entryRequests, err := annotations.ParsePortRequestEntry(strings.TrimSpace(groupEntry), defaultProtocol)
+				if err != nil {
+					return nil, annotations.InvalidValueError{Key: portsAnnotation, Value: portsAnnotationValue, Syntax: annotations.PortsAnnotationSyntax, Err: err}
+				}
+				requests = append(requests, entryRequests...)
+			}
+		}
+	} else if pod.Labels[labelKey] == annotations.AutoLabelValue {
+		requests = annotations.DeclaredContainerPorts(pod)
+	} else if pod.Labels[labelKey] != "" || len(blocks) == 0 {
+		// Pods with port blocks don't need other ports
+		requests, err = annotations.SplitLabelValue(pod.Labels[labelKey], defaultProtocol)
+		if err != nil {
+			return nil, annotations.InvalidValueError{Key: labelKey, Value: pod.Labels[labelKey], Syntax: annotations.LabelValueSyntax, Err: err}
+		}
+	}
+
+	for _, block := range blocks {
+		requests = append(requests, block...)
+	}
+
+	requests, err = annotations.ResolveContainerPorts(pod, requests)
+	if err != nil {
+		return nil, err
+	}
+	return annotations.UniquePortRequests(requests), nil
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Buffers the events of the pod watches. Deletions are handled before the other events, so after a downtime the node
+// ports and endpoints of deleted pods are released before the backlog of new pods is allocated. Only the latest of
+// the other events of a pod is kept.
+type podEventQueue struct {
+	mutex     sync.Mutex
+	deletions []watch.Event
+	others    []watch.Event
+	// Position of the queued other event by pod, counted from the first event that was ever queued
+	queued map[types.NamespacedName]int
+	popped int
+	// Receives a value while events are queued
+	ready chan struct{}
+}
+
+func newPodEventQueue() *podEventQueue {
+	return &podEventQueue{
+		queued: make(map[types.NamespacedName]int),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (queue *podEventQueue) push(event watch.Event) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	pod, isPod := event.Object.(*v1.Pod)
+	if !isPod {
+		queue.others = append(queue.others, event)
+	} else {
+		key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+		i, ok := queue.queued[key]
+		switch {
+		case event.Type == watch.Deleted:
+			if ok {
+				// The older event must not be handled after the deletion
+				queue.others[i-queue.popped] = watch.Event{}
+				delete(queue.queued, key)
+			}
+			queue.deletions = append(queue.deletions, event)
+		case ok:
+			queue.others[i-queue.popped] = event
+		default:
+			queue.queued[key] = queue.popped + len(queue.others)
+			queue.others = append(queue.others, event)
+		}
+	}
+	queue.signal()
+}
+
+// Returns the next event, deletions first
+func (queue *podEventQueue) pop() (watch.Event, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	defer queue.signal()
+
+	if len(queue.deletions) > 0 {
+		event := queue.deletions[0]
+		queue.deletions = queue.deletions[1:]
+		return event, true
+	}
+	for len(queue.others) > 0 {
+		event := queue.others[0]
+		queue.others = queue.others[1:]
+		queue.popped++
+		if pod, ok := event.Object.(*v1.Pod); ok {
+			delete(queue.queued, types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+		}
+		// Events that were superseded by a deletion are empty
+		if event.Type != "" {
+			return event, true
+		}
+	}
+	return watch.Event{}, false
+}
+
+// Returns the next deletion, if there is any
+func (queue *podEventQueue) popDeletion() (watch.Event, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if len(queue.deletions) == 0 {
+		return watch.Event{}, false
+	}
+	event := queue.deletions[0]
+	queue.deletions = queue.deletions[1:]
+	return event, true
+}
+
+func (queue *podEventQueue) signal() {
+	if len(queue.deletions) == 0 && len(queue.others) == 0 {
+		return
+	}
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
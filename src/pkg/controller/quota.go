@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var errNamespaceQuotaExceeded = errors.New("The namespace has reached its quota of dynamic hostports")
+
+// Will split a string of 'team-a=10,team-b=50' into a map of namespace => quota
+func parseNamespaceQuotas(quotasString string) (map[string]int, error) {
+	quotas := make(map[string]int)
+	if quotasString == "" {
+		return quotas, nil
+	}
+
+	for _, val := range strings.Split(quotasString, ",") {
+		parts := strings.SplitN(strings.TrimSpace(val), "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Namespace quota '" + val + "' must be in the form namespace=quota")
+		}
+		quota, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if quota < 0 {
+			return nil, errors.New("Namespace quota '" + val + "' must not be negative")
+		}
+		quotas[parts[0]] = quota
+	}
+	return quotas, nil
+}
+
+// Returns the maximum number of dynamic hostports of the namespace, -1 means unlimited
+func namespaceQuota(namespace string) int {
+	if quota, ok := namespaceQuotas[namespace]; ok {
+		return quota
+	}
+	return config.DefaultNamespaceQuota
+}
+
+// Returns how many ports can still be allocated in the namespace of the pod, -1 if it has no quota. The ports of the
+// services are counted, with --service-per-pod a service has all ports of its pod.
+func namespaceQuotaLeft(client kubernetes.Interface, pod *v1.Pod) (int, error) {
+	quota := namespaceQuota(pod.Namespace)
+	if quota < 0 {
+		return -1, nil
+	}
+
+	services, err := listManagedServices(client, pod.Namespace, "")
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for i := range services.Items {
+		if !isHeadlessService(&services.Items[i]) {
+			used += len(services.Items[i].Spec.Ports)
+		}
+	}
+	return max(quota-used, 0), nil
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/nodeaddr"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coreListers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const relayDialTimeout = 5 * time.Second
+
+// The services are resynced periodically, so node ports that failed to bind are retried
+const relayResyncPeriod = 30 * time.Second
+
+// Returns the (cached) first address of every gateway node, of the first of the address types that the node has
+func getGatewayIps(client kubernetes.Interface, addressTypes []v1.NodeAddressType, cachedExternalIPs map[string][]string) ([]string, error) {
+	cacheKey := "gateways/" + addressTypesKey(addressTypes)
+	if ips, ok := cachedExternalIPs[cacheKey]; ok {
+		return ips, nil
+	}
+
+	nodes, err := client.CoreV1().Nodes().List(context.Background(), metav1.ListOptions{LabelSelector: config.RelayGatewaySelector})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for i := range nodes.Items {
+		if nodeIps, _ := nodeaddr.AddressesByPriority(&nodes.Items[i], addressTypes, preferredAddressCidrs, false); len(nodeIps) > 0 {
+			ips = append(ips, nodeIps[0])
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("No gateway node with an address matches '" + config.RelayGatewaySelector + "'")
+	}
+	sort.Strings(ips)
+	log.Printf("Caching ips of the gateway nodes => %s", strings.Join(ips, ","))
+	cachedExternalIPs[cacheKey] = ips
+	return ips, nil
+}
+
+// Listens on the node ports of the managed services and forwards the connections to the pods.
+// Runs with the host network on the gateway nodes, for clusters whose node ports are not reachable.
+type relay struct {
+	endpoints map[string]coreListers.EndpointsLister
+	mutex     sync.Mutex
+	// NAMESPACE/NAME/NODEPORT => listener
+	listeners map[string]net.Listener
+}
+
+func relayListenerKey(service *v1.Service, nodePort int32) string {
+	return service.Namespace + "/" + service.Name + "/" + strconv.Itoa(int(nodePort))
+}
+
+// Opens the listeners of the TCP node ports of the service and closes the ones that are not used anymore
+func (r *relay) syncService(service *v1.Service, deleted bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	wanted := make(map[string]v1.ServicePort)
+	if !deleted {
+		for _, port := range service.Spec.Ports {
+			if port.NodePort != 0 && port.Protocol == v1.ProtocolTCP {
+				wanted[relayListenerKey(service, port.NodePort)] = port
+			}
+		}
+	}
+
+	// The ports that were removed from the service are not part of its spec anymore
+	prefix := service.Namespace + "/" + service.Name + "/"
+	for key, listener := range r.listeners {
+		if _, ok := wanted[key]; ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		log.Printf("Stop relaying node port %s of service '%s/%s'", strings.TrimPrefix(key, prefix), service.Namespace, service.Name)
+		listener.Close()
+		delete(r.listeners, key)
+	}
+
+	for key, port := range wanted {
+		if _, ok := r.listeners[key]; ok {
+			continue
+		}
+		listener, err := net.Listen("tcp", ":"+strconv.Itoa(int(port.NodePort)))
+		if err != nil {
+			logErr.Printf("Failed to listen on node port %d of service '%s/%s' %s", port.NodePort, service.Namespace, service.Name, err)
+			continue
+		}
+		log.Printf("Relaying node port %d to service '%s/%s'", port.NodePort, service.Namespace, service.Name)
+		r.listeners[key] = listener
+		go r.serve(listener, service.Namespace, service.Name, port)
+	}
+}
+
+func (r *relay) serve(listener net.Listener, namespace string, serviceName string, port v1.ServicePort) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// Closed because the service was deleted
+			return
+		}
+		go r.forward(conn, namespace, serviceName, port)
+	}
+}
+
+// Returns ip:port of a random ready address of the endpoints of the service
+func (r *relay) pickEndpoint(namespace string, serviceName string, port v1.ServicePort) (string, error) {
+	lister, ok := r.endpoints[namespace]
+	if !ok {
+		lister = r.endpoints[""]
+	}
+	endpoints, err := lister.Endpoints(namespace).Get(serviceName)
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Protocol != v1.ProtocolTCP || (len(subset.Ports) > 1 && endpointPort.Port != port.TargetPort.IntVal) {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				candidates = append(candidates, net.JoinHostPort(address.IP, strconv.Itoa(int(endpointPort.Port))))
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("Service has no ready endpoints")
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func (r *relay) forward(conn net.Conn, namespace string, serviceName string, port v1.ServicePort) {
+	defer conn.Close()
+	target, err := r.pickEndpoint(namespace, serviceName, port)
+	if err != nil {
+		logErr.Printf("Failed to relay connection of %s to service '%s/%s' %s", conn.RemoteAddr(), namespace, serviceName, err)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", target, relayDialTimeout)
+	if err != nil {
+		logErr.Printf("Failed to relay connection of %s to %s %s", conn.RemoteAddr(), target, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		// Let the other direction drain
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
+
+// Runs the relay until it is killed
+func runRelay(client kubernetes.Interface, namespaces []string) {
+	r := &relay{
+		endpoints: make(map[string]coreListers.EndpointsLister),
+		listeners: make(map[string]net.Listener),
+	}
+	// The tenant of the instance is part of the selector, so a relay only forwards the ports of its tenant
+	selector := managedSelector()
+
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, relayResyncPeriod,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = selector
+			}),
+		)
+		r.endpoints[namespace] = factory.Core().V1().Endpoints().Lister()
+		factory.Core().V1().Services().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if service, ok := obj.(*v1.Service); ok {
+					r.syncService(service, false)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if service, ok := newObj.(*v1.Service); ok {
+					r.syncService(service, false)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if service, ok := obj.(*v1.Service); ok {
+					r.syncService(service, true)
+				}
+			},
+		})
+		log.Printf("Relaying the services of namespace '%s'", namespace)
+		factory.Start(make(chan struct{}))
+	}
+	select {}
+}
@@ -0,0 +1,46 @@
+package controller
+
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const initialRetryDelay = 5 * time.Second
+const maxRetryDelay = 5 * time.Minute
+
+// Schedules pods to be handled again with an exponential backoff
+type podRetries struct {
+	channel chan types.NamespacedName
+	delays  map[types.NamespacedName]time.Duration
+}
+
+func newPodRetries() *podRetries {
+	return &podRetries{
+		channel: make(chan types.NamespacedName),
+		delays:  make(map[types.NamespacedName]time.Duration),
+	}
+}
+
+func (retries *podRetries) schedule(pod *v1.Pod, reason string) time.Duration {
+	reconcileRetriesTotal.WithLabelValues(pod.Namespace, reason).Inc()
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	delay := retries.delays[key] * 2
+	if delay < initialRetryDelay {
+		delay = initialRetryDelay
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	retries.delays[key] = delay
+
+	time.AfterFunc(delay, func() {
+		retries.channel <- key
+	})
+	return delay
+}
+
+func (retries *podRetries) reset(pod *v1.Pod) {
+	delete(retries.delays, types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+}
@@ -0,0 +1,31 @@
+package controller
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Stops the controller on SIGTERM or SIGINT instead of exiting right away, so it can clean up
+func watchShutdown(stop context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	log.Printf("Got %s, stopping and cleaning up", received)
+	stop()
+	// A second signal skips the cleanup
+	<-signals
+	os.Exit(1)
+}
+
+// Runs after the pod loop stopped, so nothing is created while the services are deleted
+func cleanupOnShutdown(client kubernetes.Interface, namespaces []string) error {
+	_, err := cleanup(client, namespaces)
+	if err != nil {
+		logErr.Printf("Cleanup on shutdown failed %s", err)
+	}
+	return err
+}
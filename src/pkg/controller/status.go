@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A node port that is allocated for a port of a pod
+type allocation struct {
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Port      string    `json:"port"`
+	NodePort  int32     `json:"nodePort"`
+	Node      string    `json:"node,omitempty"`
+	Addresses []string  `json:"addresses,omitempty"`
+	Zone      string    `json:"zone,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Returns the allocations of the managed services, sorted by namespace, pod and port
+func listAllocations(client kubernetes.Interface, namespaces []string) ([]allocation, error) {
+	allocations := []allocation{}
+	for _, namespace := range namespaces {
+		services, err := listManagedServices(client, namespace, "")
+		if err != nil {
+			return nil, err
+		}
+		pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: labelKey})
+		if err != nil {
+			return nil, err
+		}
+		podsByName := make(map[string]*v1.Pod)
+		for i := range pods.Items {
+			podsByName[pods.Items[i].Namespace+"/"+pods.Items[i].Name] = &pods.Items[i]
+		}
+
+		for _, service := range services.Items {
+			podName := service.Labels[forPodLabelKey]
+			if podName == "" || isHeadlessService(&service) {
+				continue
+			}
+			// A service has all ports of its pod with --service-per-pod
+			for _, port := range service.Spec.Ports {
+				current := allocation{
+					Namespace: servicePodNamespace(&service),
+					Pod:       podName,
+					Port:      servicePortRequest(port).String(),
+					NodePort:  port.NodePort,
+					Node:      service.Annotations[nodeAnnotation],
+					Addresses: serviceAdvertisedIps(&service),
+					Created:   service.CreationTimestamp.Time,
+				}
+				if pod, ok := podsByName[servicePodNamespace(&service)+"/"+podName]; ok && isServiceOfPod(&service, pod) {
+					if current.Node == "" {
+						current.Node = pod.Spec.NodeName
+					}
+					if ips := pod.Annotations[externalIpAnnotation]; ips != "" {
+						// The advertised addresses, which might differ from the external ips of the service (e.g. a relay)
+						current.Addresses = strings.Split(ips, ",")
+					}
+					current.Zone = pod.Annotations[zoneAnnotation]
+					current.Region = pod.Annotations[regionAnnotation]
+				}
+				allocations = append(allocations, current)
+			}
+		}
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		a, b := allocations[i], allocations[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Port < b.Port
+	})
+	return allocations, nil
+}
+
+// Prints the allocations as a table like kubectl does, the wide table includes the zone and region of the nodes
+func printAllocations(writer io.Writer, allocations []allocation, now time.Time, wide bool) error {
+	table := tabwriter.NewWriter(writer, 0, 8, 3, ' ', 0)
+	header := "NAMESPACE\tPOD\tPORT\tNODEPORT\tNODE\tADDRESS\tAGE"
+	if wide {
+		header += "\tZONE\tREGION"
+	}
+	fmt.Fprintln(table, header)
+	for _, current := range allocations {
+		address := orNone(strings.Join(current.Addresses, ","))
+		node := orNone(current.Node)
+		row := fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s\t%s", current.Namespace, current.Pod, current.Port, current.NodePort, node, address, duration.HumanDuration(now.Sub(current.Created)))
+		if wide {
+			row += "\t" + orNone(current.Zone) + "\t" + orNone(current.Region)
+		}
+		fmt.Fprintln(table, row)
+	}
+	return table.Flush()
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"errors"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The built-in strategies, custom ones are registered with allocator.RegisterStrategy
+func init() {
+	allocator.RegisterStrategy("apiserver", apiServerStrategy{})
+	allocator.RegisterStrategy("sequential", sequentialStrategy{})
+	allocator.RegisterStrategy("random-from-pool", randomFromPoolStrategy{})
+	allocator.RegisterStrategy("sticky", stickyStrategy{})
+	allocator.RegisterStrategy("same-port", samePortStrategy{})
+}
+
+// Returns the strategy of the pod annotation or flag.
+// If none is set the node ports are sequentially taken from the pools or chosen by the api server if there are no pools.
+func allocationStrategyForPod(pod *v1.Pod) (allocator.Strategy, error) {
+	name := podSetting(pod, allocationStrategyAnnotation, config.AllocationStrategy)
+	if name == "" {
+		return defaultAllocationStrategy(), nil
+	}
+	strategy, ok := allocator.LookupStrategy(name)
+	if !ok {
+		return nil, errors.New("Unknown allocation strategy '" + name + "'")
+	}
+	return strategy, nil
+}
+
+func defaultAllocationStrategy() allocator.Strategy {
+	if nodePortAllocator != nil {
+		return sequentialStrategy{}
+	}
+	return apiServerStrategy{}
+}
+
+var errNoNodePortPools = errors.New("The allocation strategy requires node port pools (--nodeport-pools)")
+
+// The api server picks any free node port
+type apiServerStrategy struct{}
+
+func (apiServerStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	return 0, nil
+}
+
+func (apiServerStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+}
+
+// Takes the first free node port of the pools
+type sequentialStrategy struct{}
+
+func (sequentialStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	if nodePortAllocator == nil {
+		return 0, errNoNodePortPools
+	}
+	ranges, err := nodePortRangesForPod(pod)
+	if err != nil {
+		return 0, err
+	}
+	return nodePortAllocator.Allocate(podPortServiceKey(pod, requestedPort), ranges, false)
+}
+
+func (sequentialStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+}
+
+// Takes a random free node port of the pools
+type randomFromPoolStrategy struct{}
+
+func (randomFromPoolStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	if nodePortAllocator == nil {
+		return 0, errNoNodePortPools
+	}
+	ranges, err := nodePortRangesForPod(pod)
+	if err != nil {
+		return 0, err
+	}
+	return nodePortAllocator.Allocate(podPortServiceKey(pod, requestedPort), ranges, true)
+}
+
+func (randomFromPoolStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+}
+
+// Requests the node port the workload had before and falls back to the default strategy otherwise
+type stickyStrategy struct{}
+
+func (stickyStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	nodePort, err := getStickyNodePort(client, pod, requestedPort)
+	if err != nil {
+		logErr.Printf("[%s] Failed to get sticky node port for port %s %s", pod.Name, requestedPort, err)
+	} else if nodePort != 0 {
+		return nodePort, nil
+	}
+	return defaultAllocationStrategy().NodePort(client, pod, requestedPort)
+}
+
+func (stickyStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+	err := recordStickyNodePort(client, pod, requestedPort, nodePort)
+	if err != nil {
+		logErr.Printf("[%s] Failed to record sticky node port for port %s %s", pod.Name, requestedPort, err)
+	}
+}
+
+// Requests a node port equal to the container port if it is within the node port range of the cluster
+type samePortStrategy struct{}
+
+func (samePortStrategy) NodePort(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest) (int32, error) {
+	if allocator.PortInRanges(requestedPort.Port, clusterNodePortRange) {
+		return requestedPort.Port, nil
+	}
+	return defaultAllocationStrategy().NodePort(client, pod, requestedPort)
+}
+
+func (samePortStrategy) Allocated(client kubernetes.Interface, pod *v1.Pod, requestedPort PortRequest, nodePort int32) {
+}
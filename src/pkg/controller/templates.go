@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels or annotations whose values are rendered from go templates, e.g. 'external-monitoring/target={{ .NodeIP }}:{{ .NodePort }}'
+type metadataTemplates map[string]metadataTemplate
+
+type metadataTemplate struct {
+	template *template.Template
+}
+
+// The parsed --service-label-template and --service-annotation-template
+var serviceLabelTemplates = metadataTemplates{}
+var serviceAnnotationTemplates = metadataTemplates{}
+
+// The parsed --service-port-name, nil if the ports are unnamed
+var servicePortNameTemplate *template.Template
+
+var templateFuncs = template.FuncMap{
+	"lower": func(value interface{}) string {
+		return strings.ToLower(fmt.Sprint(value))
+	},
+}
+
+func parseServicePortName() error {
+	servicePortNameTemplate = nil
+	if config.ServicePortName == "" {
+		return nil
+	}
+	tmpl, err := template.New("service-port-name").Funcs(templateFuncs).Option("missingkey=error").Parse(config.ServicePortName)
+	if err != nil {
+		return err
+	}
+	servicePortNameTemplate = tmpl
+	return nil
+}
+
+// Returns the name of the service and endpoints port. The node port is not known yet, so it is 0 within the template.
+func servicePortName(pod *v1.Pod, requestedPort PortRequest) (string, error) {
+	if servicePortNameTemplate == nil {
+		if config.ServicePerPod {
+			// The ports of a multi-port service have to be named
+			return defaultServicePortName(requestedPort), nil
+		}
+		return "", nil
+	}
+	var name bytes.Buffer
+	err := servicePortNameTemplate.Execute(&name, templateData{
+		Pod:         pod,
+		ServiceName: podPortToServiceName(pod, requestedPort),
+		Port:        requestedPort.Port,
+		Protocol:    requestedPort.Protocol,
+	})
+	if err != nil {
+		return "", err
+	}
+	if problems := validation.IsDNS1123Label(name.String()); len(problems) > 0 {
+		return "", errors.New("Invalid service port name '" + name.String() + "' " + strings.Join(problems, ", "))
+	}
+	return name.String(), nil
+}
+
+// Returns the name of the default --service-port-name, e.g. 'udp-7777'
+func defaultServicePortName(requestedPort PortRequest) string {
+	return strings.ToLower(string(requestedPort.Protocol)) + "-" + strconv.Itoa(int(requestedPort.Port))
+}
+
+func parseMetadataTemplate(key string, text string) (metadataTemplate, error) {
+	tmpl, err := template.New(key).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return metadataTemplate{}, err
+	}
+	return metadataTemplate{template: tmpl}, nil
+}
+
+func parseMetadataTemplates(texts map[string]string) (metadataTemplates, error) {
+	templates := metadataTemplates{}
+	for key, text := range texts {
+		tmpl, err := parseMetadataTemplate(key, text)
+		if err != nil {
+			return nil, errors.New("Invalid template '" + key + "' " + err.Error())
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// The flag of KEY=TEMPLATE values, it can be repeated
+type templatesValue struct {
+	texts *map[string]string
+}
+
+func (value templatesValue) String() string {
+	if value.texts == nil {
+		return ""
+	}
+	keys := make([]string, 0, len(*value.texts))
+	for key := range *value.texts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func (value templatesValue) Set(flagValue string) error {
+	key, text, ok := strings.Cut(flagValue, "=")
+	if !ok || key == "" {
+		return errors.New("Template '" + flagValue + "' is not in the format KEY=TEMPLATE")
+	}
+	if _, err := parseMetadataTemplate(key, text); err != nil {
+		return err
+	}
+	if *value.texts == nil {
+		*value.texts = make(map[string]string)
+	}
+	(*value.texts)[key] = text
+	return nil
+}
+
+func (value templatesValue) reset() {
+	*value.texts = nil
+}
+
+// Returns the KEY=TEMPLATE values the templates were set with
+func (value templatesValue) values() []string {
+	var values []string
+	for key, text := range *value.texts {
+		values = append(values, key+"="+text)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// The fields that are available within the templates
+type templateData struct {
+	Pod         *v1.Pod
+	ServiceName string
+	Port        int32
+	Protocol    v1.Protocol
+	NodePort    int32
+	// The first advertised ip, empty if the node has no matching address
+	NodeIP  string
+	NodeIPs []string
+}
+
+func (templates metadataTemplates) render(data templateData) (map[string]string, error) {
+	rendered := make(map[string]string)
+	for key, tmpl := range templates {
+		var value bytes.Buffer
+		err := tmpl.template.Execute(&value, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered[key] = value.String()
+	}
+	return rendered, nil
+}
+
+// Adds the templated labels and annotations to the service once its node port is known
+func applyMetadataTemplates(client kubernetes.Interface, pod *v1.Pod, service *v1.Service, requestedPort PortRequest, externalIps []string) error {
+	if len(serviceLabelTemplates) == 0 && len(serviceAnnotationTemplates) == 0 {
+		return nil
+	}
+
+	data := templateData{
+		Pod:         pod,
+		ServiceName: service.Name,
+		Port:        requestedPort.Port,
+		Protocol:    requestedPort.Protocol,
+		NodePort:    nodePortOf(service, requestedPort),
+		NodeIPs:     externalIps,
+	}
+	if len(externalIps) > 0 {
+		data.NodeIP = externalIps[0]
+	}
+
+	labels, err := serviceLabelTemplates.render(data)
+	if err != nil {
+		return err
+	}
+	annotations, err := serviceAnnotationTemplates.render(data)
+	if err != nil {
+		return err
+	}
+
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Services(service.Namespace).Patch(
+		context.Background(),
+		service.Name,
+		types.MergePatchType,
+		serializedJson,
+		metav1.PatchOptions{},
+	)
+	return err
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The tenant label of a ServiceAccount rarely changes, so it is not fetched for every pod event
+const serviceAccountTenantTtl = time.Minute
+
+type cachedTenant struct {
+	tenant  string
+	expires time.Time
+}
+
+var serviceAccountTenantsMutex sync.Mutex
+
+// NAMESPACE/NAME of the ServiceAccount => its tenant label
+var serviceAccountTenants = make(map[string]cachedTenant)
+
+// Returns the labels of everything that this instance creates
+func managedLabels() map[string]string {
+	labels := map[string]string{managedByLabelKey: managedByLabelValue}
+	if config.Tenant != "" {
+		labels[tenantLabel] = config.Tenant
+	}
+	return labels
+}
+
+// Returns the label selector of everything that this instance created. Instances without a tenant don't touch
+// anything of a tenant either.
+func managedSelector() string {
+	if config.Tenant == "" {
+		return managedByLabelKey + "=" + managedByLabelValue + ",!" + tenantLabel
+	}
+	return managedByLabelKey + "=" + managedByLabelValue + "," + tenantLabel + "=" + config.Tenant
+}
+
+// Returns true if the namespace or the ServiceAccount of the pod belongs to the tenant of this instance
+func isTenantPod(client kubernetes.Interface, pod *v1.Pod) bool {
+	if config.Tenant == "" {
+		return true
+	}
+	if ns, err := getNamespace(pod.Namespace); err == nil && ns.Labels[tenantLabel] == config.Tenant {
+		return true
+	}
+
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return getServiceAccountTenant(client, pod.Namespace, serviceAccount) == config.Tenant
+}
+
+func getServiceAccountTenant(client kubernetes.Interface, namespace string, name string) string {
+	key := namespace + "/" + name
+	serviceAccountTenantsMutex.Lock()
+	cached, ok := serviceAccountTenants[key]
+	serviceAccountTenantsMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.tenant
+	}
+
+	serviceAccount, err := client.CoreV1().ServiceAccounts(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		logErr.Printf("Failed to get ServiceAccount '%s' %s", key, err)
+		return ""
+	}
+	tenant := serviceAccount.Labels[tenantLabel]
+	serviceAccountTenantsMutex.Lock()
+	serviceAccountTenants[key] = cachedTenant{tenant: tenant, expires: time.Now().Add(serviceAccountTenantTtl)}
+	serviceAccountTenantsMutex.Unlock()
+	return tenant
+}
@@ -0,0 +1,217 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The orders the top view can be sorted in, 's' switches to the next one
+var topSortOrders = []string{"age", "port", "namespace"}
+
+// A row of the top view, allocations that appeared or were released since the last refresh are marked
+type topRow struct {
+	allocation
+	change string
+}
+
+// The state of the live view of the allocations
+type topView struct {
+	sortBy string
+	// Only the allocations of this namespace are shown, all if empty
+	namespace string
+	// The allocations of the last refresh by namespace/pod/port
+	previous map[string]allocation
+	rows     []topRow
+}
+
+func allocationKey(current allocation) string {
+	return current.Namespace + "/" + current.Pod + "/" + current.Port
+}
+
+// Compares the allocations with the ones of the last refresh. Released allocations are shown once more.
+func (view *topView) update(allocations []allocation) {
+	current := make(map[string]allocation)
+	view.rows = nil
+	for _, next := range allocations {
+		key := allocationKey(next)
+		current[key] = next
+		row := topRow{allocation: next}
+		if previous, ok := view.previous[key]; view.previous != nil && (!ok || previous.NodePort != next.NodePort) {
+			row.change = "+"
+		}
+		view.rows = append(view.rows, row)
+	}
+	for key, previous := range view.previous {
+		if _, ok := current[key]; !ok {
+			view.rows = append(view.rows, topRow{allocation: previous, change: "-"})
+		}
+	}
+	view.previous = current
+}
+
+// Switches to the next namespace of the allocations, after the last one all namespaces are shown again
+func (view *topView) nextNamespace() {
+	namespaces := make(map[string]bool)
+	for _, row := range view.rows {
+		namespaces[row.Namespace] = true
+	}
+	sorted := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		sorted = append(sorted, namespace)
+	}
+	sort.Strings(sorted)
+	for _, namespace := range sorted {
+		if view.namespace == "" || namespace > view.namespace {
+			view.namespace = namespace
+			return
+		}
+	}
+	view.namespace = ""
+}
+
+func (view *topView) nextSortOrder() {
+	for i, order := range topSortOrders {
+		if order == view.sortBy {
+			view.sortBy = topSortOrders[(i+1)%len(topSortOrders)]
+			return
+		}
+	}
+	view.sortBy = topSortOrders[0]
+}
+
+// Returns the rows of the namespace filter in the sort order. The newest allocations come first when sorted by age.
+func (view *topView) visibleRows() []topRow {
+	var rows []topRow
+	for _, row := range view.rows {
+		if view.namespace == "" || row.Namespace == view.namespace {
+			rows = append(rows, row)
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch view.sortBy {
+		case "port":
+			return a.NodePort < b.NodePort
+		case "namespace":
+			if a.Namespace != b.Namespace {
+				return a.Namespace < b.Namespace
+			}
+			return a.Pod < b.Pod
+		default:
+			return a.Created.After(b.Created)
+		}
+	})
+	return rows
+}
+
+func (view *topView) render(writer io.Writer, now time.Time) error {
+	namespace := view.namespace
+	if namespace == "" {
+		namespace = "all"
+	}
+	rows := view.visibleRows()
+	fmt.Fprintf(writer, "%s  %d allocations  namespace: %s  sort: %s  (q quit, n next namespace, s next sort order)\n\n", now.Format(time.TimeOnly), len(rows), namespace, view.sortBy)
+
+	table := tabwriter.NewWriter(writer, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(table, " \tNAMESPACE\tPOD\tPORT\tNODEPORT\tNODE\tADDRESS\tAGE")
+	for _, row := range rows {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", row.change, row.Namespace, row.Pod, row.Port, row.NodePort, orNone(row.Node), orNone(strings.Join(row.Addresses, ",")), duration.HumanDuration(now.Sub(row.Created)))
+	}
+	return table.Flush()
+}
+
+// Shows the allocations live until q is pressed. Without a terminal the view is just printed on every refresh.
+func runTop(client kubernetes.Interface, namespaces []string, interval time.Duration, sortBy string) error {
+	view := &topView{sortBy: sortBy}
+	keys := make(chan byte)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(os.Stdin.Fd()), state)
+		go func() {
+			key := make([]byte, 1)
+			for {
+				if _, err := os.Stdin.Read(key); err != nil {
+					close(keys)
+					return
+				}
+				keys <- key[0]
+			}
+		}()
+	}
+
+	fetch := true
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if fetch {
+			allocations, err := listAllocations(client, namespaces)
+			if err != nil {
+				return err
+			}
+			view.update(allocations)
+		}
+		screen := &bytes.Buffer{}
+		// Clears the screen, and the raw terminal needs carriage returns
+		screen.WriteString("\x1b[H\x1b[2J")
+		err := view.render(screen, time.Now())
+		if err != nil {
+			return err
+		}
+		os.Stdout.WriteString(strings.ReplaceAll(screen.String(), "\n", "\r\n"))
+
+		select {
+		case <-ticker.C:
+			fetch = true
+		case key, ok := <-keys:
+			fetch = false
+			switch {
+			case !ok || key == 'q' || key == 3:
+				// 3 is ctrl+c, which is no signal in raw mode
+				return nil
+			case key == 'n':
+				view.nextNamespace()
+			case key == 's':
+				view.nextSortOrder()
+			}
+		}
+	}
+}
+
+func topCommand() *cobra.Command {
+	var interval time.Duration
+	var sortBy string
+	command := &cobra.Command{
+		Use:   "top",
+		Short: "Show the allocations live, new ones are marked with + and released ones with -",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !slices.Contains(topSortOrders, sortBy) {
+				return errors.New("Invalid sort order '" + sortBy + "', expected one of " + strings.Join(topSortOrders, ", "))
+			}
+			client, err := createClientset()
+			if err != nil {
+				return err
+			}
+			return runTop(client, watchedNamespaces(), interval, sortBy)
+		},
+	}
+	command.Flags().DurationVar(&interval, "interval", 2*time.Second, "How often the allocations are refreshed")
+	command.Flags().StringVar(&sortBy, "sort", "age", "Sort order, one of age, port or namespace")
+	return command
+}
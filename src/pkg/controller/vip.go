@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The key of the ConfigMap of --virtual-ips-configmap with the ips
+const virtualIpsConfigMapKey = "ips"
+
+func validateVirtualIps() error {
+	sources := 0
+	for _, source := range []string{config.VirtualIps, config.VirtualIpsService, config.VirtualIpsConfigMap} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources == 0 {
+		return nil
+	}
+	if sources > 1 {
+		return errors.New("Only one of --virtual-ips, --virtual-ips-service and --virtual-ips-configmap can be set")
+	}
+	if config.RelayGatewaySelector != "" {
+		return errors.New("The virtual ips can't be combined with the relay gateway nodes")
+	}
+	if config.VirtualIps != "" {
+		_, err := parseVirtualIps(config.VirtualIps)
+		return err
+	}
+	for _, source := range []string{config.VirtualIpsService, config.VirtualIpsConfigMap} {
+		if source == "" {
+			continue
+		}
+		if namespace, name := splitNamespacedName(source); namespace == "" || name == "" {
+			return errors.New("Invalid virtual ips source '" + source + "', expected NAMESPACE/NAME")
+		}
+	}
+	return nil
+}
+
+func parseVirtualIps(value string) ([]string, error) {
+	var ips []string
+	for _, ip := range strings.Split(value, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, errors.New("Invalid virtual ip '" + ip + "'")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func hasVirtualIps() bool {
+	return config.VirtualIps != "" || config.VirtualIpsService != "" || config.VirtualIpsConfigMap != ""
+}
+
+// Returns the (cached) virtual ips. The ips of the service or ConfigMap are read again after a config reload.
+func getVirtualIps(client kubernetes.Interface, cachedExternalIPs map[string][]string) ([]string, error) {
+	if ips, ok := cachedExternalIPs["virtual-ips"]; ok {
+		return ips, nil
+	}
+
+	var ips []string
+	var err error
+	switch {
+	case config.VirtualIps != "":
+		ips, err = parseVirtualIps(config.VirtualIps)
+	case config.VirtualIpsService != "":
+		ips, err = getServiceIngressIps(client, config.VirtualIpsService)
+	default:
+		ips, err = getConfigMapVirtualIps(client, config.VirtualIpsConfigMap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Caching the virtual ips => %s", strings.Join(ips, ","))
+	cachedExternalIPs["virtual-ips"] = ips
+	return ips, nil
+}
+
+func getServiceIngressIps(client kubernetes.Interface, namespacedName string) ([]string, error) {
+	namespace, name := splitNamespacedName(namespacedName)
+	service, err := client.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			ips = append(ips, ingress.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("Service '" + namespacedName + "' has no ingress ip yet")
+	}
+	return ips, nil
+}
+
+func getConfigMapVirtualIps(client kubernetes.Interface, namespacedName string) ([]string, error) {
+	namespace, name := splitNamespacedName(namespacedName)
+	configMap, err := client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	value, ok := configMap.Data[virtualIpsConfigMapKey]
+	if !ok {
+		return nil, errors.New("ConfigMap '" + namespacedName + "' has no key '" + virtualIpsConfigMapKey + "'")
+	}
+	return parseVirtualIps(value)
+}
+
+// Returns the virtual ips of the pod, or nil if the address of its node should be advertised
+func getPodVirtualIps(client kubernetes.Interface, pod *v1.Pod, cachedExternalIPs map[string][]string) []string {
+	if !hasVirtualIps() {
+		return nil
+	}
+	ips, err := getVirtualIps(client, cachedExternalIPs)
+	if err != nil {
+		logErr.Printf("[%s] Failed to get the virtual ips, falling back to the ips of node '%s' %s", pod.Name, pod.Spec.NodeName, err)
+		return nil
+	}
+	return ips
+}
@@ -0,0 +1,131 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Tracks the heartbeats of a pod loop and the events of its watches
+type watchdog struct {
+	timeout  time.Duration
+	mutex    sync.Mutex
+	lastBeat time.Time
+	stalled  bool
+	// Namespace => running watch and the time of its last event, including the bookmarks of quiet watches
+	watchers   map[string]watch.Interface
+	lastEvents map[string]time.Time
+}
+
+var watchdogsMutex sync.Mutex
+
+// The watchdogs of all pod loops of the process
+var watchdogs []*watchdog
+
+// Returns the watchdog of a pod loop, it checks the loop until the context is done
+func newWatchdog(ctx context.Context, timeout time.Duration) *watchdog {
+	dog := &watchdog{
+		timeout:    timeout,
+		lastBeat:   time.Now(),
+		watchers:   make(map[string]watch.Interface),
+		lastEvents: make(map[string]time.Time),
+	}
+	if timeout > 0 {
+		watchdogsMutex.Lock()
+		watchdogs = append(watchdogs, dog)
+		watchdogsMutex.Unlock()
+		go func() {
+			ticker := time.NewTicker(timeout / 5)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					dog.check()
+				case <-ctx.Done():
+					watchdogsMutex.Lock()
+					watchdogs = slices.DeleteFunc(watchdogs, func(other *watchdog) bool { return other == dog })
+					watchdogsMutex.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	return dog
+}
+
+// Called by the pod loop whenever it processed something, including its idle ticks
+func (dog *watchdog) beat() {
+	dog.mutex.Lock()
+	defer dog.mutex.Unlock()
+	dog.lastBeat = time.Now()
+	if dog.stalled {
+		log.Print("The pod loop recovered")
+		dog.stalled = false
+	}
+}
+
+func (dog *watchdog) watchStarted(namespace string, watcher watch.Interface) {
+	dog.mutex.Lock()
+	defer dog.mutex.Unlock()
+	dog.watchers[namespace] = watcher
+	dog.lastEvents[namespace] = time.Now()
+}
+
+func (dog *watchdog) eventReceived(namespace string) {
+	dog.mutex.Lock()
+	defer dog.mutex.Unlock()
+	dog.lastEvents[namespace] = time.Now()
+}
+
+func (dog *watchdog) check() {
+	dog.mutex.Lock()
+	defer dog.mutex.Unlock()
+	if !dog.stalled && time.Since(dog.lastBeat) > dog.timeout {
+		logErr.Printf("The pod loop didn't process anything for %s, it seems to be stuck", time.Since(dog.lastBeat).Round(time.Second))
+		watchdogStallsTotal.WithLabelValues("loop").Inc()
+		dog.stalled = true
+	}
+	for namespace, lastEvent := range dog.lastEvents {
+		if time.Since(lastEvent) <= dog.timeout {
+			continue
+		}
+		// The api server sends bookmarks about every minute, even if the pods don't change. A broken connection can
+		// leave the watch open without any of them. The restart resumes from the last resource version.
+		log.Printf("Restarting the pod watch of namespace '%s' because it had no events or bookmarks for %s", namespace, dog.timeout)
+		watchdogStallsTotal.WithLabelValues("watch").Inc()
+		dog.watchers[namespace].Stop()
+		dog.lastEvents[namespace] = time.Now()
+	}
+}
+
+func (dog *watchdog) healthy() bool {
+	dog.mutex.Lock()
+	defer dog.mutex.Unlock()
+	return !dog.stalled
+}
+
+// Returns an error if a pod loop of the process is stalled
+func checkWatchdogs() error {
+	watchdogsMutex.Lock()
+	defer watchdogsMutex.Unlock()
+	for _, dog := range watchdogs {
+		if !dog.healthy() {
+			return errors.New("The pod loop is stalled")
+		}
+	}
+	return nil
+}
+
+// The liveness endpoint, the kubelet restarts the controller if a pod loop is stalled
+func serveHealthz(writer http.ResponseWriter, request *http.Request) {
+	if err := checkWatchdogs(); err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Write([]byte("ok"))
+}
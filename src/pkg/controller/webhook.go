@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/allocator"
+	admissionV1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The host ports are reserved for the admission request until the pod shows up in the informer, or released if it
+// never does. Pods that are created with a generateName have no name during the admission.
+const pendingHostPortTimeout = time.Minute
+
+// Assigns free host ports to the requested container ports of new pods, instead of creating services for them
+type hostPortWebhook struct {
+	client kubernetes.Interface
+	pool   *allocator.Pool
+	mutex  sync.Mutex
+	// Key of the admission request => time of the admission
+	pending map[string]time.Time
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Returns the index of the container and its port that matches the request. The port is -1 if it is not declared.
+func findContainerPort(pod *v1.Pod, request PortRequest) (int, int) {
+	for c, container := range pod.Spec.Containers {
+		if request.Container != "" && container.Name != request.Container {
+			continue
+		}
+		for p, port := range container.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			if port.ContainerPort == request.Port && protocol == request.Protocol {
+				return c, p
+			}
+		}
+		if request.Container != "" {
+			return c, -1
+		}
+	}
+	return 0, -1
+}
+
+// Assigns the host ports and returns the JSON patch of the pod. Problems that don't prevent the pod from running are
+// returned as warnings, like the controller only logs them.
+func (webhook *hostPortWebhook) mutate(pod *v1.Pod, key string) ([]jsonPatchOperation, []string, error) {
+	if isNamespaceExcluded(pod.Namespace) || isPaused(pod) || !isNamespaceEnabled(pod.Namespace) || !isTenantPod(webhook.client, pod) {
+		return nil, nil, nil
+	}
+	requestedPorts, err := getRequestedPorts(webhook.client, pod)
+	if err != nil {
+		return nil, []string{"No host ports were assigned: " + err.Error()}, nil
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return nil, nil, nil
+	}
+
+	var warnings []string
+	for _, requestedPort := range undeclaredPorts(pod, requestedPorts) {
+		warnings = append(warnings, "Port "+requestedPort.String()+" is not declared by any container, it is added to the container. Set the annotation "+allowUndeclaredPortsAnnotation+"=true if this is intended")
+	}
+	changed := false
+	annotations := make(map[string]string)
+	for k, v := range pod.Annotations {
+		annotations[k] = v
+	}
+	containers := make([]v1.Container, len(pod.Spec.Containers))
+	for c, container := range pod.Spec.Containers {
+		containers[c] = *container.DeepCopy()
+	}
+
+	denied, err := deniedByPolicyHook(pod, requestedPorts)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, requestedPort := range requestedPorts {
+		if !isPortAllowed(requestedPort.Port) {
+			warnings = append(warnings, "Port "+requestedPort.String()+" is not allowed to be exposed by the port policy")
+			continue
+		}
+		if reason, ok := denied[requestedPort.Key()]; ok {
+			warnings = append(warnings, "Port "+requestedPort.String()+" was denied by the policy hook: "+reason)
+			continue
+		}
+
+		c, p := findContainerPort(pod, requestedPort)
+		if p >= 0 && containers[c].Ports[p].HostPort != 0 {
+			// Keep the host port of the pod spec
+			hostPort := strconv.Itoa(int(containers[c].Ports[p].HostPort))
+			webhook.pool.MarkUsed(containers[c].Ports[p].HostPort, key)
+			if annotations[podPortToAnnotation(requestedPort)] != hostPort {
+				annotations[podPortToAnnotation(requestedPort)] = hostPort
+				changed = true
+			}
+			continue
+		}
+
+		hostPort, err := webhook.pool.Allocate(key, webhook.pool.Ranges(), false)
+		if err != nil {
+			webhook.pool.Release(key)
+			return nil, nil, err
+		}
+		if p >= 0 {
+			containers[c].Ports[p].HostPort = hostPort
+		} else {
+			containers[c].Ports = append(containers[c].Ports, v1.ContainerPort{
+				ContainerPort: requestedPort.Port,
+				HostPort:      hostPort,
+				Protocol:      requestedPort.Protocol,
+			})
+		}
+		annotations[podPortToAnnotation(requestedPort)] = strconv.Itoa(int(hostPort))
+		changed = true
+		log.Printf("[%s] Assigned host port %d to port %s", key, hostPort, requestedPort)
+	}
+
+	if !changed {
+		return nil, warnings, nil
+	}
+	patch := []jsonPatchOperation{
+		{Op: "replace", Path: "/spec/containers", Value: containers},
+		// Adding an existing member replaces it
+		{Op: "add", Path: "/metadata/annotations", Value: annotations},
+	}
+	if config.PortLabels {
+		labels := make(map[string]string)
+		for k, v := range pod.Labels {
+			labels[k] = v
+		}
+		for k, v := range annotations {
+			if label, ok := names.PortLabel(k); ok {
+				labels[label] = v
+			}
+		}
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/metadata/labels", Value: labels})
+	}
+	return patch, warnings, nil
+}
+
+func (webhook *hostPortWebhook) review(request *admissionV1.AdmissionRequest) *admissionV1.AdmissionResponse {
+	response := &admissionV1.AdmissionResponse{UID: request.UID, Allowed: true}
+	if request.Operation != admissionV1.Create || request.Kind.Kind != "Pod" {
+		return response
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		response.Warnings = []string{"No host ports were assigned: " + err.Error()}
+		return response
+	}
+	pod.Namespace = request.Namespace
+
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	key := allocator.ServiceKey(pod.Namespace, name) + "@" + string(request.UID)
+	webhook.mutex.Lock()
+	webhook.pending[key] = time.Now()
+	webhook.mutex.Unlock()
+
+	patch, warnings, err := webhook.mutate(pod, key)
+	response.Warnings = warnings
+	if err != nil {
+		logErr.Printf("[%s] Failed to assign host ports %s", key, err)
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: "Failed to assign host ports: " + err.Error()}
+		return response
+	}
+	if len(patch) == 0 {
+		return response
+	}
+	serializedPatch, err := json.Marshal(patch)
+	if err != nil {
+		webhook.pool.Release(key)
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+		return response
+	}
+	patchType := admissionV1.PatchTypeJSONPatch
+	response.Patch = serializedPatch
+	response.PatchType = &patchType
+	return response
+}
+
+func (webhook *hostPortWebhook) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review := &admissionV1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(writer, "Invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = webhook.review(review.Request)
+	review.Request = nil
+	serialized, err := json.Marshal(review)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(serialized)
+}
+
+// Marks the host ports of the existing pods as used, so they survive restarts of the webhook
+func (webhook *hostPortWebhook) syncPod(pod *v1.Pod, deleted bool) {
+	key := allocator.ServiceKey(pod.Namespace, pod.Name)
+	if deleted {
+		webhook.pool.Release(key)
+		return
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.HostPort != 0 {
+				webhook.pool.MarkUsed(port.HostPort, key)
+			}
+		}
+	}
+}
+
+// Releases the host ports of admission requests whose pod was never created (e.g. rejected by another webhook)
+func (webhook *hostPortWebhook) releasePending() {
+	webhook.mutex.Lock()
+	defer webhook.mutex.Unlock()
+	for key, admitted := range webhook.pending {
+		if time.Since(admitted) > pendingHostPortTimeout {
+			// Ports of created pods are owned by the pod by now and not released
+			webhook.pool.Release(key)
+			delete(webhook.pending, key)
+		}
+	}
+}
+
+func watchHostPortPods(webhook *hostPortWebhook, namespaces []string) {
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(webhook.client, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = podLabelSelector()
+			}),
+		)
+		informer := factory.Core().V1().Pods().Informer()
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if pod, ok := obj.(*v1.Pod); ok {
+					webhook.syncPod(pod, false)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if pod, ok := newObj.(*v1.Pod); ok {
+					webhook.syncPod(pod, false)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				if pod, ok := obj.(*v1.Pod); ok {
+					webhook.syncPod(pod, true)
+				}
+			},
+		})
+		stopChannel := make(chan struct{})
+		factory.Start(stopChannel)
+		cache.WaitForCacheSync(stopChannel, informer.HasSynced)
+	}
+}
+
+// Serves the mutating webhook until it is killed
+func runWebhook(client kubernetes.Interface, namespaces []string) error {
+	if config.HostPortRanges == "" {
+		return errors.New("The webhook requires --hostport-ranges")
+	}
+	pool, err := allocator.NewPool(config.HostPortRanges)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting the host port webhook with the host ports %s", config.HostPortRanges)
+
+	if config.MetricsAddress != "" {
+		go serveMetrics(context.Background(), config.MetricsAddress, client)
+	}
+	if !config.NamespacedRbac {
+		startNamespaceInformer(client, make(chan struct{}))
+	}
+
+	webhook := &hostPortWebhook{
+		client:  client,
+		pool:    pool,
+		pending: make(map[string]time.Time),
+	}
+	// The host ports of the existing pods have to be known before new ones are assigned
+	watchHostPortPods(webhook, namespaces)
+	go func() {
+		for range time.Tick(pendingHostPortTimeout) {
+			webhook.releasePending()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", webhook)
+	log.Printf("Serving the webhook on %s", config.WebhookAddress)
+	return http.ListenAndServeTLS(config.WebhookAddress, config.WebhookCertFile, config.WebhookKeyFile, mux)
+}
@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0blu/k8s-dynamic-hostport/pkg/annotations"
+	authenticationV1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coreListers "k8s.io/client-go/listers/core/v1"
+)
+
+// The extra fields of the user of a bound service account token that identify its pod
+const (
+	podNameExtra = "authentication.kubernetes.io/pod-name"
+	podUidExtra  = "authentication.kubernetes.io/pod-uid"
+)
+
+// The answer of the whoami service
+type whoamiResponse struct {
+	Namespace   string                   `json:"namespace"`
+	Name        string                   `json:"name"`
+	Node        string                   `json:"node"`
+	Allocations []annotations.Allocation `json:"allocations"`
+}
+
+// The namespace and uid of the pod a reviewed token is bound to
+type whoamiTokenPod struct {
+	namespace string
+	uid       types.UID
+	expiry    time.Time
+}
+
+// Authenticates the pods with their bound service account tokens. Successful reviews are cached like the ones of
+// the http auth, since the pods poll the service.
+type whoamiAuthenticator struct {
+	client kubernetes.Interface
+	mutex  sync.Mutex
+	// Hash of the token => pod
+	reviewed map[string]whoamiTokenPod
+}
+
+var errWhoamiNoToken = errors.New("No bearer token")
+
+// Returns the namespace and uid of the pod the bearer token of the request is bound to
+func (authenticator *whoamiAuthenticator) tokenPod(request *http.Request) (string, types.UID, error) {
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", "", errWhoamiNoToken
+	}
+	key := credentialKey(token, "whoami")
+	authenticator.mutex.Lock()
+	cached, ok := authenticator.reviewed[key]
+	authenticator.mutex.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.namespace, cached.uid, nil
+	}
+
+	review, err := authenticator.client.AuthenticationV1().TokenReviews().Create(context.Background(), &authenticationV1.TokenReview{
+		Spec: authenticationV1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	if !review.Status.Authenticated {
+		return "", "", errors.New("Invalid bearer token")
+	}
+	// system:serviceaccount:NAMESPACE:NAME
+	parts := strings.Split(review.Status.User.Username, ":")
+	uid := review.Status.User.Extra[podUidExtra]
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" || len(uid) != 1 || len(review.Status.User.Extra[podNameExtra]) != 1 {
+		return "", "", errors.New("The token of '" + review.Status.User.Username + "' is not bound to a pod")
+	}
+	tokenPod := whoamiTokenPod{namespace: parts[2], uid: types.UID(uid[0]), expiry: time.Now().Add(httpAuthCacheTtl)}
+	authenticator.mutex.Lock()
+	authenticator.reviewed[key] = tokenPod
+	authenticator.mutex.Unlock()
+	return tokenPod.namespace, tokenPod.uid, nil
+}
+
+// Answers GET /whoami?namespace=NAMESPACE&name=POD with the allocations of the pod. Only the pod itself is answered,
+// the request needs a service account token that is bound to the pod (or comes from one of its ips with
+// --whoami-source-ip-auth). The pods are read from the informer caches of the watched namespaces.
+func newWhoamiHandler(client kubernetes.Interface, pods map[string]coreListers.PodLister) http.Handler {
+	authenticator := &whoamiAuthenticator{client: client, reviewed: make(map[string]whoamiTokenPod)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/whoami", func(writer http.ResponseWriter, request *http.Request) {
+		namespace := request.URL.Query().Get("namespace")
+		name := request.URL.Query().Get("name")
+		if namespace == "" || name == "" {
+			http.Error(writer, "The namespace and name of the pod are required", http.StatusBadRequest)
+			return
+		}
+		lister, ok := pods[namespace]
+		if !ok {
+			lister, ok = pods[""]
+		}
+		if !ok {
+			http.Error(writer, "The pod is not managed", http.StatusNotFound)
+			return
+		}
+		pod, err := lister.Pods(namespace).Get(name)
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			logErr.Printf("[%s] Failed to get the pod for the whoami service %s", name, err)
+			http.Error(writer, "Failed to get the pod", http.StatusServiceUnavailable)
+			return
+		}
+		// The config can be reloaded in the meantime
+		configMutex.RLock()
+		managed := err == nil && isManagedPod(pod) && !isNamespaceExcluded(pod.Namespace)
+		sourceIpAuth := config.WhoamiSourceIpAuth
+		configMutex.RUnlock()
+		if !managed {
+			http.Error(writer, "The pod is not managed", http.StatusNotFound)
+			return
+		}
+
+		// The tokens can't be reviewed in the namespaced rbac mode, there only the source ip is checked
+		tokenNamespace, tokenUid, err := "", types.UID(""), errWhoamiNoToken
+		if !config.NamespacedRbac {
+			tokenNamespace, tokenUid, err = authenticator.tokenPod(request)
+		}
+		if errors.Is(err, errWhoamiNoToken) && sourceIpAuth {
+			if !isPodAddress(pod, request.RemoteAddr) {
+				http.Error(writer, "The request does not come from the pod", http.StatusForbidden)
+				return
+			}
+		} else if err != nil {
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		} else if tokenNamespace != pod.Namespace || tokenUid != pod.UID {
+			http.Error(writer, "The token is not bound to the pod", http.StatusForbidden)
+			return
+		}
+
+		response := whoamiResponse{Namespace: pod.Namespace, Name: pod.Name, Node: pod.Spec.NodeName, Allocations: []annotations.Allocation{}}
+		if value, ok := pod.Annotations[allocationsAnnotation]; ok {
+			allocations, err := annotations.ParseAllocations(value)
+			if err != nil {
+				http.Error(writer, "Invalid allocations annotation", http.StatusInternalServerError)
+				return
+			}
+			response.Allocations = allocations
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(response)
+	})
+	return mux
+}
+
+// Returns true if the remote address is one of the ips of the pod. Pods with hostNetwork have the ip of their node,
+// which every other host network pod on the node shares, so they are never answered.
+func isPodAddress(pod *v1.Pod, remoteAddr string) bool {
+	if pod.Spec.HostNetwork {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	remote := net.ParseIP(host)
+	if remote == nil {
+		return false
+	}
+	ips := []string{pod.Status.PodIP}
+	for _, podIp := range pod.Status.PodIPs {
+		ips = append(ips, podIp.IP)
+	}
+	for _, ip := range ips {
+		if podIp := net.ParseIP(ip); podIp != nil && podIp.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWhoami() error {
+	if config.WhoamiAddress != "" && config.NamespacedRbac && !config.WhoamiSourceIpAuth {
+		return errors.New("The whoami service requires --whoami-source-ip-auth in the namespaced rbac mode, the tokens of the pods can't be reviewed without cluster wide permissions")
+	}
+	return nil
+}
+
+// Starts the informers of the managed pods of the namespaces and waits until their caches are synced
+func startWhoamiInformers(client kubernetes.Interface, namespaces []string, stopChannel <-chan struct{}) map[string]coreListers.PodLister {
+	pods := make(map[string]coreListers.PodLister)
+	for _, namespace := range namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = podLabelSelector()
+			}),
+		)
+		pods[namespace] = factory.Core().V1().Pods().Lister()
+		factory.Start(stopChannel)
+		for informerType, synced := range factory.WaitForCacheSync(stopChannel) {
+			if !synced {
+				logErr.Panicf("Failed to sync informer %s", informerType)
+			}
+		}
+	}
+	return pods
+}
+
+// The whoami service is not behind the http auth, the pods authenticate with their own service account tokens. It is
+// served until the context is done.
+func serveWhoami(ctx context.Context, address string, client kubernetes.Interface, namespaces []string) {
+	pods := startWhoamiInformers(client, namespaces, ctx.Done())
+	log.Printf("Serving the whoami service on %s", address)
+	server := &http.Server{Addr: address, Handler: newWhoamiHandler(client, pods)}
+	defer context.AfterFunc(ctx, func() { server.Close() })()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logErr.Printf("Whoami server failed %s", err)
+	}
+}
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Suffix of the discovery ConfigMap of a workload, which is named WORKLOAD-dynamic-hostports
+const discoveryConfigMapSuffix = "-dynamic-hostports"
+const discoveryConfigMapKey = "endpoints.json"
+
+// Deployment or StatefulSet that owns a pod
+type workloadRef struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+	UID        types.UID
+}
+
+func newWorkloadRef(namespace string, owner *metav1.OwnerReference) *workloadRef {
+	return &workloadRef{APIVersion: owner.APIVersion, Kind: owner.Kind, Namespace: namespace, Name: owner.Name, UID: owner.UID}
+}
+
+// A single port of a pod within the discovery ConfigMap
+type discoveryEndpoint struct {
+	NodePort  int32    `json:"nodePort"`
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// Returns the Deployment (via its ReplicaSet) or StatefulSet of the pod, nil if the pod has none of them
+func owningWorkload(client kubernetes.Interface, pod *v1.Pod, replicaSetOwners map[string]*metav1.OwnerReference) (*workloadRef, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+
+	switch owner.Kind {
+	case "StatefulSet":
+		return newWorkloadRef(pod.Namespace, owner), nil
+	case "ReplicaSet":
+		deployment, known := replicaSetOwners[owner.Name]
+		if !known {
+			replicaSet, err := client.AppsV1().ReplicaSets(pod.Namespace).Get(context.Background(), owner.Name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			deployment = metav1.GetControllerOf(replicaSet)
+			replicaSetOwners[owner.Name] = deployment
+		}
+		if deployment == nil || deployment.Kind != "Deployment" {
+			return nil, nil
+		}
+		return newWorkloadRef(pod.Namespace, deployment), nil
+	}
+	return nil, nil
+}
+
+// Returns pod => port => service of all pods of the workload
+func workloadServices(client kubernetes.Interface, workload *workloadRef) (map[string]map[string]v1.Service, error) {
+	pods, err := client.CoreV1().Pods(workload.Namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: labelKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	services, err := listManagedServices(client, workload.Namespace, "")
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSetOwners := make(map[string]*metav1.OwnerReference)
+	podServices := make(map[string]map[string]v1.Service)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		podWorkload, err := owningWorkload(client, pod, replicaSetOwners)
+		if err != nil {
+			return nil, err
+		}
+		if podWorkload != nil && *podWorkload == *workload {
+			podServices[pod.Name] = make(map[string]v1.Service)
+		}
+	}
+
+	for _, service := range services.Items {
+		ports, ok := podServices[service.Labels[forPodLabelKey]]
+		if !ok || isHeadlessService(&service) {
+			continue
+		}
+		// With --service-per-pod every port is split into a service of its own
+		for _, port := range service.Spec.Ports {
+			portService := service
+			portService.Spec.Ports = []v1.ServicePort{port}
+			ports[servicePortRequest(port).Key()] = portService
+		}
+	}
+	return podServices, nil
+}
+
+// Returns pod => port => node port
+func workloadMappings(podServices map[string]map[string]v1.Service) map[string]map[string]int32 {
+	mappings := make(map[string]map[string]int32)
+	for podName, services := range podServices {
+		mappings[podName] = make(map[string]int32)
+		for port, service := range services {
+			mappings[podName][port] = service.Spec.Ports[0].NodePort
+		}
+	}
+	return mappings
+}
+
+// Returns pod => port => node port and the advertised endpoints
+func workloadEndpoints(podServices map[string]map[string]v1.Service) map[string]map[string]discoveryEndpoint {
+	endpoints := make(map[string]map[string]discoveryEndpoint)
+	for podName, services := range podServices {
+		endpoints[podName] = make(map[string]discoveryEndpoint)
+		for port, service := range services {
+			nodePort := service.Spec.Ports[0].NodePort
+			endpoint := discoveryEndpoint{NodePort: nodePort}
+			for _, ip := range serviceAdvertisedIps(&service) {
+				endpoint.Endpoints = append(endpoint.Endpoints, net.JoinHostPort(ip, strconv.Itoa(int(nodePort))))
+			}
+			endpoints[podName][port] = endpoint
+		}
+	}
+	return endpoints
+}
+
+// Recalculates the mappings annotation and the discovery ConfigMap of the workload that owns the pod
+func updateWorkloadOutputs(client kubernetes.Interface, pod *v1.Pod) error {
+	if !config.WorkloadAnnotation && !config.DiscoveryConfigMaps {
+		return nil
+	}
+	workload, err := owningWorkload(client, pod, make(map[string]*metav1.OwnerReference))
+	if err != nil || workload == nil {
+		return err
+	}
+
+	podServices, err := workloadServices(client, workload)
+	if err != nil {
+		return err
+	}
+
+	if config.WorkloadAnnotation {
+		err = updateWorkloadAnnotation(client, workload, workloadMappings(podServices))
+		if err != nil {
+			return err
+		}
+	}
+	if config.DiscoveryConfigMaps {
+		err = updateDiscoveryConfigMap(client, workload, workloadEndpoints(podServices))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateWorkloadAnnotation(client kubernetes.Interface, workload *workloadRef, mappings map[string]map[string]int32) error {
+	serializedMappings, err := json.Marshal(mappings)
+	if err != nil {
+		return err
+	}
+	serializedJson, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				mappingsAnnotation: string(serializedMappings),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if workload.Kind == "StatefulSet" {
+		_, err = client.AppsV1().StatefulSets(workload.Namespace).Patch(context.Background(), workload.Name, types.MergePatchType, serializedJson, metav1.PatchOptions{})
+	} else {
+		_, err = client.AppsV1().Deployments(workload.Namespace).Patch(context.Background(), workload.Name, types.MergePatchType, serializedJson, metav1.PatchOptions{})
+	}
+	return err
+}
+
+// Replaces the content of the discovery ConfigMap. It is owned by the workload, so it is garbage collected together with it.
+func updateDiscoveryConfigMap(client kubernetes.Interface, workload *workloadRef, endpoints map[string]map[string]discoveryEndpoint) error {
+	serializedEndpoints, err := json.Marshal(endpoints)
+	if err != nil {
+		return err
+	}
+	name := workload.Name + discoveryConfigMapSuffix
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMaps := client.CoreV1().ConfigMaps(workload.Namespace)
+		configMap, err := configMaps.Get(context.Background(), name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			_, err = configMaps.Create(context.Background(), &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: workload.Namespace,
+					Labels:    managedLabels(),
+					OwnerReferences: []metav1.OwnerReference{
+						{
+							APIVersion: workload.APIVersion,
+							Kind:       workload.Kind,
+							Name:       workload.Name,
+							UID:        workload.UID,
+						},
+					},
+				},
+				Data: map[string]string{
+					discoveryConfigMapKey: string(serializedEndpoints),
+				},
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[discoveryConfigMapKey] = string(serializedEndpoints)
+		_, err = configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,168 @@
+// Package nodeaddr selects the addresses of a node that are advertised for its dynamic hostports.
+package nodeaddr
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Addresses returns the addresses of the node with the address type. Addresses inside an earlier cidr come first.
+// Unless all addresses are requested only the first address per ip family is returned.
+func Addresses(node *v1.Node, addressType v1.NodeAddressType, preferredCidrs []*net.IPNet, all bool) []string {
+	var ips []string
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == addressType {
+			ips = append(ips, addr.Address)
+		}
+	}
+	ips = SortByCidrPreference(ips, preferredCidrs)
+	if !all {
+		ips = FirstPerFamily(ips)
+	}
+	return ips
+}
+
+// IsIPv6 returns true if the ip is a valid IPv6 address
+func IsIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// FirstPerFamily keeps the first IPv4 and the first IPv6 address, so dual-stack nodes are reachable over both families
+func FirstPerFamily(ips []string) []string {
+	var result []string
+	hasV4, hasV6 := false, false
+	for _, ip := range ips {
+		if IsIPv6(ip) {
+			if !hasV6 {
+				hasV6 = true
+				result = append(result, ip)
+			}
+		} else if !hasV4 {
+			hasV4 = true
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// IsDualStack returns true if the ips contain IPv4 as well as IPv6 addresses
+func IsDualStack(ips []string) bool {
+	return len(FirstPerFamily(ips)) > 1
+}
+
+// CidrPreferenceIndex returns the index of the first cidr that contains the ip or len(cidrs) if there is none
+func CidrPreferenceIndex(ip string, cidrs []*net.IPNet) int {
+	parsed := net.ParseIP(ip)
+	for i, cidr := range cidrs {
+		if parsed != nil && cidr.Contains(parsed) {
+			return i
+		}
+	}
+	return len(cidrs)
+}
+
+// SortByCidrPreference stable sorts the ips so that ips inside of an earlier cidr come first.
+// Ips that are not in any cidr are kept at the end.
+func SortByCidrPreference(ips []string, cidrs []*net.IPNet) []string {
+	if len(cidrs) == 0 {
+		return ips
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		return CidrPreferenceIndex(ips[i], cidrs) < CidrPreferenceIndex(ips[j], cidrs)
+	})
+	return ips
+}
+
+// ParseCidrs will split a string of '10.0.0.0/8,192.168.0.0/16' into a list of networks
+func ParseCidrs(cidrsString string) ([]*net.IPNet, error) {
+	if cidrsString == "" {
+		return nil, nil
+	}
+
+	var cidrs []*net.IPNet
+	for _, val := range strings.Split(cidrsString, ",") {
+		_, cidr, err := net.ParseCIDR(strings.TrimSpace(val))
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// LocalClusterKind returns the name of the local development cluster (e.g. kind or minikube) the node belongs to,
+// or an empty string if it doesn't look like one. Their nodes usually have no external ip.
+func LocalClusterKind(node *v1.Node) string {
+	switch {
+	case strings.HasPrefix(node.Spec.ProviderID, "kind://"):
+		return "kind"
+	case node.Labels["minikube.k8s.io/name"] != "":
+		return "minikube"
+	case node.Name == "docker-desktop" || node.Name == "desktop-control-plane":
+		return "Docker Desktop"
+	case node.Name == "lima-rancher-desktop":
+		return "Rancher Desktop"
+	case strings.HasPrefix(node.Name, "k3d-"):
+		return "k3d"
+	}
+	return ""
+}
+
+// ParseAddressTypes will split a string of 'ExternalIP,InternalIP' into an ordered list of node address types
+func ParseAddressTypes(typesString string) ([]v1.NodeAddressType, error) {
+	var types []v1.NodeAddressType
+	for _, val := range strings.Split(typesString, ",") {
+		addressType := v1.NodeAddressType(strings.TrimSpace(val))
+		switch addressType {
+		case v1.NodeExternalIP, v1.NodeExternalDNS, v1.NodeInternalIP, v1.NodeInternalDNS, v1.NodeHostName:
+			types = append(types, addressType)
+		default:
+			return nil, errors.New("Invalid node address type '" + val + "'")
+		}
+	}
+	return types, nil
+}
+
+// ParseNameTypes parses the address types like ParseAddressTypes, but only allows the ones that are names
+// (ExternalDNS, InternalDNS, Hostname). An empty string is no type at all.
+func ParseNameTypes(typesString string) ([]v1.NodeAddressType, error) {
+	if strings.TrimSpace(typesString) == "" {
+		return nil, nil
+	}
+	types, err := ParseAddressTypes(typesString)
+	if err != nil {
+		return nil, err
+	}
+	for _, addressType := range types {
+		if addressType == v1.NodeExternalIP || addressType == v1.NodeInternalIP {
+			return nil, errors.New("Node address type '" + string(addressType) + "' is not a name")
+		}
+	}
+	return types, nil
+}
+
+// AddressesByPriority returns the addresses of the first of the address types that the node has, and that type
+func AddressesByPriority(node *v1.Node, types []v1.NodeAddressType, preferredCidrs []*net.IPNet, all bool) ([]string, v1.NodeAddressType) {
+	for _, addressType := range types {
+		if ips := Addresses(node, addressType, preferredCidrs, all); len(ips) > 0 {
+			return ips, addressType
+		}
+	}
+	return nil, ""
+}
+
+// IPs returns the addresses that are ips. DNS names and hostnames can't be external ips of a service.
+func IPs(addresses []string) []string {
+	var ips []string
+	for _, address := range addresses {
+		if net.ParseIP(address) != nil {
+			ips = append(ips, address)
+		}
+	}
+	return ips
+}
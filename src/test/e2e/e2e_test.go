@@ -0,0 +1,241 @@
+//go:build e2e
+
+// Package e2e deploys the controller into a kind cluster and connects to example workloads through their node ports.
+// It requires docker, kind and kubectl:
+//
+//	go test -tags e2e -timeout 20m ./test/e2e/
+//
+// E2E_KEEP_CLUSTER=true keeps the cluster for debugging.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const clusterName = "dynamic-hostports-e2e"
+const image = "dynamic-hostports:e2e"
+const annotationPrefix = "dynamic-hostports.k8s"
+
+// Serves its hostname over http on 8080 and replies to 'hostname' over udp on 8081
+const echoImage = "registry.k8s.io/e2e-test-images/agnhost:2.47"
+
+// The repository root, relative to this package
+const repositoryRoot = "../../.."
+
+var client kubernetes.Interface
+var kubeconfig string
+
+func TestMain(m *testing.M) {
+	for _, tool := range []string{"docker", "kind", "kubectl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			fmt.Printf("Skipping the e2e tests, %s is not installed\n", tool)
+			os.Exit(0)
+		}
+	}
+	os.Exit(run(m))
+}
+
+func command(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func kubectl(args ...string) error {
+	return command("kubectl", append([]string{"--kubeconfig", kubeconfig}, args...)...)
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "dynamic-hostports-e2e")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig = filepath.Join(dir, "kubeconfig")
+
+	steps := []func() error{
+		func() error { return command("docker", "build", "-t", image, repositoryRoot) },
+		func() error {
+			return command("kind", "create", "cluster", "--name", clusterName, "--kubeconfig", kubeconfig, "--wait", "5m")
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			fmt.Println("Failed to set up the cluster", err)
+			return 1
+		}
+	}
+	if os.Getenv("E2E_KEEP_CLUSTER") != "true" {
+		defer command("kind", "delete", "cluster", "--name", clusterName)
+	}
+
+	steps = []func() error{
+		func() error { return command("kind", "load", "docker-image", image, "--name", clusterName) },
+		func() error { return kubectl("apply", "-f", filepath.Join(repositoryRoot, "deploy.yaml")) },
+		func() error {
+			return kubectl("-n", "dynamic-hostports", "patch", "deployment", "dynamic-hostports-deployment", "--type", "json", "-p",
+				`[{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "`+image+`"},`+
+					`{"op": "replace", "path": "/spec/template/spec/containers/0/imagePullPolicy", "value": "IfNotPresent"}]`)
+		},
+		// kind nodes have no external ip
+		func() error {
+			return kubectl("-n", "dynamic-hostports", "set", "env", "deployment/dynamic-hostports-deployment", "DYNAMIC_HOSTPORTS_NODE_ADDRESS_PREFERENCE=InternalIP")
+		},
+		func() error {
+			return kubectl("-n", "dynamic-hostports", "rollout", "status", "deployment/dynamic-hostports-deployment", "--timeout", "5m")
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			fmt.Println("Failed to deploy the controller", err)
+			return 1
+		}
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	client, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	code := m.Run()
+	if code != 0 {
+		kubectl("-n", "dynamic-hostports", "logs", "deployment/dynamic-hostports-deployment")
+	}
+	return code
+}
+
+func createEchoPod(t *testing.T, name string, labelValue string) {
+	t.Helper()
+	_, err := client.CoreV1().Pods("default").Create(context.Background(), &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"dynamic-hostports": labelValue},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "echo",
+					Image: echoImage,
+					Args:  []string{"netexec", "--http-port=8080", "--udp-port=8081"},
+					Ports: []v1.ContainerPort{
+						{ContainerPort: 8080, Protocol: v1.ProtocolTCP},
+						{ContainerPort: 8081, Protocol: v1.ProtocolUDP},
+					},
+				},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.CoreV1().Pods("default").Delete(context.Background(), name, metav1.DeleteOptions{})
+	})
+}
+
+// Waits until the controller annotated the endpoint of the port and returns it
+func waitForEndpoint(t *testing.T, podName string, port string) string {
+	t.Helper()
+	var endpoint string
+	err := wait.PollUntilContextTimeout(context.Background(), time.Second, 3*time.Minute, true, func(ctx context.Context) (bool, error) {
+		pod, err := client.CoreV1().Pods("default").Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		endpoint = pod.Annotations[annotationPrefix+"/endpoint-"+port]
+		return endpoint != "", nil
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for the endpoint of port %s %s", port, err)
+	}
+	return endpoint
+}
+
+// Retries the check, kube-proxy needs a moment until the node port is reachable
+func eventuallyReachable(t *testing.T, description string, check func() (string, error), expected string) {
+	t.Helper()
+	var lastErr error
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(time.Second) {
+		response, err := check()
+		if err == nil && strings.TrimSpace(response) == expected {
+			return
+		}
+		lastErr = fmt.Errorf("got '%s' %v", response, err)
+	}
+	t.Fatalf("%s is not reachable %s", description, lastErr)
+}
+
+func TestTcpAndUdpConnectivity(t *testing.T) {
+	createEchoPod(t, "echo-0", "auto")
+
+	tcpEndpoint := waitForEndpoint(t, "echo-0", "8080")
+	httpClient := http.Client{Timeout: 5 * time.Second}
+	eventuallyReachable(t, "tcp endpoint "+tcpEndpoint, func() (string, error) {
+		response, err := httpClient.Get("http://" + tcpEndpoint + "/hostname")
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		return string(body), err
+	}, "echo-0")
+
+	udpEndpoint := waitForEndpoint(t, "echo-0", "8081-udp")
+	eventuallyReachable(t, "udp endpoint "+udpEndpoint, func() (string, error) {
+		conn, err := net.DialTimeout("udp", udpEndpoint, 5*time.Second)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hostname"))
+		if err != nil {
+			return "", err
+		}
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		return string(buffer[:n]), err
+	}, "echo-0")
+}
+
+func TestServicesAreDeletedWithThePod(t *testing.T) {
+	createEchoPod(t, "echo-1", "8080")
+	waitForEndpoint(t, "echo-1", "8080")
+
+	err := client.CoreV1().Pods("default").Delete(context.Background(), "echo-1", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollUntilContextTimeout(context.Background(), time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+		services, err := client.CoreV1().Services("default").List(ctx, metav1.ListOptions{
+			LabelSelector: annotationPrefix + "/for-pod=echo-1",
+		})
+		return err == nil && len(services.Items) == 0, err
+	})
+	if err != nil {
+		t.Fatalf("The services of the deleted pod still exist %s", err)
+	}
+}
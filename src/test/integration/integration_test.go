@@ -0,0 +1,318 @@
+//go:build integration
+
+// Package integration runs the controller binary against the real api server and etcd of envtest.
+// The binaries are installed with setup-envtest and found via KUBEBUILDER_ASSETS:
+//
+//	KUBEBUILDER_ASSETS=$(setup-envtest use -p path) go test -tags integration ./test/integration/
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+const labelKey = "dynamic-hostports"
+const annotationPrefix = "dynamic-hostports.k8s"
+const forPodLabelKey = annotationPrefix + "/for-pod"
+
+const nodeName = "integration-node"
+const nodeIp = "203.0.113.20"
+
+// Requests for this port are rejected by the port policy
+const deniedPort = 9999
+
+var client kubernetes.Interface
+
+// The built controller and the kubeconfig of envtest
+var binary string
+var kubeconfig string
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		fmt.Println("Skipping the integration tests, KUBEBUILDER_ASSETS is not set")
+		os.Exit(0)
+	}
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "dynamic-hostports-integration")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	binary = filepath.Join(dir, "k8s-dynamic-hostport")
+	build := exec.Command("go", "build", "-o", binary, "../..")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Println("Failed to build the controller", err)
+		return 1
+	}
+
+	environment := &envtest.Environment{}
+	config, err := environment.Start()
+	if err != nil {
+		fmt.Println("Failed to start envtest", err)
+		return 1
+	}
+	defer environment.Stop()
+
+	client, err = kubernetes.NewForConfig(config)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	user, err := environment.AddUser(envtest.User{Name: "dynamic-hostports", Groups: []string{"system:masters"}}, nil)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	kubeconfigContent, err := user.KubeConfig()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	kubeconfig = filepath.Join(dir, "kubeconfig")
+	if err := os.WriteFile(kubeconfig, kubeconfigContent, 0o600); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if err := createNode(); err != nil {
+		fmt.Println("Failed to create the node", err)
+		return 1
+	}
+
+	// Without a namespace all of them are watched, every test uses its own
+	controller := exec.Command(binary, "run", "--kubeconfig", kubeconfig, "--metrics-address", "", "--denied-ports", strconv.Itoa(deniedPort))
+	controller.Stdout, controller.Stderr = os.Stdout, os.Stderr
+	if err := controller.Start(); err != nil {
+		fmt.Println("Failed to start the controller", err)
+		return 1
+	}
+	defer controller.Process.Kill()
+
+	return m.Run()
+}
+
+// There is no kubelet, so the node and its addresses are created by hand
+func createNode() error {
+	node, err := client.CoreV1().Nodes().Create(context.Background(), &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: nodeIp}}
+	_, err = client.CoreV1().Nodes().UpdateStatus(context.Background(), node, metav1.UpdateOptions{})
+	return err
+}
+
+func createNamespace(t *testing.T) string {
+	t.Helper()
+	namespace, err := client.CoreV1().Namespaces().Create(context.Background(), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "integration-"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return namespace.Name
+}
+
+// Creates the pod and marks it as running, like the kubelet would
+func createRunningPod(t *testing.T, namespace string, name string, labelValue string, annotations map[string]string) *v1.Pod {
+	t.Helper()
+	pod, err := client.CoreV1().Pods(namespace).Create(context.Background(), &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{labelKey: labelValue},
+			Annotations: annotations,
+		},
+		Spec: v1.PodSpec{
+			NodeName:   nodeName,
+			Containers: []v1.Container{{Name: "app", Image: "app"}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pod.Status = v1.PodStatus{
+		Phase:      v1.PodRunning,
+		PodIP:      "10.1.0.5",
+		HostIP:     nodeIp,
+		Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+	}
+	pod, err = client.CoreV1().Pods(namespace).UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pod
+}
+
+func eventually(t *testing.T, description string, condition func() (bool, error)) {
+	t.Helper()
+	err := wait.PollUntilContextTimeout(context.Background(), 100*time.Millisecond, 30*time.Second, true, func(ctx context.Context) (bool, error) {
+		return condition()
+	})
+	if err != nil {
+		t.Fatalf("Timed out waiting for %s %s", description, err)
+	}
+}
+
+func getService(t *testing.T, namespace string, name string) *v1.Service {
+	t.Helper()
+	var service *v1.Service
+	eventually(t, "service "+name, func() (bool, error) {
+		var err error
+		service, err = client.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	return service
+}
+
+func waitForWarning(t *testing.T, namespace string, reason string) {
+	t.Helper()
+	eventually(t, "event "+reason, func() (bool, error) {
+		events, err := client.CoreV1().Events(namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events.Items {
+			if event.Type == v1.EventTypeWarning && event.Reason == reason {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+func TestPodLifecycle(t *testing.T) {
+	namespace := createNamespace(t)
+	pod := createRunningPod(t, namespace, "game-0", "8080.27015", nil)
+
+	service := getService(t, namespace, "game-0-8080")
+	nodePort := service.Spec.Ports[0].NodePort
+	if nodePort == 0 {
+		t.Fatal("Expected the api server to allocate a node port")
+	}
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != nodeIp {
+		t.Errorf("Expected the external ip of the node, got %v", service.Spec.ExternalIPs)
+	}
+	getService(t, namespace, "game-0-27015")
+
+	endpoints, err := client.CoreV1().Endpoints(namespace).Get(context.Background(), "game-0-8080", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints.Subsets) != 1 || len(endpoints.Subsets[0].Addresses) != 1 || endpoints.Subsets[0].Addresses[0].IP != pod.Status.PodIP {
+		t.Errorf("Expected the endpoints to point to the pod ip, got %+v", endpoints.Subsets)
+	}
+
+	eventually(t, "pod annotation", func() (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(context.Background(), "game-0", metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return pod.Annotations[annotationPrefix+"/8080"] == strconv.Itoa(int(nodePort)), nil
+	})
+
+	zero := int64(0)
+	err = client.CoreV1().Pods(namespace).Delete(context.Background(), "game-0", metav1.DeleteOptions{GracePeriodSeconds: &zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "deletion of the services", func() (bool, error) {
+		services, err := client.CoreV1().Services(namespace).List(context.Background(), metav1.ListOptions{})
+		return err == nil && len(services.Items) == 0, err
+	})
+
+	// There is no endpoints controller in envtest that removes the endpoints together with their service
+	cleanup := exec.Command(binary, "cleanup", "--kubeconfig", kubeconfig, "--namespace", namespace)
+	cleanup.Stdout, cleanup.Stderr = os.Stdout, os.Stderr
+	if err := cleanup.Run(); err != nil {
+		t.Fatal(err)
+	}
+	endpointsList, err := client.CoreV1().Endpoints(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpointsList.Items) != 0 {
+		t.Errorf("Expected the cleanup to delete the endpoints, got %d", len(endpointsList.Items))
+	}
+}
+
+func TestNodePortConflict(t *testing.T) {
+	namespace := createNamespace(t)
+	occupied, err := client.CoreV1().Services(namespace).Create(context.Background(), &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "occupied"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Port: 80}},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	occupiedNodePort := occupied.Spec.Ports[0].NodePort
+
+	createRunningPod(t, namespace, "game-0", "8080", map[string]string{
+		annotationPrefix + "/preferred-8080": strconv.Itoa(int(occupiedNodePort)),
+	})
+
+	service := getService(t, namespace, "game-0-8080")
+	if service.Spec.Ports[0].NodePort == 0 || service.Spec.Ports[0].NodePort == occupiedNodePort {
+		t.Errorf("Expected another node port than %d, got %d", occupiedNodePort, service.Spec.Ports[0].NodePort)
+	}
+	waitForWarning(t, namespace, "NodePortConflict")
+}
+
+func TestDeniedPort(t *testing.T) {
+	namespace := createNamespace(t)
+	createRunningPod(t, namespace, "game-0", "8080."+strconv.Itoa(deniedPort), nil)
+
+	getService(t, namespace, "game-0-8080")
+	waitForWarning(t, namespace, "PortNotAllowed")
+
+	_, err := client.CoreV1().Services(namespace).Get(context.Background(), "game-0-"+strconv.Itoa(deniedPort), metav1.GetOptions{})
+	if !k8sErrors.IsNotFound(err) {
+		t.Errorf("Expected no service for the denied port, got %v", err)
+	}
+}
+
+func TestInvalidLabelValue(t *testing.T) {
+	namespace := createNamespace(t)
+	createRunningPod(t, namespace, "broken-0", "http", nil)
+	createRunningPod(t, namespace, "game-0", "8080", nil)
+
+	// The events are handled in order, so the broken pod was handled once the service of the next pod exists
+	getService(t, namespace, "game-0-8080")
+	services, err := client.CoreV1().Services(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: forPodLabelKey + "=broken-0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 0 {
+		t.Errorf("Expected no services for a pod with an invalid label value, got %d", len(services.Items))
+	}
+	waitForWarning(t, namespace, "InvalidPortRequest")
+}